@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogLine(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	path := filepath.Join(t.TempDir(), "access.log")
+	useConfig(t, map[string]string{"ACCESS_LOG": path})
+	prev := accessLog
+	t.Cleanup(func() { accessLog = prev })
+	if err := initAccessLog(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accessLog.(*os.File).Close() })
+
+	srv := httptest.NewServer(withAccessLog(p.Config.Handler))
+	t.Cleanup(srv.Close)
+	send(t, http.MethodPost, srv.URL+"/public?v=1", `{"query":"{ a }"}`, map[string]string{
+		"Content-Type": "application/json",
+		"Referer":      "https://shop.example/cart",
+		"User-Agent":   `curl/8.5.0 "quoted"`,
+	})
+	send(t, http.MethodGet, srv.URL+"/missing", "", map[string]string{"User-Agent": ""})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("access log = %q, want 2 lines", data)
+	}
+	patterns := []string{
+		`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /public\?v=1 HTTP/1\.1" 200 11 "https://shop\.example/cart" "curl/8\.5\.0 \\"quoted\\"" \d+$`,
+		`^127\.0\.0\.1 - - \[[^\]]+\] "GET /missing HTTP/1\.1" 404 \d+ "-" "-" \d+$`,
+	}
+	for i, pattern := range patterns {
+		if !regexp.MustCompile(pattern).MatchString(lines[i]) {
+			t.Errorf("line %d = %q\ndoes not match %s", i+1, lines[i], pattern)
+		}
+	}
+}
+
+func TestAccessLogEmptyBody(t *testing.T) {
+	var buf strings.Builder
+	prev := accessLog
+	accessLog = &buf
+	t.Cleanup(func() { accessLog = prev })
+	useConfig(t, nil)
+
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if !strings.Contains(buf.String(), `"GET /healthz HTTP/1.1" 200 - `) {
+		t.Errorf("line = %q, want status 200 and size -", buf.String())
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"ACCESS_LOG": ""})
+	prev := accessLog
+	accessLog = nil
+	t.Cleanup(func() { accessLog = prev })
+	if err := initAccessLog(); err != nil || accessLog != nil {
+		t.Fatalf("initAccessLog = %v, accessLog = %v", err, accessLog)
+	}
+	// A wrapped handler would write its line to the nil accessLog and panic.
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultLogsLimit = 20
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func adminLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn := mongoConn.Load()
+	if conn == nil {
+		http.Error(w, "MongoDB is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		http.Error(w, "Missing ip parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultLogsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > cfg.MaxLogsLimit {
+		limit = cfg.MaxLogsLimit
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetLimit(int64(limit))
+	cursor, err := conn.logs.Find(r.Context(), bson.M{"ip": ip}, opts)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error querying MongoDB", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	entries := []logEntry{}
+	if err := cursor.All(r.Context(), &entries); err != nil {
+		slog.ErrorContext(r.Context(), "Error decoding MongoDB logs", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// registerPprof exposes the runtime profiles behind the admin token.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", requireAdmin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAdmin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAdmin(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAdmin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAdmin(pprof.Trace))
+}
+
+// adminReplayHandler re-sends a logged query to the current backend and
+// returns the backend's response as-is. Replays bypass the GraphQL handler, so
+// they are not rate limited or logged as client traffic. Mutations are only
+// replayed with allowMutation=true since they re-execute writes.
+func adminReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn := mongoConn.Load()
+	if conn == nil {
+		http.Error(w, "MongoDB is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id parameter", http.StatusBadRequest)
+		return
+	}
+
+	var entry logEntry
+	err = conn.logs.FindOne(r.Context(), bson.M{"_id": id}).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Log entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error querying MongoDB", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if entry.SanitizedQuery == "" {
+		http.Error(w, "Log entry has no stored query text", http.StatusUnprocessableEntity)
+		return
+	}
+
+	opType := operationType(entry.SanitizedQuery, entry.OperationName)
+	if opType == "mutation" && r.URL.Query().Get("allowMutation") != "true" {
+		http.Error(w, "Refusing to replay a mutation without allowMutation=true", http.StatusConflict)
+		return
+	}
+
+	payload := map[string]interface{}{"query": entry.SanitizedQuery}
+	if entry.OperationName != "" {
+		payload["operationName"] = entry.OperationName
+	}
+	if entry.Variables != nil {
+		payload["variables"] = entry.Variables
+	}
+	body, _ := json.Marshal(payload)
+
+	// The query goes to the route it was originally proxied on, not to this
+	// admin URL. Entries logged before routes were recorded use the first.
+	path := entry.Route
+	if path == "" && len(cfg.Routes) > 0 {
+		path = cfg.Routes[0]
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(cfg.RequestIDHeader, newRequestID())
+	req.Header.Set("X-Replay-Of", id.Hex())
+
+	activeBackends.Load().forOperation(opType).ServeHTTP(w, req)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"no token configured", "", "Bearer anything", http.StatusNotFound},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"valid token", "secret", "Bearer secret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]string{"ADMIN_TOKEN": tt.token})
+			rec := serve(requireAdmin(ok), http.MethodGet, "/admin/logs", "", map[string]string{"Authorization": tt.header})
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminLogsHandlerWithoutMongo(t *testing.T) {
+	useConfig(t, nil)
+	prev := mongoConn.Swap(nil)
+	t.Cleanup(func() { mongoConn.Store(prev) })
+
+	rec := serve(adminLogsHandler, http.MethodGet, "/admin/logs?ip=203.0.113.7", "", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAdminLogsHandler(t *testing.T) {
+	mt := newMockMongo(t)
+
+	mt.Run("rejects bad parameters", func(mt *mtest.T) {
+		useConfig(mt.T, nil)
+		useMockMongo(mt)
+		for _, target := range []string{"/admin/logs", "/admin/logs?ip=1.2.3.4&limit=0", "/admin/logs?ip=1.2.3.4&limit=x"} {
+			if rec := serve(adminLogsHandler, http.MethodGet, target, "", nil); rec.Code != http.StatusBadRequest {
+				mt.Errorf("%s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+			}
+		}
+		if rec := serve(adminLogsHandler, http.MethodPost, "/admin/logs?ip=1.2.3.4", "", nil); rec.Code != http.StatusMethodNotAllowed {
+			mt.Errorf("POST: status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mt.Run("returns the newest entries for the ip", func(mt *mtest.T) {
+		useConfig(mt.T, map[string]string{"ADMIN_LOGS_MAX_LIMIT": "5"})
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.logs", mtest.FirstBatch,
+			bson.D{{Key: "ip", Value: "203.0.113.7"}, {Key: "status", Value: 200}},
+			bson.D{{Key: "ip", Value: "203.0.113.7"}, {Key: "status", Value: 429}},
+		))
+
+		rec := serve(adminLogsHandler, http.MethodGet, "/admin/logs?ip=203.0.113.7&limit=50", "", nil)
+		if rec.Code != http.StatusOK {
+			mt.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+		var entries []logEntry
+		if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+			mt.Fatal(err)
+		}
+		if len(entries) != 2 || entries[1].Status != 429 {
+			mt.Errorf("entries = %+v", entries)
+		}
+
+		cmd := mt.GetStartedEvent().Command
+		if ip := cmd.Lookup("filter", "ip").StringValue(); ip != "203.0.113.7" {
+			mt.Errorf("filter ip = %q", ip)
+		}
+		if limit := cmd.Lookup("limit").AsInt64(); limit != 5 {
+			mt.Errorf("limit = %d, want it capped at 5", limit)
+		}
+		if dir := cmd.Lookup("sort", "timestamp").AsInt64(); dir != -1 {
+			mt.Errorf("sort timestamp = %d, want -1", dir)
+		}
+	})
+}
+
+func TestPprofRequiresAdminToken(t *testing.T) {
+	useConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		rec := serve(mux.ServeHTTP, http.MethodGet, path, "", nil)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without token: status = %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+		rec = serve(mux.ServeHTTP, http.MethodGet, path, "", map[string]string{"Authorization": "Bearer secret"})
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s with token: status = %d, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestAdminReplayHandler(t *testing.T) {
+	mt := newMockMongo(t)
+	id := primitive.NewObjectID()
+	entryResponse := func(fields ...bson.E) bson.D {
+		return mtest.CreateCursorResponse(0, "db.logs", mtest.FirstBatch, append(bson.D{{Key: "_id", Value: id}}, fields...))
+	}
+
+	mt.Run("replays to the logged route", func(mt *mtest.T) {
+		p := newTestProxy(mt.T, map[string]string{"GRAPHQL_ROUTES": "/public,/internal"}, nil)
+		useMockMongo(mt)
+		mt.AddMockResponses(entryResponse(
+			bson.E{Key: "route", Value: "/internal"},
+			bson.E{Key: "operationName", Value: "Items"},
+			bson.E{Key: "sanitizedQuery", Value: "query Items($n: Int) { items(first: $n) }"},
+			bson.E{Key: "variables", Value: bson.D{{Key: "n", Value: 2}}},
+		))
+
+		rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?id="+id.Hex(), "", nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"data":{}}` {
+			mt.Fatalf("replay = %d %s", rec.Code, rec.Body)
+		}
+		got := p.backend.last(mt.T)
+		if got.Path != "/internal" || got.Query != "" {
+			mt.Errorf("backend received %s?%s, want /internal without the admin query", got.Path, got.Query)
+		}
+		if got.Header.Get("X-Replay-Of") != id.Hex() {
+			mt.Errorf("X-Replay-Of = %q", got.Header.Get("X-Replay-Of"))
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(got.Body), &payload); err != nil {
+			mt.Fatal(err)
+		}
+		if payload["operationName"] != "Items" || payload["variables"].(map[string]interface{})["n"] != float64(2) {
+			mt.Errorf("replayed payload = %v", payload)
+		}
+		if n := len(p.logs.recent()); n != 0 {
+			mt.Errorf("replay was logged as client traffic: %d entries", n)
+		}
+	})
+
+	mt.Run("falls back to the first route", func(mt *mtest.T) {
+		p := newTestProxy(mt.T, map[string]string{"GRAPHQL_ROUTES": "/public,/internal"}, nil)
+		useMockMongo(mt)
+		mt.AddMockResponses(entryResponse(bson.E{Key: "sanitizedQuery", Value: "{ a }"}))
+		if rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?id="+id.Hex(), "", nil); rec.Code != http.StatusOK {
+			mt.Fatalf("replay = %d %s", rec.Code, rec.Body)
+		}
+		if path := p.backend.last(mt.T).Path; path != "/public" {
+			mt.Errorf("backend path = %q, want /public", path)
+		}
+	})
+
+	mt.Run("guards mutations", func(mt *mtest.T) {
+		p := newTestProxy(mt.T, nil, nil)
+		useMockMongo(mt)
+		mt.AddMockResponses(entryResponse(bson.E{Key: "sanitizedQuery", Value: "mutation { buy }"}))
+		if rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?id="+id.Hex(), "", nil); rec.Code != http.StatusConflict {
+			mt.Errorf("mutation replay = %d, want %d", rec.Code, http.StatusConflict)
+		}
+		mt.AddMockResponses(entryResponse(bson.E{Key: "sanitizedQuery", Value: "mutation { buy }"}))
+		if rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?allowMutation=true&id="+id.Hex(), "", nil); rec.Code != http.StatusOK {
+			mt.Errorf("allowed mutation replay = %d, want %d", rec.Code, http.StatusOK)
+		}
+		if n := len(p.backend.received()); n != 1 {
+			mt.Errorf("backend received %d requests, want 1", n)
+		}
+	})
+
+	mt.Run("rejects bad requests", func(mt *mtest.T) {
+		newTestProxy(mt.T, nil, nil)
+		useMockMongo(mt)
+		if rec := serve(adminReplayHandler, http.MethodGet, "/admin/replay?id="+id.Hex(), "", nil); rec.Code != http.StatusMethodNotAllowed {
+			mt.Errorf("GET = %d", rec.Code)
+		}
+		if rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?id=nope", "", nil); rec.Code != http.StatusBadRequest {
+			mt.Errorf("bad id = %d", rec.Code)
+		}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.logs", mtest.FirstBatch))
+		if rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?id="+id.Hex(), "", nil); rec.Code != http.StatusNotFound {
+			mt.Errorf("missing entry = %d", rec.Code)
+		}
+		mt.AddMockResponses(entryResponse())
+		if rec := serve(adminReplayHandler, http.MethodPost, "/admin/replay?id="+id.Hex(), "", nil); rec.Code != http.StatusUnprocessableEntity {
+			mt.Errorf("entry without query = %d", rec.Code)
+		}
+	})
+}
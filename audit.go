@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// auditEntry is the security audit record written for every rejected request.
+// It is kept apart from the request logs so it survives their sampling and
+// filtering options. Audit entries are stored in MongoDB, so AUDIT_LOG is only
+// on by default with LOG_SINK=mongo.
+type auditEntry struct {
+	Reason        string    `bson:"reason" json:"reason"`
+	Status        int       `bson:"status" json:"status"`
+	Message       string    `bson:"message" json:"message"`
+	RequestID     string    `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	IP            string    `bson:"ip" json:"ip"`
+	OperationName string    `bson:"operationName,omitempty" json:"operationName,omitempty"`
+	Timestamp     time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// auditSink queues audit entries for MongoDB. It is nil unless AUDIT_LOG is
+// on.
+var auditSink *batchSink[auditEntry]
+
+func initAuditSink() {
+	if cfg.AuditLog {
+		auditSink = newBatchSink("audit", writeAuditBatch)
+	}
+}
+
+func auditRejection(rc *RequestContext, rej *rejection) {
+	if auditSink == nil || mongoConn.Load() == nil {
+		return
+	}
+	auditSink.Write(auditEntry{
+		Reason:        rej.reason,
+		Status:        rej.status,
+		Message:       rej.msg,
+		RequestID:     rc.RequestID,
+		IP:            rc.ClientIP,
+		OperationName: rc.OperationName,
+		Timestamp:     time.Now(),
+	})
+}
+
+func writeAuditBatch(ctx context.Context, entries []auditEntry) error {
+	conn := mongoConn.Load()
+	if conn == nil {
+		return errors.New("MongoDB is unavailable")
+	}
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
+	}
+	err := withMongoWriteSlot(ctx, func() error {
+		_, err := conn.audit.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		return err
+	})
+	reportMongoResult(err)
+	return err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// useAuditQueue installs an audit sink whose queue the test reads directly,
+// with nothing draining it.
+func useAuditQueue(t *testing.T, size int) chan auditEntry {
+	prevSink, prevConn := auditSink, mongoConn.Load()
+	queue := make(chan auditEntry, size)
+	auditSink = &batchSink[auditEntry]{name: "audit", queue: queue}
+	if prevConn == nil {
+		mongoConn.Store(&mongoHandles{})
+	}
+	t.Cleanup(func() {
+		auditSink = prevSink
+		mongoConn.Store(prevConn)
+	})
+	return queue
+}
+
+func TestRejectionsAreAudited(t *testing.T) {
+	tests := []struct {
+		reason string
+		env    map[string]string
+		body   string
+	}{
+		{"rate_limit", map[string]string{"RATE_LIMIT_PER_MINUTE": "1"}, `{"query":"{ a }"}`},
+		{"auth", map[string]string{"HMAC_SECRET": "s"}, `{"query":"{ a }"}`},
+		{"introspection", map[string]string{"DISABLE_INTROSPECTION": "true"}, `{"query":"{ __schema { types { name } } }"}`},
+		{"depth", map[string]string{"MAX_QUERY_DEPTH": "1"}, `{"query":"{ a { b } }"}`},
+		{"cost", map[string]string{"MAX_QUERY_COST": "1"}, `{"query":"{ a b c }"}`},
+		{"operation", map[string]string{"ALLOWED_OPERATIONS": "Known"}, `{"query":"query Unknown { a }"}`},
+		{"bad_request", nil, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			p := newTestProxy(t, tt.env, nil)
+			queue := useAuditQueue(t, 10)
+			if tt.reason == "rate_limit" {
+				checkRateLimit("127.0.0.1")
+			}
+			resp, _ := p.post(t, "/public", tt.body, nil)
+			if resp.StatusCode < http.StatusBadRequest {
+				t.Fatalf("status = %d, want a rejection", resp.StatusCode)
+			}
+			select {
+			case entry := <-queue:
+				if entry.Reason != tt.reason || entry.Status != resp.StatusCode || entry.IP != "127.0.0.1" || entry.Message == "" {
+					t.Errorf("audit entry = %+v, want reason %q", entry, tt.reason)
+				}
+				if entry.RequestID != resp.Header.Get("X-Request-Id") || entry.Timestamp.IsZero() {
+					t.Errorf("audit entry = %+v", entry)
+				}
+			default:
+				t.Fatal("no audit entry queued")
+			}
+		})
+	}
+}
+
+func TestAcceptedRequestsAreNotAudited(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	queue := useAuditQueue(t, 10)
+	p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if len(queue) != 0 {
+		t.Errorf("accepted request queued %d audit entries", len(queue))
+	}
+}
+
+func TestAuditQueueDropsWhenFull(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	useAuditQueue(t, 1)
+	before := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("audit"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			http.Post(p.URL+"/public", "application/json", nil)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("rejections blocked on the full audit queue")
+	}
+	if got := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("audit")); got != before+2 {
+		t.Errorf(`logs_dropped_total{sink="audit"} = %v, want %v`, got, before+2)
+	}
+}
+
+func TestAuditNeedsSinkAndMongo(t *testing.T) {
+	useConfig(t, nil)
+	rc := &RequestContext{ClientIP: "192.0.2.1"}
+	rej := reject(http.StatusForbidden, "auth", "no")
+
+	prevSink := auditSink
+	auditSink = nil
+	auditRejection(rc, rej) // must not panic without a sink
+	auditSink = prevSink
+
+	queue := useAuditQueue(t, 1)
+	prevConn := mongoConn.Swap(nil)
+	auditRejection(rc, rej)
+	mongoConn.Store(prevConn)
+	if len(queue) != 0 {
+		t.Error("entry queued without a MongoDB connection")
+	}
+}
+
+func TestWriteAuditBatch(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("inserts into the audit collection", func(mt *mtest.T) {
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		entries := []auditEntry{{Reason: "auth", IP: "192.0.2.1"}, {Reason: "cost", IP: "192.0.2.2"}}
+		if err := writeAuditBatch(context.Background(), entries); err != nil {
+			mt.Fatal(err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		if coll := cmd.Lookup("insert").StringValue(); coll != "audit_log" {
+			mt.Errorf("inserted into %q", coll)
+		}
+		if ordered := cmd.Lookup("ordered").Boolean(); ordered {
+			mt.Error("insert is ordered")
+		}
+		docs, _ := cmd.Lookup("documents").Array().Values()
+		if len(docs) != 2 || docs[1].Document().Lookup("reason").StringValue() != "cost" {
+			mt.Errorf("documents = %v", docs)
+		}
+	})
+
+	mt.Run("fails without MongoDB", func(mt *mtest.T) {
+		prev := mongoConn.Swap(nil)
+		defer mongoConn.Store(prev)
+		if err := writeAuditBatch(context.Background(), []auditEntry{{Reason: "auth"}}); err == nil {
+			mt.Error("writeAuditBatch succeeded without a connection")
+		}
+	})
+}
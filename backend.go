@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+// backend is a single upstream with its own transport so that a backend
+// removed by a reload can drain its in-flight requests and then release its
+// connections without touching the others.
+type backend struct {
+	target    *url.URL
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+
+	mu       sync.Mutex
+	inflight int
+	retired  bool
+}
+
+// backendSet is the routing table swapped atomically on reload.
+type backendSet struct {
+	primary *backend
+	// byOperation routes an operation type ("query", "mutation",
+	// "subscription") to a dedicated backend instead of primary.
+	byOperation map[string]*backend
+	// shadow, if set, receives a copy of every query for comparison.
+	shadow *backend
+	// canary, if set, serves canaryPercent of the traffic that would go to
+	// primary. Unlike shadow it answers the client, and takes mutations too.
+	canary        *backend
+	canaryPercent float64
+}
+
+// forOperation returns the backend for opType, falling back to primary when
+// no mapping exists or the type could not be determined.
+func (s *backendSet) forOperation(opType string) *backend {
+	if b, ok := s.byOperation[opType]; ok {
+		return b
+	}
+	return s.primary
+}
+
+// useCanary decides whether a request from clientIP goes to the canary. With
+// CANARY_STICKY the choice is a hash of the IP, so a client sees one version
+// consistently for a given percentage.
+func (s *backendSet) useCanary(clientIP string) bool {
+	if s.canary == nil || s.canaryPercent <= 0 {
+		return false
+	}
+	if !cfg.CanarySticky {
+		return rand.Float64()*100 < s.canaryPercent
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientIP))
+	return float64(h.Sum32()%10000) < s.canaryPercent*100
+}
+
+// all returns each distinct backend in the set once.
+func (s *backendSet) all() []*backend {
+	seen := map[*backend]bool{s.primary: true}
+	all := []*backend{s.primary}
+	others := slices.Collect(maps.Values(s.byOperation))
+	if s.shadow != nil {
+		others = append(others, s.shadow)
+	}
+	if s.canary != nil {
+		others = append(others, s.canary)
+	}
+	for _, b := range others {
+		if !seen[b] {
+			seen[b] = true
+			all = append(all, b)
+		}
+	}
+	return all
+}
+
+var activeBackends atomic.Pointer[backendSet]
+
+// injectUpstreamHeaders sets the UPSTREAM_HEADERS on a forwarded request,
+// replacing any client-sent value. Values may reference {client_ip} and
+// {request_id}.
+func injectUpstreamHeaders(r *http.Request) {
+	if len(cfg.UpstreamHeaders) == 0 {
+		return
+	}
+	clientIP, requestID := "", r.Header.Get(cfg.RequestIDHeader)
+	if rc := requestContextFrom(r.Context()); rc != nil {
+		clientIP, requestID = rc.ClientIP, rc.RequestID
+	}
+	values := strings.NewReplacer("{client_ip}", clientIP, "{request_id}", requestID)
+	for name, value := range cfg.UpstreamHeaders {
+		r.Header.Set(name, values.Replace(value))
+	}
+}
+
+// upstreamProtocols maps BACKEND_HTTP2 to the protocols the backend
+// transport may use. "auto" keeps the default of negotiating HTTP/2 over TLS
+// and HTTP/1.1 otherwise, "off" forces HTTP/1.1, and "h2c" speaks HTTP/2 with
+// prior knowledge, including over plain TCP to backends that only accept
+// h2c.
+func upstreamProtocols() (*http.Protocols, error) {
+	protocols := new(http.Protocols)
+	switch strings.ToLower(cfg.BackendHTTP2) {
+	case "auto":
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case "off":
+		protocols.SetHTTP1(true)
+	case "h2c":
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("invalid BACKEND_HTTP2 %q", cfg.BackendHTTP2)
+	}
+	return protocols, nil
+}
+
+// setUpstreamHost applies UPSTREAM_HOST to a forwarded request. The incoming
+// Host is passed through by default; "target" uses the backend URL's host and
+// any other value is sent as is, for backends that route on virtual hosts.
+func setUpstreamHost(r *http.Request, target *url.URL) {
+	switch cfg.UpstreamHost {
+	case "":
+	case "target":
+		r.Host = target.Host
+	default:
+		r.Host = cfg.UpstreamHost
+	}
+}
+
+func newBackend(target *url.URL, tlsConfig *tls.Config, protocols *http.Protocols) *backend {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Protocols = protocols
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		if cfg.BackendTimeoutValue != "" {
+			r.Header.Set(cfg.BackendTimeoutHeader, cfg.BackendTimeoutValue)
+		}
+		injectUpstreamHeaders(r)
+		setUpstreamHost(r, target)
+	}
+	proxy.ErrorHandler = proxyErrorHandler
+	// multipart/mixed responses for @defer and @stream aren't JSON, so the
+	// rewrites below leave them untouched, and having no Content-Length they
+	// are flushed to the client part by part.
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if cfg.CORSEnabled && cfg.CORSStripBackendHeaders {
+			stripBackendCORSHeaders(resp.Header)
+		}
+		if err := limitResponseSize(resp, cfg.MaxResponseBytes); err != nil {
+			return err
+		}
+		if err := mapErrorStatus(resp, cfg.ErrorCodeStatuses); err != nil {
+			return err
+		}
+		return stripResponseFields(resp, cfg.ResponseStripFields)
+	}
+	return &backend{target: target, proxy: proxy, transport: transport}
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.inflight++
+	b.mu.Unlock()
+	inflightProxyRequests.Inc()
+
+	defer func() {
+		inflightProxyRequests.Dec()
+		b.mu.Lock()
+		b.inflight--
+		if b.retired && b.inflight == 0 {
+			b.transport.CloseIdleConnections()
+		}
+		b.mu.Unlock()
+	}()
+
+	b.proxy.ServeHTTP(w, r)
+}
+
+// retire marks the backend as removed. Its connections are closed as soon as
+// the last in-flight request completes.
+func (b *backend) retire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retired = true
+	if b.inflight == 0 {
+		b.transport.CloseIdleConnections()
+	} else {
+		slog.Info("Draining in-flight requests", "backend", b.target.String(), "inflight", b.inflight)
+	}
+}
+
+// loadBackendSet builds a backend set from BACKEND_URL, OPERATION_BACKENDS
+// and SHADOW_BACKEND_URL, reusing backends from prev whose URL is unchanged so
+// their connections are kept.
+func loadBackendSet(prev *backendSet) (*backendSet, error) {
+	tlsConfig, err := upstreamTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	protocols, err := upstreamProtocols()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*backend)
+	if prev != nil {
+		for _, b := range prev.all() {
+			existing[b.target.String()] = b
+		}
+	}
+	get := func(raw string) (*backend, error) {
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := existing[target.String()]; ok {
+			return b, nil
+		}
+		b := newBackend(target, tlsConfig.Clone(), protocols)
+		existing[target.String()] = b
+		return b, nil
+	}
+
+	primary, err := get(os.Getenv("BACKEND_URL"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BACKEND_URL: %w", err)
+	}
+	set := &backendSet{primary: primary, byOperation: make(map[string]*backend)}
+	for opType, raw := range envMap("OPERATION_BACKENDS") {
+		b, err := get(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OPERATION_BACKENDS URL for %s: %w", opType, err)
+		}
+		set.byOperation[opType] = b
+	}
+	if raw := os.Getenv("SHADOW_BACKEND_URL"); raw != "" {
+		if set.shadow, err = get(raw); err != nil {
+			return nil, fmt.Errorf("invalid SHADOW_BACKEND_URL: %w", err)
+		}
+	}
+	// CANARY_PERCENT is read here rather than in loadConfig so a rollout can
+	// be stepped up with a SIGHUP.
+	if raw := os.Getenv("CANARY_BACKEND_URL"); raw != "" {
+		if set.canary, err = get(raw); err != nil {
+			return nil, fmt.Errorf("invalid CANARY_BACKEND_URL: %w", err)
+		}
+		set.canaryPercent = envFloat("CANARY_PERCENT", 0)
+		if set.canaryPercent < 0 || set.canaryPercent > 100 {
+			return nil, fmt.Errorf("invalid CANARY_PERCENT %v: must be between 0 and 100", set.canaryPercent)
+		}
+	}
+	return set, nil
+}
+
+// swapBackends installs next and retires any backend it no longer uses.
+func swapBackends(next *backendSet) {
+	prev := activeBackends.Swap(next)
+	if prev == nil {
+		return
+	}
+	kept := make(map[*backend]bool)
+	for _, b := range next.all() {
+		kept[b] = true
+	}
+	for _, b := range prev.all() {
+		if !kept[b] {
+			b.retire()
+		}
+	}
+}
+
+// watchReloadSignal re-reads .env on SIGHUP and applies the settings that can
+// change at runtime: the backends and MAINTENANCE_MODE.
+func watchReloadSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := godotenv.Overload(envFile); err != nil {
+			slog.Error("Error reloading .env file", "path", envFile, "err", err)
+		}
+		applyFlagOverrides()
+		setMaintenanceMode(envBool("MAINTENANCE_MODE", false))
+
+		next, err := loadBackendSet(activeBackends.Load())
+		if err != nil {
+			slog.Error("Backend reload failed, keeping current backends", "err", err)
+			continue
+		}
+		swapBackends(next)
+		slog.Info("Backends reloaded", "primary", next.primary.target.String(), "operation_routes", len(next.byOperation))
+
+		if schemaNeeded() {
+			if err := refreshSchema(context.Background()); err != nil {
+				slog.Error("Schema refresh failed, keeping current schema", "err", err)
+			}
+		}
+	}
+}
+
+// probeBackends dials each backend once so a bad BACKEND_URL shows up at
+// startup instead of on the first request. Each dial is bounded by
+// BACKEND_PROBE_TIMEOUT.
+func probeBackends(set *backendSet) {
+	for _, b := range set.all() {
+		addr := b.target.Host
+		if b.target.Port() == "" {
+			port := "80"
+			if b.target.Scheme == "https" {
+				port = "443"
+			}
+			addr = net.JoinHostPort(b.target.Hostname(), port)
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, cfg.BackendProbeTimeout)
+		if err != nil {
+			if cfg.BackendProbeFailFast {
+				fatal("Backend unreachable", "backend", b.target.String(), "err", err)
+			}
+			slog.Warn("Backend unreachable", "backend", b.target.String(), "err", err)
+			continue
+		}
+		conn.Close()
+		slog.Info("Backend reachable", "backend", b.target.String())
+	}
+}
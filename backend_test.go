@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadBackendSetReusesUnchangedBackends(t *testing.T) {
+	useConfig(t, map[string]string{
+		"BACKEND_URL":        "http://primary.internal",
+		"OPERATION_BACKENDS": "mutation=http://writer.internal",
+	})
+	first, err := loadBackendSet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OPERATION_BACKENDS", "mutation=http://writer2.internal")
+	second, err := loadBackendSet(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.primary != first.primary {
+		t.Error("primary was rebuilt although BACKEND_URL did not change")
+	}
+	if second.forOperation("mutation") == first.forOperation("mutation") {
+		t.Error("mutation backend was kept although its URL changed")
+	}
+}
+
+func TestSwapBackendsDrainsRetiredBackend(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p := newTestProxy(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte(`{"data":{"old":true}}`))
+	})
+	old := activeBackends.Load().primary
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Post(p.URL+"/public", "application/json", strings.NewReader(`{"query":"{ a }"}`))
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	replacement := newStubBackend(t, nil)
+	t.Setenv("BACKEND_URL", replacement.URL)
+	next, err := loadBackendSet(activeBackends.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapBackends(next)
+
+	old.mu.Lock()
+	retired, inflight := old.retired, old.inflight
+	old.mu.Unlock()
+	if !retired || inflight != 1 {
+		t.Errorf("old backend retired = %v with %d in flight, want retired with 1", retired, inflight)
+	}
+
+	if resp, _ := p.post(t, "/public", `{"query":"{ b }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("new request: status = %d", resp.StatusCode)
+	}
+	if n := len(replacement.received()); n != 1 {
+		t.Errorf("replacement backend received %d requests, want 1", n)
+	}
+
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("in-flight request: status = %d, want it to complete", status)
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	if old.inflight != 0 {
+		t.Errorf("old backend still has %d in flight", old.inflight)
+	}
+}
+
+func TestBackendTimeoutHeader(t *testing.T) {
+	t.Run("configured", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"BACKEND_TIMEOUT_VALUE": "1500ms"}, nil)
+		p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"X-GraphQL-Timeout": "1h"})
+		if v := p.backend.last(t).Header.Get("X-GraphQL-Timeout"); v != "1500ms" {
+			t.Errorf("X-GraphQL-Timeout = %q, want the configured 1500ms", v)
+		}
+	})
+	t.Run("custom header", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"BACKEND_TIMEOUT_VALUE": "2s", "BACKEND_TIMEOUT_HEADER": "X-Deadline"}, nil)
+		p.post(t, "/public", `{"query":"{ a }"}`, nil)
+		if v := p.backend.last(t).Header.Get("X-Deadline"); v != "2s" {
+			t.Errorf("X-Deadline = %q, want 2s", v)
+		}
+	})
+	t.Run("unset", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"BACKEND_TIMEOUT_VALUE": ""}, nil)
+		p.post(t, "/public", `{"query":"{ a }"}`, nil)
+		if v := p.backend.last(t).Header.Get("X-GraphQL-Timeout"); v != "" {
+			t.Errorf("X-GraphQL-Timeout = %q without BACKEND_TIMEOUT_VALUE", v)
+		}
+	})
+}
+
+func TestOperationBackends(t *testing.T) {
+	writer := newStubBackend(t, nil)
+	p := newTestProxy(t, map[string]string{"OPERATION_BACKENDS": "mutation=" + writer.URL}, nil)
+
+	p.post(t, "/public", `{"query":"mutation { buy }"}`, nil)
+	p.post(t, "/public", `{"query":"query { items }"}`, nil)
+	p.post(t, "/public", `{"query":"{ shorthand }"}`, nil)
+
+	if got := writer.received(); len(got) != 1 || !strings.Contains(got[0].Body, "buy") {
+		t.Errorf("write backend received %+v, want only the mutation", got)
+	}
+	if got := p.backend.received(); len(got) != 2 {
+		t.Errorf("read backend received %d requests, want the 2 queries", len(got))
+	}
+}
+
+func TestForOperationFallsBackToPrimary(t *testing.T) {
+	primary, writer := &backend{}, &backend{}
+	set := &backendSet{primary: primary, byOperation: map[string]*backend{"mutation": writer}}
+	if set.forOperation("mutation") != writer {
+		t.Error("mutation not routed to its backend")
+	}
+	for _, opType := range []string{"query", "subscription", ""} {
+		if set.forOperation(opType) != primary {
+			t.Errorf("%q not routed to primary", opType)
+		}
+	}
+}
+
+func TestProbeBackends(t *testing.T) {
+	up := newStubBackend(t, nil)
+	down := newStubBackend(t, nil)
+	down.Close()
+	useConfig(t, map[string]string{
+		"BACKEND_URL":           up.URL,
+		"OPERATION_BACKENDS":    "mutation=" + down.URL,
+		"BACKEND_PROBE_TIMEOUT": "500ms",
+	})
+	set, err := loadBackendSet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+
+	start := time.Now()
+	probeBackends(set)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("probe took %s", elapsed)
+	}
+	if attrs, ok := logs.find("Backend reachable"); !ok || attrs["backend"].String() != up.URL {
+		t.Errorf("reachable backend not reported: %v", attrs)
+	}
+	if attrs, ok := logs.find("Backend unreachable"); !ok || attrs["backend"].String() != down.URL {
+		t.Errorf("unreachable backend not reported: %v", attrs)
+	}
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	p := newTestProxy(t, map[string]string{
+		"UPSTREAM_HEADERS": "X-Api-Key=internal-secret,X-Tenant=shop,X-Origin-Client={client_ip}/{request_id}",
+	}, nil)
+	resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{
+		"X-Api-Key":    "client-forged",
+		"X-Request-Id": "req-9",
+	})
+	got := p.backend.last(t).Header
+	want := map[string]string{
+		"X-Api-Key":       "internal-secret",
+		"X-Tenant":        "shop",
+		"X-Origin-Client": "127.0.0.1/req-9",
+	}
+	for name, value := range want {
+		if v := got.Get(name); v != value {
+			t.Errorf("%s = %q, want %q", name, v, value)
+		}
+	}
+	if v := resp.Header.Get("X-Api-Key"); v != "" {
+		t.Errorf("injected header leaked to the client: %q", v)
+	}
+}
+
+// protoBackend answers with the protocol each request arrived over.
+func protoBackend(t *testing.T, tls bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data":{"proto":%q}}`, r.Proto)
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	if tls {
+		srv.EnableHTTP2 = true
+		srv.Config.Protocols.SetHTTP2(true)
+		srv.StartTLS()
+	} else {
+		srv.Config.Protocols.SetUnencryptedHTTP2(true)
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	h2c, tlsBackend := protoBackend(t, false), protoBackend(t, true)
+	tests := []struct {
+		name, url, mode, want string
+	}{
+		{"h2c prior knowledge", h2c.URL, "h2c", "HTTP/2.0"},
+		{"plain HTTP by default", h2c.URL, "auto", "HTTP/1.1"},
+		{"negotiated over TLS", tlsBackend.URL, "auto", "HTTP/2.0"},
+		{"off over TLS", tlsBackend.URL, "off", "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, map[string]string{"BACKEND_URL": tt.url, "BACKEND_HTTP2": tt.mode, "BACKEND_INSECURE_SKIP_VERIFY": "true"}, nil)
+			resp, body := p.post(t, "/public", `{"query":"{ proto }"}`, nil)
+			want := `{"data":{"proto":"` + tt.want + `"}}`
+			if resp.StatusCode != http.StatusOK || body != want {
+				t.Errorf("got %d %s, want %s", resp.StatusCode, body, want)
+			}
+		})
+	}
+}
+
+func TestUpstreamHTTP2Invalid(t *testing.T) {
+	useConfig(t, map[string]string{"BACKEND_HTTP2": "sometimes"})
+	if _, err := loadBackendSet(nil); err == nil {
+		t.Error("loadBackendSet accepted an invalid BACKEND_HTTP2")
+	}
+}
+
+func TestUpstreamHost(t *testing.T) {
+	tests := []struct {
+		name, setting string
+		want          func(p *testProxy) string
+	}{
+		{"incoming host by default", "", func(*testProxy) string { return "shop.example" }},
+		{"backend host", "target", func(p *testProxy) string { return strings.TrimPrefix(p.backend.URL, "http://") }},
+		{"explicit host", "api.internal", func(*testProxy) string { return "api.internal" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, map[string]string{"UPSTREAM_HOST": tt.setting}, nil)
+			req, err := http.NewRequest(http.MethodPost, p.URL+"/public", strings.NewReader(`{"query":"{ a }"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "shop.example"
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if got, want := p.backend.last(t).Host, tt.want(p); got != want {
+				t.Errorf("upstream Host = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCanarySplit(t *testing.T) {
+	const n = 2000
+	fraction := func(set *backendSet, ip func(i int) string) float64 {
+		hits := 0
+		for i := 0; i < n; i++ {
+			if set.useCanary(ip(i)) {
+				hits++
+			}
+		}
+		return float64(hits) / n
+	}
+	sameIP := func(int) string { return "203.0.113.7" }
+	manyIPs := func(i int) string { return fmt.Sprintf("10.%d.%d.1", i/256, i%256) }
+
+	t.Run("random split", func(t *testing.T) {
+		useConfig(t, map[string]string{"CANARY_BACKEND_URL": "http://canary.internal", "CANARY_PERCENT": "20", "CANARY_STICKY": "false"})
+		set, err := loadBackendSet(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fraction(set, sameIP); got < 0.16 || got > 0.24 {
+			t.Errorf("canary fraction = %.3f, want about 0.20", got)
+		}
+	})
+
+	t.Run("sticky split", func(t *testing.T) {
+		useConfig(t, map[string]string{"CANARY_BACKEND_URL": "http://canary.internal", "CANARY_PERCENT": "20", "CANARY_STICKY": "true"})
+		set, err := loadBackendSet(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fraction(set, manyIPs); got < 0.16 || got > 0.24 {
+			t.Errorf("canary fraction across clients = %.3f, want about 0.20", got)
+		}
+		for i := 0; i < 50; i++ {
+			ip := manyIPs(i)
+			first := set.useCanary(ip)
+			for j := 0; j < 20; j++ {
+				if set.useCanary(ip) != first {
+					t.Fatalf("client %s switched backends", ip)
+				}
+			}
+		}
+	})
+
+	t.Run("edges", func(t *testing.T) {
+		for percent, want := range map[string]float64{"0": 0, "100": 1} {
+			useConfig(t, map[string]string{"CANARY_BACKEND_URL": "http://canary.internal", "CANARY_PERCENT": percent})
+			set, err := loadBackendSet(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fraction(set, manyIPs); got != want {
+				t.Errorf("CANARY_PERCENT=%s: canary fraction = %v, want %v", percent, got, want)
+			}
+		}
+		useConfig(t, map[string]string{"CANARY_BACKEND_URL": "", "CANARY_PERCENT": "50"})
+		set, err := loadBackendSet(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set.useCanary("203.0.113.7") {
+			t.Error("request sent to the canary with no CANARY_BACKEND_URL")
+		}
+	})
+
+	t.Run("invalid percent", func(t *testing.T) {
+		for _, percent := range []string{"-1", "101"} {
+			useConfig(t, map[string]string{"CANARY_BACKEND_URL": "http://canary.internal", "CANARY_PERCENT": percent})
+			if _, err := loadBackendSet(nil); err == nil {
+				t.Errorf("CANARY_PERCENT=%s accepted", percent)
+			}
+		}
+	})
+}
+
+func TestCanaryServesClient(t *testing.T) {
+	canary := newStubBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"from":"canary"}}`))
+	})
+	p := newTestProxy(t, map[string]string{"CANARY_BACKEND_URL": canary.URL, "CANARY_PERCENT": "100"}, nil)
+	for _, query := range []string{`{"query":"{ a }"}`, `{"query":"mutation { buy }"}`} {
+		if _, body := p.post(t, "/public", query, nil); body != `{"data":{"from":"canary"}}` {
+			t.Errorf("%s: client got %s, want the canary's response", query, body)
+		}
+	}
+	if n := len(canary.received()); n != 2 {
+		t.Errorf("canary received %d requests, want the query and the mutation", n)
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Errorf("stable backend received %d requests, want none", n)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBufferSize keeps the occasional huge body from pinning its buffer
+// in the pool.
+const maxPooledBufferSize = 1 << 20
+
+// bodyBufferPool recycles the buffers a request body is read into and
+// re-marshalled into, unless BODY_BUFFER_POOL=false.
+var bodyBufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getBodyBuffer() *bytes.Buffer {
+	if !cfg.BodyBufferPool {
+		return new(bytes.Buffer)
+	}
+	return bodyBufferPool.Get().(*bytes.Buffer)
+}
+
+func putBodyBuffer(buf *bytes.Buffer) {
+	if !cfg.BodyBufferPool || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bodyBufferPool.Put(buf)
+}
+
+// sharedBuffer is a pooled buffer with more than one holder. It goes back to
+// the pool when the last holder releases it, so a buffer the transport may
+// still be reading after the handler returns is never reused early.
+type sharedBuffer struct {
+	buf  *bytes.Buffer
+	refs atomic.Int32
+}
+
+func newSharedBuffer(buf *bytes.Buffer) *sharedBuffer {
+	s := &sharedBuffer{buf: buf}
+	s.refs.Store(1)
+	return s
+}
+
+func (s *sharedBuffer) retain() {
+	s.refs.Add(1)
+}
+
+func (s *sharedBuffer) release() {
+	if s.refs.Add(-1) == 0 {
+		putBodyBuffer(s.buf)
+	}
+}
+
+// reader returns an upstream request body over b, which must be a slice of
+// the buffer, that holds its own reference until the transport closes it. A
+// body that is never sent is never closed, and its buffer is left to the
+// garbage collector instead of being reused.
+func (s *sharedBuffer) reader(b []byte) io.ReadCloser {
+	s.retain()
+	return &sharedBufferReader{Reader: bytes.NewReader(b), shared: s}
+}
+
+type sharedBufferReader struct {
+	*bytes.Reader
+	shared *sharedBuffer
+	once   sync.Once
+}
+
+func (r *sharedBufferReader) Close() error {
+	r.once.Do(r.shared.release)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSharedBufferReleasedByLastHolder(t *testing.T) {
+	useConfig(t, map[string]string{"BODY_BUFFER_POOL": "true"})
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"query":"{ a }"}`)
+	shared := newSharedBuffer(buf)
+	body := shared.reader(buf.Bytes())
+
+	// The handler lets go first; the upstream request still owns the body.
+	shared.release()
+	if got, _ := io.ReadAll(body); string(got) != `{"query":"{ a }"}` {
+		t.Fatalf("body read after the handler released it = %q", got)
+	}
+	if buf.Len() == 0 {
+		t.Fatal("buffer was reset while the upstream body was still open")
+	}
+	body.Close()
+	if buf.Len() != 0 {
+		t.Error("buffer was not returned once the upstream body was closed")
+	}
+
+	// A second Close must not drop the handler's reference as well.
+	buf = bytes.NewBufferString(`{"query":"{ b }"}`)
+	shared = newSharedBuffer(buf)
+	body = shared.reader(buf.Bytes())
+	body.Close()
+	body.Close()
+	if buf.Len() == 0 {
+		t.Fatal("closing the body twice released the handler's reference")
+	}
+	shared.release()
+	if buf.Len() != 0 {
+		t.Error("buffer was not returned once the handler released it")
+	}
+}
+
+func TestPutBodyBuffer(t *testing.T) {
+	useConfig(t, map[string]string{"BODY_BUFFER_POOL": "true"})
+	small := bytes.NewBufferString("data")
+	putBodyBuffer(small)
+	if small.Len() != 0 {
+		t.Error("pooled buffer was not reset")
+	}
+	huge := bytes.NewBuffer(make([]byte, 0, maxPooledBufferSize+1))
+	huge.WriteString("data")
+	putBodyBuffer(huge)
+	if huge.Len() == 0 {
+		t.Error("oversized buffer was pooled")
+	}
+
+	useConfig(t, map[string]string{"BODY_BUFFER_POOL": "false"})
+	unpooled := bytes.NewBufferString("data")
+	putBodyBuffer(unpooled)
+	if unpooled.Len() == 0 {
+		t.Error("buffer was pooled with BODY_BUFFER_POOL=false")
+	}
+}
+
+// echoBody answers with the request body, so a client can check it got its
+// own request back.
+func echoBody(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, r.Body)
+}
+
+func TestBodyBufferPoolUnderConcurrency(t *testing.T) {
+	for _, pooled := range []string{"true", "false"} {
+		t.Run("BODY_BUFFER_POOL="+pooled, func(t *testing.T) {
+			p := newTestProxy(t, map[string]string{"BODY_BUFFER_POOL": pooled, "RATE_LIMIT_PER_MINUTE": "100000"}, echoBody)
+			const clients, requests = 16, 25
+			errs := make(chan error, clients*requests)
+			var wg sync.WaitGroup
+			for c := 0; c < clients; c++ {
+				wg.Add(1)
+				go func(c int) {
+					defer wg.Done()
+					for i := 0; i < requests; i++ {
+						// Bodies of varying size exercise buffers grown by earlier requests.
+						marker := fmt.Sprintf("c%d-r%d-%s", c, i, strings.Repeat("x", (c*requests+i)%500))
+						errs <- roundTrip(p.URL+"/public", marker)
+					}
+				}(c)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// roundTrip sends a query carrying marker as a variable and checks that the
+// echoed body is the one that was sent.
+func roundTrip(url, marker string) error {
+	body := `{"query":"query Q($m: String) { a(m: $m) }","variables":{"m":"` + marker + `"}}`
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	var echoed struct {
+		Variables map[string]string `json:"variables"`
+	}
+	if err := json.Unmarshal(raw, &echoed); err != nil {
+		return fmt.Errorf("%s: %v", marker, err)
+	}
+	if got := echoed.Variables["m"]; got != marker {
+		return fmt.Errorf("sent %.20s, backend received %.20s: %d %.300s", marker, got, resp.StatusCode, raw)
+	}
+	return nil
+}
+
+func BenchmarkBodyRewrite(b *testing.B) {
+	query := `{"query":"query Q($m: String) { a(m: $m) { ` + strings.Repeat("field ", 2000) + `} }","variables":{"m":"x"}}`
+	for _, pooled := range []string{"true", "false"} {
+		b.Run("BODY_BUFFER_POOL="+pooled, func(b *testing.B) {
+			p := newTestProxy(b, map[string]string{"BODY_BUFFER_POOL": pooled, "RATE_LIMIT_PER_MINUTE": "100000000"}, nil)
+			h := graphqlMiddleware(loadRoutes()[0])
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest(http.MethodPost, p.URL+"/public", strings.NewReader(query))
+				req.Header.Set("Content-Type", "application/json")
+				req.RemoteAddr = "127.0.0.1:1234"
+				h(discardResponse{http.Header{}}, req)
+			}
+		})
+	}
+}
+
+// discardResponse is a ResponseWriter that keeps nothing, so the benchmark
+// measures the handler rather than a recorder.
+type discardResponse struct{ header http.Header }
+
+func (d discardResponse) Header() http.Header         { return d.header }
+func (d discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponse) WriteHeader(int)             {}
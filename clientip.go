@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPFromRequest returns the originating client address. Forwarding
+// headers are only honored when the direct peer is a trusted proxy, and the
+// X-Forwarded-For chain is peeled from the right past every trusted hop so a
+// client cannot spoof its address by prepending entries.
+func clientIPFromRequest(r *http.Request, trusted []*net.IPNet) string {
+	remote := extractClientIP(r.RemoteAddr)
+	if !ipInNets(remote, trusted) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// Garbage in the chain; stop at the last hop we could verify.
+			break
+		}
+		client = hops[i]
+		if !ipInNets(client, trusted) {
+			break
+		}
+	}
+	if client == "::1" {
+		return "127.0.0.1"
+	}
+	return client
+}
+
+func ipInNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders prepares the client address headers for the backend.
+// ReverseProxy appends the direct peer to X-Forwarded-For itself, so only a
+// chain received from a trusted proxy is kept; anything else could be forged.
+func setForwardedHeaders(r *http.Request, clientIP string) {
+	if !cfg.ForwardClientIP {
+		// A nil value tells ReverseProxy not to add X-Forwarded-For at all.
+		r.Header["X-Forwarded-For"] = nil
+		r.Header.Del("X-Real-IP")
+		r.Header.Del("Forwarded")
+		return
+	}
+
+	trustedPeer := ipInNets(extractClientIP(r.RemoteAddr), cfg.TrustedProxies)
+	if !trustedPeer {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("Forwarded")
+	}
+	r.Header.Set("X-Real-IP", clientIP)
+
+	if cfg.ForwardedHeader {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(extractClientIP(r.RemoteAddr)), forwardedValue(r.Host), proto)
+		if prior := r.Header.Get("Forwarded"); prior != "" {
+			element = prior + ", " + element
+		}
+		r.Header.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats an address for the RFC 7239 Forwarded header, where
+// IPv6 addresses must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue formats a Forwarded parameter value: a token as is, anything
+// else, such as a host:port, as a quoted string.
+func forwardedValue(v string) string {
+	if v != "" && strings.IndexFunc(v, func(c rune) bool { return !isTokenChar(c) }) < 0 {
+		return v
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range v {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isTokenChar reports whether c may appear in an RFC 7230 token.
+func isTokenChar(c rune) bool {
+	return c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
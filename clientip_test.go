@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClientIPFromRequest(t *testing.T) {
+	useConfig(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8, 192.0.2.1, 2001:db8::/32"})
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"untrusted peer ignores XFF", "203.0.113.9:1234", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer without XFF", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"trusted peer uses client", "10.1.2.3:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"peels every trusted hop", "10.1.2.3:1234", []string{"198.51.100.1, 10.9.9.9, 192.0.2.1"}, "198.51.100.1"},
+		{"spoofed prefix is ignored", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"multiple header lines", "10.1.2.3:1234", []string{"198.51.100.1", "10.9.9.9"}, "198.51.100.1"},
+		{"stops at garbage", "10.1.2.3:1234", []string{"198.51.100.1, not-an-ip, 10.9.9.9"}, "10.9.9.9"},
+		{"all hops trusted", "10.1.2.3:1234", []string{"10.7.7.7, 10.8.8.8"}, "10.7.7.7"},
+		{"bare trusted IP", "192.0.2.1:80", []string{"198.51.100.2"}, "198.51.100.2"},
+		{"trusted IPv6 peer", "[2001:db8::1]:443", []string{"2001:db8:ffff::5, 2001:db8::2"}, "2001:db8:ffff::5"},
+		{"IPv6 loopback", "[::1]:80", nil, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/public", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIPFromRequest(r, cfg.TrustedProxies); got != tt.want {
+				t.Errorf("clientIPFromRequest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvCIDRs(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,192.0.2.1,::1,bogus,300.1.1.1/8")
+	nets := envCIDRs("TRUSTED_PROXIES")
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("envCIDRs = %v, want %v", got, want)
+	}
+}
+
+func TestProxyRateLimitsByForwardedClient(t *testing.T) {
+	// The test client connects from 127.0.0.1, trusted here as a proxy, so
+	// each forwarded client gets its own budget.
+	p := newTestProxy(t, map[string]string{"TRUSTED_PROXIES": "127.0.0.1", "RATE_LIMIT_PER_MINUTE": "1"}, nil)
+	body := `{"query":"{ a }"}`
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2"} {
+		if resp, _ := p.post(t, "/public", body, map[string]string{"X-Forwarded-For": ip}); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", ip, resp.StatusCode)
+		}
+	}
+	if resp, _ := p.post(t, "/public", body, map[string]string{"X-Forwarded-For": "198.51.100.1"}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("repeat client: status = %d, want 429", resp.StatusCode)
+	}
+	if ip := p.lastLog(t).IP; ip != "198.51.100.1" {
+		t.Errorf("logged ip = %q", ip)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		header        map[string]string
+		wantXFF       string
+		wantRealIP    string
+		wantForwarded string
+	}{
+		{
+			name:          "direct client",
+			env:           map[string]string{"FORWARDED_HEADER": "true"},
+			wantXFF:       "127.0.0.1",
+			wantRealIP:    "127.0.0.1",
+			wantForwarded: `for=127.0.0.1;host="HOST";proto=http`,
+		},
+		{
+			name:       "untrusted chain is dropped",
+			header:     map[string]string{"X-Forwarded-For": "203.0.113.9", "Forwarded": "for=203.0.113.9"},
+			wantXFF:    "127.0.0.1",
+			wantRealIP: "127.0.0.1",
+		},
+		{
+			name:          "trusted proxy chain is appended",
+			env:           map[string]string{"TRUSTED_PROXIES": "127.0.0.1", "FORWARDED_HEADER": "true"},
+			header:        map[string]string{"X-Forwarded-For": "198.51.100.1", "Forwarded": "for=198.51.100.1"},
+			wantXFF:       "198.51.100.1, 127.0.0.1",
+			wantRealIP:    "198.51.100.1",
+			wantForwarded: `for=198.51.100.1, for=127.0.0.1;host="HOST";proto=http`,
+		},
+		{
+			name:   "forwarding disabled",
+			env:    map[string]string{"FORWARD_CLIENT_IP": "false", "TRUSTED_PROXIES": "127.0.0.1"},
+			header: map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.1", "Forwarded": "for=198.51.100.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, tt.env, nil)
+			p.post(t, "/public", `{"query":"{ a }"}`, tt.header)
+			got := p.backend.last(t).Header
+			host := strings.TrimPrefix(p.URL, "http://")
+			if v := got.Get("X-Forwarded-For"); v != tt.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", v, tt.wantXFF)
+			}
+			if v := got.Get("X-Real-IP"); v != tt.wantRealIP {
+				t.Errorf("X-Real-IP = %q, want %q", v, tt.wantRealIP)
+			}
+			if v, want := got.Get("Forwarded"), strings.ReplaceAll(tt.wantForwarded, "HOST", host); v != want {
+				t.Errorf("Forwarded = %q, want %q", v, want)
+			}
+		})
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	if got := forwardedNode("192.0.2.1"); got != "192.0.2.1" {
+		t.Errorf("IPv4 = %q", got)
+	}
+	if got := forwardedNode("2001:db8::1"); got != `"[2001:db8::1]"` {
+		t.Errorf("IPv6 = %q", got)
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": `"example.com:8080"`,
+		"[2001:db8::1]:80": `"[2001:db8::1]:80"`,
+		`a"b\c`:            `"a\"b\\c"`,
+		"":                 `""`,
+	} {
+		if got := forwardedValue(in); got != want {
+			t.Errorf("forwardedValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	coalesceGroup singleflight.Group
+	coalesceStats = newCacheStats("coalesce")
+)
+
+// bufferedResponse holds a complete backend response so it can be replayed
+// to every caller that shared the upstream request.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// coalesceKey identifies requests that are safe to answer with one upstream
+// call. The credentials are part of the key so responses are never shared
+// across callers who might be authorized differently.
+func coalesceKey(r *http.Request, query, opName string, variables interface{}) string {
+	// json.Marshal sorts map keys, which normalizes the variables object.
+	vars, _ := json.Marshal(variables)
+	h := sha256.New()
+	for _, part := range []string{query, opName, string(vars), r.Header.Get("Authorization"), r.Header.Get("Cookie")} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serveCoalesced proxies through next, sharing the response with any
+// identical request already in flight.
+func serveCoalesced(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	leader := false
+	v, _, _ := coalesceGroup.Do(key, func() (interface{}, error) {
+		leader = true
+		// The upstream call belongs to every waiting caller, so the leader
+		// disconnecting must not cancel it. The route timeout still applies.
+		ctx := context.WithoutCancel(r.Context())
+		if deadline, ok := r.Context().Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		buf := newBufferedResponse()
+		next.ServeHTTP(buf, r.WithContext(ctx))
+		return buf, nil
+	})
+	if leader {
+		coalesceStats.miss()
+	} else {
+		coalesceStats.hit()
+		coalescedRequestsTotal.Inc()
+	}
+	v.(*bufferedResponse).replay(w)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrentPosts sends n copies of body to the proxy at once and returns the
+// response statuses and bodies.
+func concurrentPosts(p *testProxy, n int, body string) ([]int, []string) {
+	statuses, bodies := make([]int, n), make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Post(p.URL+"/public", "application/json", strings.NewReader(body))
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			statuses[i], bodies[i] = resp.StatusCode, string(b)
+		}(i)
+	}
+	wg.Wait()
+	return statuses, bodies
+}
+
+func TestCoalescesIdenticalQueries(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	p := newTestProxy(t, map[string]string{"COALESCE_QUERIES": "true"}, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		arrived <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"data":{"n":1}}`)
+	})
+
+	done := make(chan struct{})
+	var statuses []int
+	var bodies []string
+	go func() {
+		statuses, bodies = concurrentPosts(p, 5, `{"query":"{ n }"}`)
+		close(done)
+	}()
+	<-arrived
+	// Give the other requests time to join the one in flight.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	<-done
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend calls = %d, want 1", n)
+	}
+	for i := range statuses {
+		if statuses[i] != http.StatusOK || bodies[i] != `{"data":{"n":1}}` {
+			t.Errorf("response %d = %d %q", i, statuses[i], bodies[i])
+		}
+	}
+}
+
+func TestDoesNotCoalesceMutations(t *testing.T) {
+	const n = 3
+	var calls atomic.Int32
+	all := make(chan struct{})
+	p := newTestProxy(t, map[string]string{"COALESCE_QUERIES": "true"}, func(w http.ResponseWriter, r *http.Request) {
+		// Hold every call until all of them are in flight at once.
+		if calls.Add(1) == n {
+			close(all)
+		}
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, `{"data":{}}`)
+	})
+
+	concurrentPosts(p, n, `{"query":"mutation { buy }"}`)
+	if got := calls.Load(); got != n {
+		t.Errorf("backend calls = %d, want %d", got, n)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	req := func(auth string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPost, "/public", nil)
+		r.Header.Set("Authorization", auth)
+		return r
+	}
+	base := coalesceKey(req("a"), "{ n }", "", map[string]interface{}{"x": 1, "y": 2})
+	if k := coalesceKey(req("a"), "{ n }", "", map[string]interface{}{"y": 2, "x": 1}); k != base {
+		t.Error("variable order changed the key")
+	}
+	if k := coalesceKey(req("b"), "{ n }", "", map[string]interface{}{"x": 1, "y": 2}); k == base {
+		t.Error("requests with different credentials share a key")
+	}
+	if k := coalesceKey(req("a"), "{ n }", "", map[string]interface{}{"x": 2, "y": 2}); k == base {
+		t.Error("requests with different variables share a key")
+	}
+}
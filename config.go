@@ -0,0 +1,466 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type config struct {
+	AdminToken                string
+	MaxLogsLimit              int
+	EnsureIndexes             bool
+	SanitizePattern           *regexp.Regexp
+	MaxTrackedIPs             int
+	HMACSecret                string
+	HMACRequired              bool
+	TrustedProxies            []*net.IPNet
+	DisableIntrospection      bool
+	IntrospectionAllowedCIDRs []*net.IPNet
+	ErrorCodeStatuses         map[string]int
+	SlowQueryThreshold        time.Duration
+	QuerySampleRate           float64
+	PprofEnabled              bool
+	LoadTestToken             string
+	MaxJSONDepth              int
+	LogSink                   string
+	LogQueueSize              int
+	LogBatchSize              int
+	LogQueueShedThreshold     int
+	LogFlushInterval          time.Duration
+	KafkaBrokers              []string
+	KafkaTopic                string
+	OpenSearchURL             string
+	OpenSearchIndex           string
+	OpenSearchUsername        string
+	OpenSearchPassword        string
+	OpenSearchCAFile          string
+	OpenSearchInsecure        bool
+	CoalesceQueries           bool
+	RateLimitHeaders          bool
+	MaintenanceMode           bool
+	MaintenanceRetryAfter     time.Duration
+	Routes                    []string
+	RequestTimeout            time.Duration
+	RouteTimeouts             map[string]string
+	LogMutationsOnly          bool
+	ForwardClientIP           bool
+	ForwardedHeader           bool
+	BackendTimeoutHeader      string
+	BackendTimeoutValue       string
+	ResponseStripFields       [][]string
+	BackendStartupProbe       bool
+	BackendProbeTimeout       time.Duration
+	BackendProbeFailFast      bool
+	RouteMethods              map[string]string
+	DeniedDirectives          []string
+	MaxVariables              int
+	MaxVariableKeyLength      int
+	MaxBodyBytes              int64
+	CORSMaxAge                int
+	CORSAllowCredentials      bool
+	CORSAllowedOrigins        []string
+	CORSEnabled               bool
+	CORSStripBackendHeaders   bool
+	DefaultOperationName      string
+	ReadOnly                  bool
+	DailyQuota                int
+	SanitizeHeader            bool
+	UpstreamHeaders           map[string]string
+	AuditLog                  bool
+	AuditCollection           string
+	RequestIDHeader           string
+	SchemaValidation          bool
+	SchemaRefreshInterval     time.Duration
+	MongoMaxPoolSize          uint64
+	OperationRateLimits       map[string]int
+	LogFallback               string
+	LogFallbackSize           int
+	AdminAddr                 string
+	ListenAddr                string
+	ListenSocketMode          os.FileMode
+	LogLevel                  string
+	LogFormat                 string
+	BackendTLSMinVersion      string
+	BackendTLSCiphers         []string
+	BackendCAFile             string
+	BackendInsecureSkipVerify bool
+	IdempotencyTTL            time.Duration
+	IdempotencyMaxKeys        int
+	MaxResponseBytes          int64
+	RateLimitPerMinute        int
+	MongoDB                   string
+	MongoCollection           string
+	SanitizeMode              string
+	MaxQueryCost              int
+	QueryCostHeader           bool
+	BackendHTTP2              string
+	AllowedOperations         []string
+	MaxVariableArrayLength    int
+	MaxVariableArrayTotal     int
+	VariableArrayLimits       map[string]int
+	LivenessPath              string
+	ReadinessPath             string
+	RateLimitPenalty          time.Duration
+	RateLimitPenaltyMax       time.Duration
+	RateLimitPenaltyReset     time.Duration
+	VariableSchemas           map[string]string
+	AccessLog                 string
+	MaxConcurrentRequests     int
+	QueueTimeout              time.Duration
+	MetricsMaxOperations      int
+	MetricsOperationIdle      time.Duration
+	TestMode                  bool
+	TestBackendResponse       string
+	SchemaEndpoint            bool
+	StrictOperationName       bool
+	LogStageTimings           bool
+	MaxQueryDepth             int
+	RejectionDetails          bool
+	UpstreamHost              string
+	CanarySticky              bool
+	RateLimitWarmup           time.Duration
+	RateLimitWarmupMultiplier float64
+	MaxConditionalSelections  int
+	RejectionHTML             bool
+	RejectionHTMLTemplate     string
+	LogHeaderMaxLength        int
+	BodyBufferPool            bool
+	BodyReadTimeout           time.Duration
+	ReadHeaderTimeout         time.Duration
+	RateLimitExemptPaths      []string
+	RequiredHeaders           []string
+	OperationSLOs             map[string]time.Duration
+	LogVariables              bool
+	PanicRecovery             bool
+	ShadowBackendURL          string
+}
+
+var cfg config
+
+func loadConfig() config {
+	return config{
+		AdminToken:                os.Getenv("ADMIN_TOKEN"),
+		MaxLogsLimit:              envInt("ADMIN_LOGS_MAX_LIMIT", 100),
+		EnsureIndexes:             envBool("MONGO_ENSURE_INDEXES", true),
+		SanitizePattern:           envRegexp("SANITIZE_PATTERN", defaultSanitizePattern),
+		MaxTrackedIPs:             envInt("RATE_LIMIT_MAX_IPS", 100000),
+		HMACSecret:                os.Getenv("HMAC_SECRET"),
+		HMACRequired:              envBool("HMAC_REQUIRED", true),
+		TrustedProxies:            envCIDRs("TRUSTED_PROXIES"),
+		DisableIntrospection:      envBool("DISABLE_INTROSPECTION", false),
+		IntrospectionAllowedCIDRs: envCIDRs("INTROSPECTION_ALLOWED_CIDRS"),
+		ErrorCodeStatuses:         envStatusMap("GRAPHQL_ERROR_STATUS"),
+		SlowQueryThreshold:        envDuration("SLOW_QUERY_THRESHOLD", 0),
+		QuerySampleRate:           envFloat("LOG_QUERY_SAMPLE_RATE", 1),
+		PprofEnabled:              envBool("PPROF_ENABLED", false),
+		LoadTestToken:             os.Getenv("LOAD_TEST_TOKEN"),
+		MaxJSONDepth:              envInt("MAX_JSON_DEPTH", 32),
+		LogSink:                   envString("LOG_SINK", "mongo"),
+		LogQueueSize:              envInt("LOG_QUEUE_SIZE", 10000),
+		LogBatchSize:              envInt("LOG_BATCH_SIZE", 100),
+		LogQueueShedThreshold:     envInt("LOG_QUEUE_SHED_THRESHOLD", 0),
+		LogFlushInterval:          envDuration("LOG_FLUSH_INTERVAL", time.Second),
+		KafkaBrokers:              envList("KAFKA_BROKERS"),
+		KafkaTopic:                os.Getenv("KAFKA_TOPIC"),
+		OpenSearchURL:             os.Getenv("OPENSEARCH_URL"),
+		OpenSearchIndex:           envString("OPENSEARCH_INDEX", "graphql-logs"),
+		OpenSearchUsername:        os.Getenv("OPENSEARCH_USERNAME"),
+		OpenSearchPassword:        os.Getenv("OPENSEARCH_PASSWORD"),
+		OpenSearchCAFile:          os.Getenv("OPENSEARCH_CA_FILE"),
+		OpenSearchInsecure:        envBool("OPENSEARCH_INSECURE_SKIP_VERIFY", false),
+		CoalesceQueries:           envBool("COALESCE_QUERIES", false),
+		RateLimitHeaders:          envBool("RATE_LIMIT_HEADERS", false),
+		MaintenanceMode:           envBool("MAINTENANCE_MODE", false),
+		MaintenanceRetryAfter:     envDuration("MAINTENANCE_RETRY_AFTER", 2*time.Minute),
+		Routes:                    envListDefault("GRAPHQL_ROUTES", "/public"),
+		RequestTimeout:            envDuration("REQUEST_TIMEOUT", 0),
+		RouteTimeouts:             envMap("ROUTE_TIMEOUTS"),
+		LogMutationsOnly:          envBool("LOG_MUTATIONS_ONLY", false),
+		ForwardClientIP:           envBool("FORWARD_CLIENT_IP", true),
+		ForwardedHeader:           envBool("FORWARDED_HEADER", false),
+		BackendTimeoutHeader:      envString("BACKEND_TIMEOUT_HEADER", "X-GraphQL-Timeout"),
+		BackendTimeoutValue:       os.Getenv("BACKEND_TIMEOUT_VALUE"),
+		ResponseStripFields:       envPaths("RESPONSE_STRIP_FIELDS"),
+		BackendStartupProbe:       envBool("BACKEND_STARTUP_PROBE", false),
+		BackendProbeTimeout:       envDuration("BACKEND_PROBE_TIMEOUT", 3*time.Second),
+		BackendProbeFailFast:      envBool("BACKEND_PROBE_FAIL_FAST", false),
+		RouteMethods:              envMap("ROUTE_METHODS"),
+		DeniedDirectives:          envList("DENIED_DIRECTIVES"),
+		MaxVariables:              envInt("MAX_VARIABLES", 0),
+		MaxVariableKeyLength:      envInt("MAX_VARIABLE_KEY_LENGTH", 0),
+		MaxBodyBytes:              int64(envInt("MAX_BODY_BYTES", 1<<20)),
+		CORSMaxAge:                envInt("CORS_MAX_AGE", 600),
+		CORSAllowCredentials:      envBool("CORS_ALLOW_CREDENTIALS", false),
+		CORSAllowedOrigins:        envListDefault("CORS_ALLOWED_ORIGINS", "http://localhost:3000"),
+		CORSEnabled:               envBool("CORS_ENABLED", true),
+		CORSStripBackendHeaders:   envBool("CORS_STRIP_BACKEND_HEADERS", true),
+		DefaultOperationName:      os.Getenv("DEFAULT_OPERATION_NAME"),
+		ReadOnly:                  envBool("READ_ONLY", false),
+		DailyQuota:                envInt("RATE_LIMIT_DAILY_QUOTA", 0),
+		SanitizeHeader:            envBool("SANITIZE_HEADER", false),
+		UpstreamHeaders:           envMap("UPSTREAM_HEADERS"),
+		AuditLog:                  envBool("AUDIT_LOG", envString("LOG_SINK", "mongo") == "mongo"),
+		AuditCollection:           envString("AUDIT_COLLECTION", "audit_log"),
+		RequestIDHeader:           envString("REQUEST_ID_HEADER", "X-Request-Id"),
+		SchemaValidation:          envBool("SCHEMA_VALIDATION", false),
+		SchemaRefreshInterval:     envDuration("SCHEMA_REFRESH_INTERVAL", 0),
+		MongoMaxPoolSize:          uint64(max(envInt("MONGO_MAX_POOL_SIZE", 100), 1)),
+		OperationRateLimits:       envIntMap("OPERATION_RATE_LIMITS"),
+		LogFallback:               os.Getenv("LOG_FALLBACK"),
+		LogFallbackSize:           envInt("LOG_FALLBACK_SIZE", 1000),
+		AdminAddr:                 envString("ADMIN_ADDR", ""),
+		ListenAddr:                envString("LISTEN_ADDR", ":8080"),
+		ListenSocketMode:          envFileMode("LISTEN_SOCKET_MODE", 0o660),
+		LogLevel:                  envString("LOG_LEVEL", "info"),
+		LogFormat:                 envString("LOG_FORMAT", "text"),
+		BackendTLSMinVersion:      envString("BACKEND_TLS_MIN_VERSION", "1.2"),
+		BackendTLSCiphers:         envList("BACKEND_TLS_CIPHERS"),
+		BackendCAFile:             os.Getenv("BACKEND_CA_FILE"),
+		BackendInsecureSkipVerify: envBool("BACKEND_INSECURE_SKIP_VERIFY", false),
+		IdempotencyTTL:            envDuration("IDEMPOTENCY_TTL", 0),
+		IdempotencyMaxKeys:        envInt("IDEMPOTENCY_MAX_KEYS", 10000),
+		MaxResponseBytes:          int64(envInt("MAX_RESPONSE_BYTES", 0)),
+		RateLimitPerMinute:        envInt("RATE_LIMIT_PER_MINUTE", 50),
+		MongoDB:                   envString("MONGO_DB", "Middleware_Logs"),
+		MongoCollection:           envString("MONGO_COLLECTION", "graphql_logs"),
+		SanitizeMode:              envString("SANITIZE_MODE", "all"),
+		MaxQueryCost:              envInt("MAX_QUERY_COST", 0),
+		QueryCostHeader:           envBool("QUERY_COST_HEADER", false),
+		BackendHTTP2:              envString("BACKEND_HTTP2", "auto"),
+		AllowedOperations:         envList("ALLOWED_OPERATIONS"),
+		MaxVariableArrayLength:    envInt("MAX_VARIABLE_ARRAY_LENGTH", 0),
+		MaxVariableArrayTotal:     envInt("MAX_VARIABLE_ARRAY_TOTAL", 0),
+		VariableArrayLimits:       envIntMap("VARIABLE_ARRAY_LIMITS"),
+		LivenessPath:              envString("LIVENESS_PATH", "/healthz"),
+		ReadinessPath:             envString("READINESS_PATH", "/readyz"),
+		RateLimitPenalty:          envDuration("RATE_LIMIT_PENALTY", 0),
+		RateLimitPenaltyMax:       envDuration("RATE_LIMIT_PENALTY_MAX", time.Hour),
+		RateLimitPenaltyReset:     envDuration("RATE_LIMIT_PENALTY_RESET", 10*time.Minute),
+		VariableSchemas:           envMap("VARIABLE_SCHEMAS"),
+		AccessLog:                 envString("ACCESS_LOG", ""),
+		MaxConcurrentRequests:     envInt("MAX_CONCURRENT_REQUESTS", 0),
+		QueueTimeout:              envDuration("QUEUE_TIMEOUT", 10*time.Second),
+		MetricsMaxOperations:      envInt("METRICS_MAX_OPERATIONS", 100),
+		MetricsOperationIdle:      envDuration("METRICS_OPERATION_IDLE", time.Hour),
+		TestMode:                  envBool("TEST_MODE", false),
+		TestBackendResponse:       envString("TEST_BACKEND_RESPONSE", ""),
+		SchemaEndpoint:            envBool("SCHEMA_ENDPOINT", false),
+		StrictOperationName:       envBool("STRICT_OPERATION_NAME", false),
+		LogStageTimings:           envBool("LOG_STAGE_TIMINGS", false),
+		MaxQueryDepth:             envInt("MAX_QUERY_DEPTH", 0),
+		RejectionDetails:          envBool("REJECTION_DETAILS", true),
+		UpstreamHost:              envString("UPSTREAM_HOST", ""),
+		CanarySticky:              envBool("CANARY_STICKY", false),
+		RateLimitWarmup:           envDuration("RATE_LIMIT_WARMUP", 0),
+		RateLimitWarmupMultiplier: envFloat("RATE_LIMIT_WARMUP_MULTIPLIER", 2),
+		MaxConditionalSelections:  envInt("MAX_CONDITIONAL_SELECTIONS", 0),
+		RejectionHTML:             envBool("REJECTION_HTML", false),
+		RejectionHTMLTemplate:     envString("REJECTION_HTML_TEMPLATE", ""),
+		LogHeaderMaxLength:        max(envInt("LOG_HEADER_MAX_LENGTH", 512), 0),
+		BodyBufferPool:            envBool("BODY_BUFFER_POOL", true),
+		BodyReadTimeout:           envDuration("BODY_READ_TIMEOUT", 30*time.Second),
+		ReadHeaderTimeout:         envDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		RateLimitExemptPaths:      envList("RATE_LIMIT_EXEMPT_PATHS"),
+		RequiredHeaders:           envList("REQUIRED_HEADERS"),
+		OperationSLOs:             envDurationMap("OPERATION_SLOS"),
+		LogVariables:              envBool("LOG_VARIABLES", true),
+		PanicRecovery:             envBool("PANIC_RECOVERY", true),
+		ShadowBackendURL:          os.Getenv("SHADOW_BACKEND_URL"),
+	}
+}
+
+func envString(key, def string) string {
+	if raw := os.Getenv(key); raw != "" {
+		return raw
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		slog.Warn("Invalid setting, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return n
+}
+
+func envBool(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		slog.Warn("Invalid setting, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return b
+}
+
+func envRegexp(key, def string) *regexp.Regexp {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return regexp.MustCompile(def)
+	}
+	re, err := regexp.Compile(raw)
+	if err != nil {
+		slog.Warn("Invalid pattern, using default", "key", key, "value", raw, "err", err)
+		return regexp.MustCompile(def)
+	}
+	return re
+}
+
+// envCIDRs parses a comma-separated list of CIDRs. Bare IPs are accepted as
+// single-host networks; invalid entries are logged and skipped.
+func envCIDRs(key string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, raw := range envList(key) {
+		if !strings.Contains(raw, "/") {
+			if ip := net.ParseIP(raw); ip != nil && ip.To4() != nil {
+				raw += "/32"
+			} else {
+				raw += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(raw)
+		if err != nil {
+			slog.Warn("Invalid setting entry", "key", key, "entry", raw, "err", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func envList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envMap parses a comma-separated list of key=value pairs.
+func envMap(key string) map[string]string {
+	items := make(map[string]string)
+	for _, item := range envList(key) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			slog.Warn("Invalid setting entry, expected key=value", "key", key, "entry", item)
+			continue
+		}
+		items[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return items
+}
+
+// envStatusMap parses key=status pairs such as UNAUTHENTICATED=401.
+func envStatusMap(key string) map[string]int {
+	statuses := make(map[string]int)
+	for k, v := range envMap(key) {
+		status, err := strconv.Atoi(v)
+		if err != nil || http.StatusText(status) == "" {
+			slog.Warn("Invalid status in setting", "key", key, "entry", k, "value", v)
+			continue
+		}
+		statuses[k] = status
+	}
+	return statuses
+}
+
+// envIntMap parses key=n pairs such as SearchProducts=5.
+func envIntMap(key string) map[string]int {
+	values := make(map[string]int)
+	for k, v := range envMap(key) {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			slog.Warn("Invalid value in setting", "key", key, "entry", k, "value", v)
+			continue
+		}
+		values[k] = n
+	}
+	return values
+}
+
+// envDurationMap parses key=duration pairs such as GetCart=250ms.
+func envDurationMap(key string) map[string]time.Duration {
+	values := make(map[string]time.Duration)
+	for k, v := range envMap(key) {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("Invalid value in setting", "key", key, "entry", k, "value", v)
+			continue
+		}
+		values[k] = d
+	}
+	return values
+}
+
+// envFileMode parses an octal permission mode such as 0660.
+func envFileMode(key string, def os.FileMode) os.FileMode {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || mode > 0o777 {
+		slog.Warn("Invalid setting, using default", "key", key, "value", raw, "default", def.String())
+		return def
+	}
+	return os.FileMode(mode)
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		slog.Warn("Invalid setting, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return d
+}
+
+func envFloat(key string, def float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		slog.Warn("Invalid setting, using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+	return f
+}
+
+func envListDefault(key, def string) []string {
+	if items := envList(key); len(items) > 0 {
+		return items
+	}
+	return strings.Split(def, ",")
+}
+
+// envPaths parses a comma-separated list of dotted field paths.
+func envPaths(key string) [][]string {
+	var paths [][]string
+	for _, item := range envList(key) {
+		paths = append(paths, strings.Split(item, "."))
+	}
+	return paths
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, rt route) {
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); originAllowed(origin, cfg.CORSAllowedOrigins) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Access-Control-Allow-Methods", rt.allowHeader())
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if cfg.CORSAllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Allow-Credentials",
+}
+
+// stripBackendCORSHeaders removes the backend's CORS headers so only the
+// proxy's own policy reaches the client. CORS_STRIP_BACKEND_HEADERS=false
+// keeps them for backends trusted to set their own.
+func stripBackendCORSHeaders(h http.Header) {
+	for _, name := range corsResponseHeaders {
+		h.Del(name)
+	}
+}
+
+// backendCORSWriter lets preserved backend CORS headers take precedence. The
+// reverse proxy adds the backend's headers after the proxy's own, so where
+// both set one only the last value is kept.
+type backendCORSWriter struct {
+	http.ResponseWriter
+}
+
+func (w backendCORSWriter) WriteHeader(status int) {
+	h := w.Header()
+	for _, name := range corsResponseHeaders {
+		if values := h.Values(name); len(values) > 1 {
+			h.Set(name, values[len(values)-1])
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w backendCORSWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writePreflight answers an OPTIONS request. Max-Age lets browsers cache the
+// preflight instead of repeating it before every request.
+func writePreflight(w http.ResponseWriter) {
+	if cfg.CORSMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.CORSMaxAge))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// originAllowed matches origin against the allowlist. An entry such as
+// https://*.example.com matches any subdomain over the same scheme, but not
+// example.com itself, which needs its own entry.
+func originAllowed(origin string, allowed []string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, pattern := range allowed {
+		if pattern == origin {
+			return true
+		}
+		scheme, host, ok := strings.Cut(pattern, "://*.")
+		if !ok {
+			continue
+		}
+		prefix := scheme + "://"
+		if strings.HasPrefix(origin, prefix) {
+			sub, found := strings.CutSuffix(strings.TrimPrefix(origin, prefix), "."+host)
+			if found && sub != "" && !strings.ContainsAny(sub, "/:") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPreflightHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantMaxAge      string
+		wantCredentials string
+	}{
+		{"defaults", nil, "600", ""},
+		{"configured", map[string]string{"CORS_MAX_AGE": "86400", "CORS_ALLOW_CREDENTIALS": "true"}, "86400", "true"},
+		{"max age disabled", map[string]string{"CORS_MAX_AGE": "0"}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, tt.env, nil)
+			resp, _ := send(t, http.MethodOptions, p.URL+"/public", "", map[string]string{
+				"Origin":                        "http://localhost:3000",
+				"Access-Control-Request-Method": "POST",
+			})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if v := resp.Header.Get("Access-Control-Max-Age"); v != tt.wantMaxAge {
+				t.Errorf("Access-Control-Max-Age = %q, want %q", v, tt.wantMaxAge)
+			}
+			if v := resp.Header.Get("Access-Control-Allow-Credentials"); v != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", v, tt.wantCredentials)
+			}
+			if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "http://localhost:3000" {
+				t.Errorf("Access-Control-Allow-Origin = %q", v)
+			}
+			if n := len(p.backend.received()); n != 0 {
+				t.Errorf("preflight reached the backend")
+			}
+		})
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://*.example.com", "http://localhost:3000"}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://shop.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"http://shop.example.com", false},
+		{"https://shop.example.com.evil.test", false},
+		{"https://evilexample.com", false},
+		{"https://shop.example.com:8443", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, allowed); got != tt.want {
+			t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestWildcardOriginIsEchoed(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://*.example.com"}, nil)
+	for origin, want := range map[string]string{
+		"https://shop.example.com": "https://shop.example.com",
+		"https://example.com":      "",
+		"https://other.test":       "",
+	} {
+		resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"Origin": origin})
+		if v := resp.Header.Get("Access-Control-Allow-Origin"); v != want {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", origin, v, want)
+		}
+	}
+}
+
+// corsBackend answers like the default stub, with CORS headers of its own.
+func corsBackend(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+	w.Header().Set("Access-Control-Allow-Headers", "X-Backend")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"data":{}}`))
+}
+
+func TestCORSDisabled(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"CORS_ENABLED": "false", "CORS_ALLOW_CREDENTIALS": "true"}, nil)
+	origin := map[string]string{"Origin": "http://localhost:3000"}
+
+	resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, origin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	for _, name := range append(corsResponseHeaders, "Access-Control-Max-Age", "Vary") {
+		if v := resp.Header.Values(name); len(v) != 0 {
+			t.Errorf("%s = %q with CORS disabled", name, v)
+		}
+	}
+
+	resp, _ = send(t, http.MethodOptions, p.URL+"/public", "", map[string]string{
+		"Origin":                        "http://localhost:3000",
+		"Access-Control-Request-Method": "POST",
+	})
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("OPTIONS status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	if allow := resp.Header.Get("Allow"); allow != "POST" {
+		t.Errorf("Allow = %q, want OPTIONS left out", allow)
+	}
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("preflight answered with Access-Control-Allow-Origin = %q", v)
+	}
+
+	p = newTestProxy(t, map[string]string{"CORS_ENABLED": "false"}, corsBackend)
+	resp, _ = p.post(t, "/public", `{"query":"{ a }"}`, origin)
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "https://backend.example" {
+		t.Errorf("backend Access-Control-Allow-Origin = %q, want it passed through untouched", v)
+	}
+}
+
+func TestBackendCORSHeaders(t *testing.T) {
+	origin := map[string]string{"Origin": "http://localhost:3000"}
+	tests := []struct {
+		name, strip            string
+		wantOrigin, wantHeader string
+	}{
+		{"strip", "true", "http://localhost:3000", "Content-Type, Authorization"},
+		{"preserve", "false", "https://backend.example", "X-Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, map[string]string{"CORS_STRIP_BACKEND_HEADERS": tt.strip}, corsBackend)
+			resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, origin)
+			if v := resp.Header.Values("Access-Control-Allow-Origin"); len(v) != 1 || v[0] != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want only %q", v, tt.wantOrigin)
+			}
+			if v := resp.Header.Values("Access-Control-Allow-Headers"); len(v) != 1 || v[0] != tt.wantHeader {
+				t.Errorf("Access-Control-Allow-Headers = %q, want only %q", v, tt.wantHeader)
+			}
+			// The backend sets no Allow-Methods, so the proxy's is kept either way.
+			if v := resp.Header.Get("Access-Control-Allow-Methods"); v != "POST, OPTIONS" {
+				t.Errorf("Access-Control-Allow-Methods = %q", v)
+			}
+		})
+	}
+}
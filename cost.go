@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// listSizeArgs are the pagination arguments taken as the number of items a
+// list field returns.
+var listSizeArgs = []string{"first", "last", "limit"}
+
+// costCeiling is where cost arithmetic saturates. Page sizes and products
+// past it are taken as costCeiling, so a huge `first:` can't overflow into a
+// small or negative cost that slips under MAX_QUERY_COST.
+const costCeiling = math.MaxInt32
+
+func saturatingAdd(a, b int) int {
+	if b > costCeiling-a {
+		return costCeiling
+	}
+	return a + b
+}
+
+func saturatingMul(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > costCeiling/b {
+		return costCeiling
+	}
+	return a * b
+}
+
+// queryCostResult is the estimate made by queryCost. conditional counts the
+// selections gated by @skip or @include.
+type queryCostResult struct {
+	cost        int
+	conditional int
+}
+
+// queryCost estimates the cost of the operation that will execute: each field
+// costs 1, multiplied by the list sizes requested by its ancestors, so
+// `users(first: 10) { friends(first: 10) { name } }` costs 1 + 10 + 100.
+// Fields under @skip or @include are costed in full whatever their condition,
+// because variables can switch all of them on at once. The cost saturates at
+// costCeiling rather than overflowing. It returns false if
+// the query does not parse or the operation is not found.
+func queryCost(query, opName string, variables map[string]interface{}) (queryCostResult, bool) {
+	doc, err := parseQuery(query)
+	if err != nil {
+		return queryCostResult{}, false
+	}
+	op := selectOperation(doc, opName)
+	if op == nil {
+		return queryCostResult{}, false
+	}
+
+	var result queryCostResult
+	var cost func(set ast.SelectionSet, multiplier int, visiting map[string]bool) int
+	cost = func(set ast.SelectionSet, multiplier int, visiting map[string]bool) int {
+		total := 0
+		for _, sel := range set {
+			if isConditional(sel) {
+				result.conditional++
+			}
+			switch s := sel.(type) {
+			case *ast.Field:
+				total = saturatingAdd(total, multiplier)
+				total = saturatingAdd(total, cost(s.SelectionSet, saturatingMul(multiplier, listSize(s, variables)), visiting))
+			case *ast.InlineFragment:
+				total = saturatingAdd(total, cost(s.SelectionSet, multiplier, visiting))
+			case *ast.FragmentSpread:
+				frag := doc.Fragments.ForName(s.Name)
+				// A fragment cycle is invalid GraphQL; count it once.
+				if frag == nil || visiting[s.Name] {
+					continue
+				}
+				visiting[s.Name] = true
+				total = saturatingAdd(total, cost(frag.SelectionSet, multiplier, visiting))
+				delete(visiting, s.Name)
+			}
+		}
+		return total
+	}
+	result.cost = cost(op.SelectionSet, 1, make(map[string]bool))
+	return result, true
+}
+
+func isConditional(sel ast.Selection) bool {
+	var directives ast.DirectiveList
+	switch s := sel.(type) {
+	case *ast.Field:
+		directives = s.Directives
+	case *ast.InlineFragment:
+		directives = s.Directives
+	case *ast.FragmentSpread:
+		directives = s.Directives
+	}
+	return directives.ForName("skip") != nil || directives.ForName("include") != nil
+}
+
+// queryDepth returns the nesting depth of the operation that will execute,
+// counting fields but not fragments, and the path to one of the deepest
+// fields. It returns false if the query does not parse or the operation is
+// not found.
+func queryDepth(query, opName string) (int, []string, bool) {
+	doc, err := parseQuery(query)
+	if err != nil {
+		return 0, nil, false
+	}
+	op := selectOperation(doc, opName)
+	if op == nil {
+		return 0, nil, false
+	}
+
+	var deepest []string
+	var walk func(set ast.SelectionSet, path []string, visiting map[string]bool)
+	walk = func(set ast.SelectionSet, path []string, visiting map[string]bool) {
+		for _, sel := range set {
+			switch s := sel.(type) {
+			case *ast.Field:
+				fieldPath := append(path[:len(path):len(path)], s.Name)
+				if len(fieldPath) > len(deepest) {
+					deepest = fieldPath
+				}
+				walk(s.SelectionSet, fieldPath, visiting)
+			case *ast.InlineFragment:
+				walk(s.SelectionSet, path, visiting)
+			case *ast.FragmentSpread:
+				frag := doc.Fragments.ForName(s.Name)
+				if frag == nil || visiting[s.Name] {
+					continue
+				}
+				visiting[s.Name] = true
+				walk(frag.SelectionSet, path, visiting)
+				delete(visiting, s.Name)
+			}
+		}
+	}
+	walk(op.SelectionSet, nil, make(map[string]bool))
+	return len(deepest), deepest, true
+}
+
+// listSize returns the page size a field asks for, or 1, clamped to
+// costCeiling. Literals too large for an int and huge or infinite floats from
+// variables count as costCeiling rather than being dropped.
+func listSize(f *ast.Field, variables map[string]interface{}) int {
+	for _, name := range listSizeArgs {
+		arg := f.Arguments.ForName(name)
+		if arg == nil {
+			continue
+		}
+		var raw interface{} = arg.Value.Raw
+		if arg.Value.Kind == ast.Variable {
+			raw = variables[arg.Value.Raw]
+		}
+		switch v := raw.(type) {
+		case string:
+			n, err := strconv.Atoi(v)
+			if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(v, "-") {
+				return costCeiling
+			}
+			if err == nil && n > 0 {
+				return min(n, costCeiling)
+			}
+		case float64:
+			if v >= costCeiling {
+				return costCeiling
+			}
+			if v >= 1 {
+				return int(v)
+			}
+		}
+	}
+	return 1
+}
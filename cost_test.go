@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQueryCost(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		opName      string
+		variables   map[string]interface{}
+		want        int
+		conditional int
+	}{
+		{"flat fields", `{ a b c }`, "", nil, 3, 0},
+		{"nested lists multiply", `{ users(first: 10) { friends(first: 10) { name } } }`, "", nil, 1 + 10 + 100, 0},
+		{"limit and last", `{ a(limit: 5) { b } c(last: 2) { d } }`, "", nil, 1 + 5 + 1 + 2, 0},
+		{"page size from a variable", `query Q($n: Int) { a(first: $n) { b } }`, "Q", map[string]interface{}{"n": float64(20)}, 21, 0},
+		{"missing variable counts as 1", `query Q($n: Int) { a(first: $n) { b } }`, "Q", nil, 2, 0},
+		{"fragments", `{ a(first: 3) { ...F ... on T { c } } } fragment F on T { b }`, "", nil, 1 + 3 + 3, 0},
+		{"fragment cycle counted once", `{ ...F } fragment F on Query { a ...F }`, "", nil, 1, 0},
+		{"conditional selections", `query Q($x: Boolean!) { a @skip(if: $x) b @include(if: $x) { c } d }`, "Q", nil, 4, 2},
+		{"selected operation", `query A { a } query B { b(first: 4) { c } }`, "B", nil, 5, 0},
+		{"overflowing literal saturates", `{ a(first: 4611686018427387904) { b c d e } }`, "", nil, costCeiling, 0},
+		{"literal beyond int range saturates", `{ a(first: 99999999999999999999) { b } }`, "", nil, costCeiling, 0},
+		{"huge float variable saturates", `query Q($n: Int) { a(first: $n) { b } }`, "Q", map[string]interface{}{"n": 1e300}, costCeiling, 0},
+		{"nested products saturate", `{ a(first: 100000) { b(first: 100000) { c(first: 100000) { d } } } }`, "", nil, costCeiling, 0},
+		{"negative size counts as 1", `{ a(first: -5) { b } }`, "", nil, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := queryCost(tt.query, tt.opName, tt.variables)
+			if !ok {
+				t.Fatal("queryCost failed")
+			}
+			if got.cost != tt.want || got.conditional != tt.conditional {
+				t.Errorf("queryCost = %d (%d conditional), want %d (%d conditional)", got.cost, got.conditional, tt.want, tt.conditional)
+			}
+		})
+	}
+
+	for _, q := range []struct{ query, opName string }{{`{ a`, ""}, {`query A { a }`, "B"}} {
+		if _, ok := queryCost(q.query, q.opName, nil); ok {
+			t.Errorf("queryCost(%q, %q) succeeded", q.query, q.opName)
+		}
+	}
+}
+
+func TestQueryCostHeader(t *testing.T) {
+	query := `{"query":"{ users(first: 10) { friends(first: 10) { name } } }"}`
+	p := newTestProxy(t, map[string]string{"QUERY_COST_HEADER": "true", "MAX_QUERY_COST": "500"}, nil)
+	resp, _ := p.post(t, "/public", query, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if v := resp.Header.Get("X-Query-Cost"); v != "111" {
+		t.Errorf("X-Query-Cost = %q, want 111", v)
+	}
+	if v := resp.Header.Get("X-Query-Cost-Remaining"); v != "389" {
+		t.Errorf("X-Query-Cost-Remaining = %q, want 389", v)
+	}
+
+	p = newTestProxy(t, map[string]string{"QUERY_COST_HEADER": "true", "MAX_QUERY_COST": "0"}, nil)
+	resp, _ = p.post(t, "/public", query, nil)
+	if v := resp.Header.Get("X-Query-Cost"); v != "111" {
+		t.Errorf("X-Query-Cost without a budget = %q, want 111", v)
+	}
+	if v, ok := resp.Header["X-Query-Cost-Remaining"]; ok {
+		t.Errorf("X-Query-Cost-Remaining = %q without a budget", v)
+	}
+
+	p = newTestProxy(t, map[string]string{"QUERY_COST_HEADER": "false", "MAX_QUERY_COST": "500"}, nil)
+	resp, _ = p.post(t, "/public", query, nil)
+	if v := resp.Header.Get("X-Query-Cost"); v != "" {
+		t.Errorf("X-Query-Cost = %q with QUERY_COST_HEADER=false", v)
+	}
+}
+
+func TestMaxQueryCost(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"MAX_QUERY_COST": "100", "QUERY_COST_HEADER": "true"}, nil)
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"within budget", `{"query":"{ a(first: 10) { b } }"}`, http.StatusOK},
+		{"over budget", `{"query":"{ a(first: 10) { b(first: 10) { c } } }"}`, http.StatusBadRequest},
+		{"overflowing page size", `{"query":"{ a(first: 4611686018427387904) { b c d e } }"}`, http.StatusBadRequest},
+		{"huge float variable", `{"query":"query Q($n: Int) { a(first: $n) { b } }","variables":{"n":1e300}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := p.post(t, "/public", tt.body, nil)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.want, body)
+			}
+			cost, err := strconv.Atoi(resp.Header.Get("X-Query-Cost"))
+			if err != nil || cost <= 0 {
+				t.Errorf("X-Query-Cost = %q, want a positive cost", resp.Header.Get("X-Query-Cost"))
+			}
+		})
+	}
+}
+
+func TestQueryDepth(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		opName string
+		want   int
+		path   []string
+	}{
+		{"flat fields", `{ a b }`, "", 1, []string{"a"}},
+		{"deepest branch wins", `{ a { b } c { d { e } } }`, "", 3, []string{"c", "d", "e"}},
+		{"inline fragments add no depth", `{ a { ... on T { b { c } } } }`, "", 3, []string{"a", "b", "c"}},
+		{"named fragments are followed", `{ a { ...F } } fragment F on T { b { c } }`, "", 3, []string{"a", "b", "c"}},
+		{"recursive fragments stop", `{ a { ...F } } fragment F on T { b { ...F } }`, "", 2, []string{"a", "b"}},
+		{"selected operation", `query A { a } query B { b { c } }`, "B", 2, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depth, path, ok := queryDepth(tt.query, tt.opName)
+			if !ok || depth != tt.want || !reflect.DeepEqual(path, tt.path) {
+				t.Errorf("queryDepth = %d, %v, %v; want %d, %v", depth, path, ok, tt.want, tt.path)
+			}
+		})
+	}
+
+	for _, tt := range []struct{ query, opName string }{{`{ a `, ""}, {`query A { a }`, "B"}} {
+		if _, _, ok := queryDepth(tt.query, tt.opName); ok {
+			t.Errorf("queryDepth(%q, %q) ok, want a failure", tt.query, tt.opName)
+		}
+	}
+}
+
+func TestMaxQueryDepth(t *testing.T) {
+	deep := `{"query":"{ a { b { c { d } } } e }"}`
+
+	t.Run("rejection explains the limit", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"MAX_QUERY_DEPTH": "2"}, nil)
+		if resp, body := p.post(t, "/public", `{"query":"{ a { b } }"}`, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("query at the limit: status = %d: %s", resp.StatusCode, body)
+		}
+		resp, body := p.post(t, "/public", deep, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+		var env errorEnvelope
+		if err := json.Unmarshal([]byte(body), &env); err != nil || len(env.Errors) != 1 {
+			t.Fatalf("body = %s", body)
+		}
+		if msg := env.Errors[0].Message; msg != "Query depth 4 exceeds the maximum of 2 at a.b.c.d" {
+			t.Errorf("message = %q", msg)
+		}
+		ext := env.Errors[0].Extensions
+		if ext["measured"] != float64(4) || ext["limit"] != float64(2) {
+			t.Errorf("extensions = %v, want measured 4 and limit 2", ext)
+		}
+		if path := ext["path"]; !reflect.DeepEqual(path, []interface{}{"a", "b", "c", "d"}) {
+			t.Errorf("extensions path = %v", path)
+		}
+		if n := len(p.backend.received()); n != 1 {
+			t.Errorf("backend received %d requests, want only the query within the limit", n)
+		}
+	})
+
+	t.Run("details off", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"MAX_QUERY_DEPTH": "2", "REJECTION_DETAILS": "false"}, nil)
+		resp, body := p.post(t, "/public", deep, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+		var env errorEnvelope
+		if err := json.Unmarshal([]byte(body), &env); err != nil || len(env.Errors) != 1 {
+			t.Fatalf("body = %s", body)
+		}
+		if _, ok := env.Errors[0].Extensions["measured"]; ok {
+			t.Errorf("extensions = %v with REJECTION_DETAILS=false", env.Errors[0].Extensions)
+		}
+	})
+}
+
+// includeGated returns a query with n fields under @include(if: $on).
+func includeGated(n int) string {
+	var b strings.Builder
+	b.WriteString("query Q($on: Boolean!) { items(first: 10) {")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, " f%d @include(if: $on)", i)
+	}
+	b.WriteString(" } }")
+	return b.String()
+}
+
+func TestConditionalSelectionCost(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		want        int
+		conditional int
+	}{
+		{"gated fields cost in full", includeGated(30), 1 + 10*30, 30},
+		{"gated subtrees cost in full", `query Q($x: Boolean!) { a(first: 5) @skip(if: $x) { b c } }`, 1 + 5 + 5, 1},
+		{"gated inline fragments", `query Q($x: Boolean!) { a { ... on T @include(if: $x) { b c } } }`, 3, 1},
+		{"gated fragment spreads", `query Q($x: Boolean!) { a { ...F @include(if: $x) } } fragment F on T { b c }`, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, on := range []bool{false, true} {
+				got, ok := queryCost(tt.query, "Q", map[string]interface{}{"on": on, "x": on})
+				if !ok {
+					t.Fatal("queryCost failed")
+				}
+				if got.cost != tt.want || got.conditional != tt.conditional {
+					t.Errorf("condition %v: queryCost = %d (%d conditional), want %d (%d conditional)", on, got.cost, got.conditional, tt.want, tt.conditional)
+				}
+			}
+		})
+	}
+}
+
+func TestConditionalSelectionsOverBudget(t *testing.T) {
+	body := func(n int) string {
+		payload, _ := json.Marshal(map[string]interface{}{"query": includeGated(n), "variables": map[string]interface{}{"on": false}})
+		return string(payload)
+	}
+
+	t.Run("max query cost", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"MAX_QUERY_COST": "200"}, nil)
+		if resp, body := p.post(t, "/public", body(19), nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("19 gated fields: status = %d: %s", resp.StatusCode, body)
+		}
+		resp, respBody := p.post(t, "/public", body(20), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("20 gated fields switched off: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+		if msg := errorMessage(t, respBody); msg != "Query cost 201 exceeds the maximum of 200" {
+			t.Errorf("message = %q", msg)
+		}
+	})
+
+	t.Run("max conditional selections", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"MAX_CONDITIONAL_SELECTIONS": "10"}, nil)
+		if resp, body := p.post(t, "/public", body(10), nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("10 gated fields: status = %d: %s", resp.StatusCode, body)
+		}
+		resp, respBody := p.post(t, "/public", body(11), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("11 gated fields: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+		if msg := errorMessage(t, respBody); msg != "Query has 11 selections under @skip or @include, more than the maximum of 10" {
+			t.Errorf("message = %q", msg)
+		}
+		if n := len(p.backend.received()); n != 1 {
+			t.Errorf("backend received %d requests, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errorCodes are the extensions.code values sent with each status, following
+// the GraphQL convention so clients can branch on them without parsing text.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "BAD_REQUEST",
+	http.StatusUnauthorized:          "UNAUTHENTICATED",
+	http.StatusForbidden:             "FORBIDDEN",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusMethodNotAllowed:      "METHOD_NOT_ALLOWED",
+	http.StatusRequestTimeout:        "REQUEST_TIMEOUT",
+	http.StatusConflict:              "CONFLICT",
+	http.StatusRequestEntityTooLarge: "PAYLOAD_TOO_LARGE",
+	http.StatusUnsupportedMediaType:  "UNSUPPORTED_MEDIA_TYPE",
+	http.StatusUnprocessableEntity:   "UNPROCESSABLE_ENTITY",
+	http.StatusTooManyRequests:       "RATE_LIMITED",
+	http.StatusInternalServerError:   "INTERNAL_SERVER_ERROR",
+	http.StatusBadGateway:            "BAD_GATEWAY",
+	http.StatusServiceUnavailable:    "SERVICE_UNAVAILABLE",
+	http.StatusGatewayTimeout:        "GATEWAY_TIMEOUT",
+}
+
+type errorEnvelope struct {
+	Errors []errorItem `json:"errors"`
+}
+
+type errorItem struct {
+	Message    string                 `json:"message"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// writeError sends a GraphQL-style error body so every failure produced by
+// the proxy has the same shape as errors from the backend.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeErrorDetails(w, status, msg, nil)
+}
+
+// writeErrorDetails is writeError with extra fields in extensions alongside
+// the code, such as the measured value and limit of a failed check.
+func writeErrorDetails(w http.ResponseWriter, status int, msg string, details map[string]interface{}) {
+	item := errorItem{Message: msg}
+	if code, ok := errorCodes[status]; ok || len(details) > 0 {
+		item.Extensions = make(map[string]interface{}, len(details)+1)
+		for k, v := range details {
+			item.Extensions[k] = v
+		}
+		if ok {
+			item.Extensions["code"] = code
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorEnvelope{Errors: []errorItem{item}})
+}
+
+const defaultRejectionTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`
+
+// rejectionTemplate renders errors for browsers when REJECTION_HTML is on.
+var rejectionTemplate = template.Must(template.New("rejection").Parse(defaultRejectionTemplate))
+
+// rejectionPage is the data REJECTION_HTML_TEMPLATE is executed with.
+type rejectionPage struct {
+	Status     int
+	StatusText string
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// loadRejectionTemplate replaces the built-in page with
+// REJECTION_HTML_TEMPLATE, an html/template file, if one is configured.
+func loadRejectionTemplate() error {
+	if cfg.RejectionHTMLTemplate == "" {
+		return nil
+	}
+	tmpl, err := template.ParseFiles(cfg.RejectionHTMLTemplate)
+	if err != nil {
+		return err
+	}
+	rejectionTemplate = tmpl
+	return nil
+}
+
+// writeNegotiatedError answers with an HTML page when REJECTION_HTML is on and
+// the client prefers text/html over JSON, as a browser navigating to the URL
+// does, and with the JSON envelope otherwise.
+func writeNegotiatedError(w http.ResponseWriter, r *http.Request, status int, msg string, details map[string]interface{}) {
+	if cfg.RejectionHTML {
+		w.Header().Add("Vary", "Accept")
+	}
+	if !cfg.RejectionHTML || !prefersHTML(r.Header.Get("Accept")) {
+		writeErrorDetails(w, status, msg, details)
+		return
+	}
+	page := rejectionPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       errorCodes[status],
+		Message:    msg,
+		RequestID:  w.Header().Get(cfg.RequestIDHeader),
+	}
+	var buf bytes.Buffer
+	if err := rejectionTemplate.Execute(&buf, page); err != nil {
+		slog.ErrorContext(r.Context(), "Error rendering rejection template", "err", err)
+		writeErrorDetails(w, status, msg, details)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// prefersHTML reports whether an Accept header ranks text/html above
+// application/json. A missing header or a tie goes to JSON.
+func prefersHTML(accept string) bool {
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality returns the q-value Accept gives mediaType, taking the most
+// specific matching range.
+func acceptQuality(accept, mediaType string) float64 {
+	major, _, _ := strings.Cut(mediaType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		rangeType = strings.ToLower(strings.TrimSpace(rangeType))
+		specificity := -1
+		switch rangeType {
+		case mediaType:
+			specificity = 2
+		case major + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefersHTML(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"text/html", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+		{"text/html;q=0.5, application/json", false},
+		{"application/json, text/html", false},
+		{"*/*", false},
+		{"text/*, application/json;q=0.1", true},
+	}
+	for _, tt := range tests {
+		if got := prefersHTML(tt.accept); got != tt.want {
+			t.Errorf("prefersHTML(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiatedRejection(t *testing.T) {
+	browser := map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"}
+	api := map[string]string{"Accept": "application/json"}
+
+	t.Run("html for browsers, json for api clients", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"REJECTION_HTML": "true"}, nil)
+		resp, body := send(t, http.MethodGet, p.URL+"/nope", "", browser)
+		if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("browser: %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(body, "<h1>404 Not Found</h1>") {
+			t.Errorf("browser body = %s", body)
+		}
+		if resp.Header.Get("Vary") != "Accept" {
+			t.Errorf("Vary = %q", resp.Header.Get("Vary"))
+		}
+
+		resp, body = p.post(t, "/public", `{"query":`, browser)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "<p>Invalid JSON body</p>") {
+			t.Errorf("browser rejection: %d %s", resp.StatusCode, body)
+		}
+
+		for name, header := range map[string]map[string]string{"api client": api, "no Accept": nil} {
+			resp, body = send(t, http.MethodGet, p.URL+"/nope", "", header)
+			if resp.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("%s: Content-Type = %q", name, resp.Header.Get("Content-Type"))
+			}
+			if msg := errorMessage(t, body); msg != "Not Found" {
+				t.Errorf("%s: message = %q", name, msg)
+			}
+		}
+	})
+
+	t.Run("json when disabled", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"REJECTION_HTML": "false"}, nil)
+		resp, body := send(t, http.MethodGet, p.URL+"/nope", "", browser)
+		if resp.Header.Get("Content-Type") != "application/json" || errorMessage(t, body) != "Not Found" {
+			t.Errorf("browser with REJECTION_HTML=false: %q %s", resp.Header.Get("Content-Type"), body)
+		}
+	})
+
+	t.Run("custom template", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rejection.html")
+		if err := os.WriteFile(path, []byte(`<p class="{{.Code}}">{{.Status}}: {{.Message}}</p>`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		p := newTestProxy(t, map[string]string{"REJECTION_HTML": "true", "REJECTION_HTML_TEMPLATE": path}, nil)
+		prev := rejectionTemplate
+		t.Cleanup(func() { rejectionTemplate = prev })
+		if err := loadRejectionTemplate(); err != nil {
+			t.Fatal(err)
+		}
+		resp, body := send(t, http.MethodGet, p.URL+"/nope", "", browser)
+		if want := `<p class="` + errorCodes[http.StatusNotFound] + `">404: Not Found</p>`; body != want {
+			t.Errorf("body = %q, want %q", body, want)
+		}
+		if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+		}
+	})
+
+	t.Run("missing template file", func(t *testing.T) {
+		useConfig(t, map[string]string{"REJECTION_HTML_TEMPLATE": filepath.Join(t.TempDir(), "missing.html")})
+		prev := rejectionTemplate
+		t.Cleanup(func() { rejectionTemplate = prev })
+		if err := loadRejectionTemplate(); err == nil {
+			t.Error("loadRejectionTemplate succeeded without the file")
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errQueueTimeout = errors.New("timed out waiting for a request slot")
+
+var queuedRequestsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "proxy_queued_requests",
+	Help: "Requests waiting for a MAX_CONCURRENT_REQUESTS slot",
+})
+
+// fairLimiter caps the requests proxied at once. Once it is saturated,
+// waiters are queued per IP and freed slots are handed out round-robin
+// across the IPs waiting, so a client flooding the queue only ever holds its
+// own turn and can't starve the others.
+type fairLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	active int
+	queues map[string]*list.List // of *fairWaiter, per IP
+	ring   *list.List            // IPs with waiters, in service order
+	next   *list.Element         // ring position served next
+}
+
+type fairWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newFairLimiter(limit int) *fairLimiter {
+	return &fairLimiter{limit: limit, queues: make(map[string]*list.List), ring: list.New()}
+}
+
+// concurrencyLimiter is nil when MAX_CONCURRENT_REQUESTS is 0.
+var concurrencyLimiter *fairLimiter
+
+// acquire waits up to timeout for a slot. Every successful acquire must be
+// paired with a release.
+func (l *fairLimiter) acquire(ctx context.Context, ip string, timeout time.Duration) error {
+	l.mu.Lock()
+	if l.active < l.limit && l.ring.Len() == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	w := &fairWaiter{ready: make(chan struct{})}
+	queue, ok := l.queues[ip]
+	if !ok {
+		queue = list.New()
+		l.queues[ip] = queue
+		l.ring.PushBack(ip)
+	}
+	elem := queue.PushBack(w)
+	queuedRequestsGauge.Inc()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// The slot was handed over as we gave up; pass it on.
+		l.releaseLocked()
+		return err
+	}
+	queue.Remove(elem)
+	queuedRequestsGauge.Dec()
+	if queue.Len() == 0 {
+		l.dropIP(ip)
+	}
+	return err
+}
+
+func (l *fairLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked hands the slot to the first waiter of the next IP in the
+// ring, or frees it if nobody is waiting. l.mu must be held.
+func (l *fairLimiter) releaseLocked() {
+	if l.ring.Len() == 0 {
+		l.active--
+		return
+	}
+	if l.next == nil {
+		l.next = l.ring.Front()
+	}
+	ip := l.next.Value.(string)
+	queue := l.queues[ip]
+	w := queue.Remove(queue.Front()).(*fairWaiter)
+	queuedRequestsGauge.Dec()
+
+	l.next = l.next.Next()
+	if queue.Len() == 0 {
+		l.dropIP(ip)
+	}
+	w.granted = true
+	close(w.ready)
+}
+
+// dropIP removes an IP with no more waiters from the ring. l.mu must be held.
+func (l *fairLimiter) dropIP(ip string) {
+	delete(l.queues, ip)
+	for e := l.ring.Front(); e != nil; e = e.Next() {
+		if e.Value.(string) == ip {
+			if l.next == e {
+				l.next = e.Next()
+			}
+			l.ring.Remove(e)
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queuedFor reports how many requests from ip are waiting in l.
+func (l *fairLimiter) queuedFor(ip string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if q, ok := l.queues[ip]; ok {
+		return q.Len()
+	}
+	return 0
+}
+
+func waitForQueued(t *testing.T, l *fairLimiter, ip string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.queuedFor(ip) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d queued, want %d", ip, l.queuedFor(ip), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func useConcurrencyLimit(t *testing.T, limit int) *fairLimiter {
+	prev := concurrencyLimiter
+	concurrencyLimiter = newFairLimiter(limit)
+	t.Cleanup(func() { concurrencyLimiter = prev })
+	return concurrencyLimiter
+}
+
+var operationNamePattern = regexp.MustCompile(`query (\w+)`)
+
+func TestFairQueueingAcrossIPs(t *testing.T) {
+	arrivals := make(chan string, 10)
+	release := make(chan struct{})
+	p := newTestProxy(t, map[string]string{"TRUSTED_PROXIES": "127.0.0.1", "RATE_LIMIT_PER_MINUTE": "100", "QUEUE_TIMEOUT": "10s"}, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		arrivals <- operationNamePattern.FindStringSubmatch(string(body))[1]
+		<-release
+		w.Write([]byte(`{"data":{}}`))
+	})
+	limiter := useConcurrencyLimit(t, 1)
+
+	done := make(chan int, 10)
+	request := func(ip, op string) {
+		req, _ := http.NewRequest(http.MethodPost, p.URL+"/public", strings.NewReader(`{"query":"query `+op+` { a }"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", ip)
+		go func() {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				done <- 0
+				return
+			}
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+	}
+	next := func() string {
+		t.Helper()
+		select {
+		case op := <-arrivals:
+			return op
+		case <-time.After(5 * time.Second):
+			t.Fatal("no request reached the backend")
+			return ""
+		}
+	}
+
+	request("203.0.113.1", "Holder")
+	if op := next(); op != "Holder" {
+		t.Fatalf("first request = %s", op)
+	}
+	// The noisy client queues four requests before the quiet one arrives.
+	for i, op := range []string{"A1", "A2", "A3", "A4"} {
+		request("198.51.100.1", op)
+		waitForQueued(t, limiter, "198.51.100.1", i+1)
+	}
+	request("198.51.100.2", "B1")
+	waitForQueued(t, limiter, "198.51.100.2", 1)
+
+	var order []string
+	for i := 0; i < 5; i++ {
+		release <- struct{}{}
+		order = append(order, next())
+	}
+	release <- struct{}{}
+	want := []string{"A1", "B1", "A2", "A3", "A4"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("service order = %v, want %v", order, want)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("status = %d", status)
+		}
+	}
+}
+
+func TestFairLimiterQueueTimeout(t *testing.T) {
+	l := newFairLimiter(1)
+	if err := l.acquire(context.Background(), "10.0.0.1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire(context.Background(), "10.0.0.2", 10*time.Millisecond); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("acquire on a full limiter = %v, want errQueueTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.acquire(ctx, "10.0.0.2", time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire with a canceled context = %v", err)
+	}
+	if n := l.queuedFor("10.0.0.2"); n != 0 {
+		t.Errorf("%d waiters left queued after giving up", n)
+	}
+	l.release()
+	if err := l.acquire(context.Background(), "10.0.0.2", 10*time.Millisecond); err != nil {
+		t.Errorf("acquire after release = %v", err)
+	}
+}
+
+func TestOverloadedResponse(t *testing.T) {
+	hold := make(chan struct{})
+	p := newTestProxy(t, map[string]string{"QUEUE_TIMEOUT": "20ms"}, func(w http.ResponseWriter, r *http.Request) {
+		<-hold
+		w.Write([]byte(`{"data":{}}`))
+	})
+	limiter := useConcurrencyLimit(t, 1)
+	if err := limiter.acquire(context.Background(), "203.0.113.1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer limiter.release()
+	close(hold)
+
+	resp, body := p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("status = %d, Retry-After = %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if msg := errorMessage(t, body); msg != "Server is busy, please retry later" {
+		t.Errorf("message = %q", msg)
+	}
+}
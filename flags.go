@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// cliFlags are the command-line options. Each one stands in for an
+// environment variable and, when given, takes precedence over it.
+var cliFlags = []struct {
+	name, env, usage string
+}{
+	{"listen", "LISTEN_ADDR", "address to listen on, e.g. :8080 or unix:/path/to.sock"},
+	{"admin-listen", "ADMIN_ADDR", "separate address for the admin, metrics and pprof endpoints"},
+	{"backend", "BACKEND_URL", "URL of the GraphQL backend"},
+	{"rate-limit", "RATE_LIMIT_PER_MINUTE", "requests allowed per client IP per minute"},
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error"},
+	{"log-sink", "LOG_SINK", "log sink: mongo, kafka or opensearch"},
+}
+
+var (
+	// envFile is the env file given by -config, reread on SIGHUP.
+	envFile = ".env"
+	// flagOverrides maps environment variables to the values given for them
+	// on the command line.
+	flagOverrides = make(map[string]string)
+)
+
+// parseFlags reads the command line into envFile and flagOverrides.
+func parseFlags(args []string) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&envFile, "config", ".env", "path to the env file to load")
+	values := make(map[string]*string)
+	for _, f := range cliFlags {
+		values[f.name] = fs.String(f.name, "", fmt.Sprintf("%s (overrides %s)", f.usage, f.env))
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\nFlags override the matching environment variables; everything else is configured through the environment.\n\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, cf := range cliFlags {
+			if cf.name == f.Name {
+				flagOverrides[cf.env] = *values[f.Name]
+			}
+		}
+	})
+}
+
+// applyFlagOverrides sets the flag values into the environment, after the env
+// file has been loaded so the flags win.
+func applyFlagOverrides() {
+	for key, value := range flagOverrides {
+		os.Setenv(key, value)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/godotenv"
+)
+
+func TestFlagsOverrideEnv(t *testing.T) {
+	prevFile, prevOverrides := envFile, flagOverrides
+	t.Cleanup(func() { envFile, flagOverrides = prevFile, prevOverrides })
+	flagOverrides = make(map[string]string)
+
+	for key, value := range map[string]string{"LISTEN_ADDR": ":1", "LOG_SINK": "kafka", "RATE_LIMIT_PER_MINUTE": "", "LOG_LEVEL": "", "BACKEND_URL": ""} {
+		t.Setenv(key, value)
+		if value == "" {
+			os.Unsetenv(key)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "local.env")
+	if err := os.WriteFile(path, []byte("RATE_LIMIT_PER_MINUTE=5\nLOG_LEVEL=debug\nLISTEN_ADDR=:2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// As main does: flags, then the env file, then the flag overrides.
+	parseFlags([]string{"-config", path, "-listen", ":9999", "-rate-limit", "7", "-backend", "http://backend:4000/graphql"})
+	if envFile != path {
+		t.Errorf("envFile = %q, want %q", envFile, path)
+	}
+	if err := godotenv.Load(envFile); err != nil {
+		t.Fatal(err)
+	}
+	applyFlagOverrides()
+	useConfig(t, nil)
+
+	if cfg.ListenAddr != ":9999" {
+		t.Errorf("ListenAddr = %q, want the flag over the environment", cfg.ListenAddr)
+	}
+	if cfg.RateLimitPerMinute != 7 {
+		t.Errorf("RateLimitPerMinute = %d, want the flag over the env file", cfg.RateLimitPerMinute)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("LogLevel = %q, want the env file's value without a flag", cfg.LogLevel)
+	}
+	if cfg.LogSink != "kafka" {
+		t.Errorf("LogSink = %q, want the environment's value without a flag", cfg.LogSink)
+	}
+	if got := os.Getenv("BACKEND_URL"); got != "http://backend:4000/graphql" {
+		t.Errorf("BACKEND_URL = %q", got)
+	}
+	if _, ok := flagOverrides["LOG_LEVEL"]; ok {
+		t.Error("an unset flag overrides its variable")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// introspectionFallback is used when a query fails to parse; a malformed
+// document must not be a way around the introspection block.
+var introspectionFallback = regexp.MustCompile(`\b__(schema|type)\b`)
+
+func parseQuery(query string) (*ast.QueryDocument, error) {
+	return parser.ParseQuery(&ast.Source{Input: query})
+}
+
+// walkFields calls fn for every field in the document's operations and
+// fragment definitions, descending into nested selection sets.
+func walkFields(doc *ast.QueryDocument, fn func(*ast.Field)) {
+	var walk func(ast.SelectionSet)
+	walk = func(set ast.SelectionSet) {
+		for _, sel := range set {
+			switch s := sel.(type) {
+			case *ast.Field:
+				fn(s)
+				walk(s.SelectionSet)
+			case *ast.InlineFragment:
+				walk(s.SelectionSet)
+			}
+		}
+	}
+	for _, op := range doc.Operations {
+		walk(op.SelectionSet)
+	}
+	for _, frag := range doc.Fragments {
+		walk(frag.SelectionSet)
+	}
+}
+
+func isIntrospectionQuery(query string) bool {
+	doc, err := parseQuery(query)
+	if err != nil {
+		return introspectionFallback.MatchString(query)
+	}
+	found := false
+	walkFields(doc, func(f *ast.Field) {
+		if f.Name == "__schema" || f.Name == "__type" {
+			found = true
+		}
+	})
+	return found
+}
+
+// operationName returns the explicit operationName from the payload, falling
+// back to the name of the first operation in the document.
+func operationName(payload map[string]interface{}, query string) string {
+	if name, ok := payload["operationName"].(string); ok && name != "" {
+		return name
+	}
+	doc, err := parseQuery(query)
+	if err != nil || len(doc.Operations) == 0 {
+		return ""
+	}
+	return doc.Operations[0].Name
+}
+
+// isAmbiguousOperation reports a document with several operations and no
+// operationName to choose between them, which the spec treats as an error.
+func isAmbiguousOperation(payload map[string]interface{}, query string) bool {
+	if name, ok := payload["operationName"].(string); ok && name != "" {
+		return false
+	}
+	doc, err := parseQuery(query)
+	return err == nil && len(doc.Operations) > 1
+}
+
+// operationType returns "query", "mutation" or "subscription" for the
+// operation that will execute, or "" if it cannot be determined.
+func operationType(query, opName string) string {
+	doc, err := parseQuery(query)
+	if err != nil {
+		return ""
+	}
+	if op := selectOperation(doc, opName); op != nil {
+		return string(op.Operation)
+	}
+	return ""
+}
+
+// selectOperation picks the operation named opName, or the only operation
+// when no name is given.
+func selectOperation(doc *ast.QueryDocument, opName string) *ast.OperationDefinition {
+	if opName == "" {
+		if len(doc.Operations) == 1 {
+			return doc.Operations[0]
+		}
+		return nil
+	}
+	return doc.Operations.ForName(opName)
+}
+
+// deniedDirective returns the first directive in query that appears in
+// denied, or "" if none does or the query does not parse.
+func deniedDirective(query string, denied []string) string {
+	if len(denied) == 0 {
+		return ""
+	}
+	doc, err := parseQuery(query)
+	if err != nil {
+		return ""
+	}
+
+	var found string
+	check := func(list ast.DirectiveList) {
+		for _, d := range list {
+			if found == "" && slices.Contains(denied, d.Name) {
+				found = d.Name
+			}
+		}
+	}
+	var walk func(ast.SelectionSet)
+	walk = func(set ast.SelectionSet) {
+		for _, sel := range set {
+			switch s := sel.(type) {
+			case *ast.Field:
+				check(s.Directives)
+				walk(s.SelectionSet)
+			case *ast.InlineFragment:
+				check(s.Directives)
+				walk(s.SelectionSet)
+			case *ast.FragmentSpread:
+				check(s.Directives)
+			}
+		}
+	}
+	for _, op := range doc.Operations {
+		check(op.Directives)
+		for _, v := range op.VariableDefinitions {
+			check(v.Directives)
+		}
+		walk(op.SelectionSet)
+	}
+	for _, frag := range doc.Fragments {
+		check(frag.Directives)
+		walk(frag.SelectionSet)
+	}
+	return found
+}
+
+// nameAnonymousOperation gives the only operation in query the given name,
+// returning false if the document has several operations or is already named.
+// The name goes into the query text too: servers reject an operationName that
+// doesn't match a named operation in the document.
+func nameAnonymousOperation(query, name string) (string, bool) {
+	doc, err := parseQuery(query)
+	if err != nil || len(doc.Operations) != 1 || doc.Operations[0].Name != "" {
+		return query, false
+	}
+	// Positions are rune offsets. For shorthand `{ ... }` the position is the
+	// opening brace; otherwise End is just past the operation keyword.
+	pos := doc.Operations[0].Position
+	runes := []rune(query)
+	if runes[pos.Start] == '{' {
+		return string(runes[:pos.Start]) + "query " + name + " " + string(runes[pos.Start:]), true
+	}
+	return string(runes[:pos.End]) + " " + name + string(runes[pos.End:]), true
+}
+
+// defaultOperationName expands DEFAULT_OPERATION_NAME for query; {hash} is
+// replaced by a short digest of the query so distinct anonymous queries stay
+// distinguishable downstream.
+func defaultOperationName(template, query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return strings.ReplaceAll(template, "{hash}", hex.EncodeToString(sum[:4]))
+}
+
+// usesIncrementalDelivery reports whether query uses @defer or @stream, whose
+// responses arrive as a multipart/mixed stream rather than one JSON body.
+func usesIncrementalDelivery(query string) bool {
+	return deniedDirective(query, []string{"defer", "stream"}) != ""
+}
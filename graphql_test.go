@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestIsIntrospectionQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"{ __schema { types { name } } }", true},
+		{`{ __type(name: "User") { name } }`, true},
+		{"{ s: __schema { queryType { name } } }", true},
+		{"query { ...F } fragment F on Query { __schema { types { name } } }", true},
+		{"{ ... on Query { __type(name: \"X\") { name } } }", true},
+		{"{ user { __typename name } }", false},
+		{"{ products { name } }", false},
+		// A document that doesn't parse falls back to a text match.
+		{"{ __schema { types { name }", true},
+		{"{ products { name }", false},
+	}
+	for _, tt := range tests {
+		if got := isIntrospectionQuery(tt.query); got != tt.want {
+			t.Errorf("isIntrospectionQuery(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestDeniedDirective(t *testing.T) {
+	denied := []string{"debug", "cached"}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"{ a @debug }", "debug"},
+		{"query Q @cached { a }", "cached"},
+		{"query Q($v: Int @debug) { a }", "debug"},
+		{"{ a { b { c @cached } } }", "cached"},
+		{"{ ... on Query @debug { a } }", "debug"},
+		{"{ ...F @debug }", "debug"},
+		{"{ ...F } fragment F on Query { a @cached }", "cached"},
+		{"{ a @skip(if: true) b @include(if: false) }", ""},
+		{"{ a }", ""},
+		// A document that doesn't parse is left to the backend.
+		{"{ a @debug", ""},
+	}
+	for _, tt := range tests {
+		if got := deniedDirective(tt.query, denied); got != tt.want {
+			t.Errorf("deniedDirective(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if got := deniedDirective("{ a @debug }", nil); got != "" {
+		t.Errorf("with no denylist = %q", got)
+	}
+}
+
+func TestNameAnonymousOperation(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		ok    bool
+	}{
+		{"{ a }", "query Anon { a }", true},
+		{"query { a }", "query Anon { a }", true},
+		{"mutation($id: ID) { buy(id: $id) }", "mutation Anon($id: ID) { buy(id: $id) }", true},
+		{`{ a(s: "é") }`, `query Anon { a(s: "é") }`, true},
+		{"query Named { a }", "query Named { a }", false},
+		{"query A { a } query B { b }", "query A { a } query B { b }", false},
+		{"{ a } { b }", "{ a } { b }", false},
+		{"{ a", "{ a", false},
+	}
+	for _, tt := range tests {
+		got, ok := nameAnonymousOperation(tt.query, "Anon")
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("nameAnonymousOperation(%q) = %q, %v; want %q, %v", tt.query, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDefaultOperationName(t *testing.T) {
+	a, b := defaultOperationName("Anonymous_{hash}", "{ a }"), defaultOperationName("Anonymous_{hash}", "{ b }")
+	if a == b || len(a) != len("Anonymous_")+8 {
+		t.Errorf("names = %q, %q; want distinct 8-digit hashes", a, b)
+	}
+	if got := defaultOperationName("Anonymous", "{ a }"); got != "Anonymous" {
+		t.Errorf("fixed name = %q", got)
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rejection is a stage's reason for refusing a request. reason is a stable
+// identifier for the audit log; msg is what the client sees. details, if set,
+// go into the error's extensions so a client can see what to change.
+type rejection struct {
+	status  int
+	reason  string
+	msg     string
+	details map[string]interface{}
+}
+
+func reject(status int, reason, msg string) *rejection {
+	return &rejection{status: status, reason: reason, msg: msg}
+}
+
+// rejectLimit refuses a request that measured over a limit, reporting both
+// values in the body unless REJECTION_DETAILS is off.
+func rejectLimit(status int, reason, msg string, measured, limit int, details map[string]interface{}) *rejection {
+	rej := reject(status, reason, msg)
+	if cfg.RejectionDetails {
+		rej.details = map[string]interface{}{"measured": measured, "limit": limit}
+		for k, v := range details {
+			rej.details[k] = v
+		}
+	}
+	return rej
+}
+
+// graphqlRequest holds the state built up as a request moves through the
+// handler stages.
+type graphqlRequest struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	rc      *RequestContext
+	isGet   bool
+	body    []byte
+	payload map[string]interface{}
+	newBody []byte
+	// admitted is set once a concurrency slot is held and must be released.
+	admitted bool
+	// bodyBuf and newBodyBuf back body and newBody; see releaseBuffers.
+	bodyBuf    *bytes.Buffer
+	newBodyBuf *sharedBuffer
+}
+
+func graphqlMiddleware(rt route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The path is checked first so unknown paths don't get CORS headers
+		// advertising methods for a resource that doesn't exist.
+		if r.URL.Path != rt.path {
+			notFoundHandler(w, r)
+			return
+		}
+
+		// With CORS_ENABLED=false CORS is left to something in front of the
+		// proxy, and OPTIONS is treated like any other method.
+		if cfg.CORSEnabled {
+			setCORSHeaders(w, r, rt)
+
+			if r.Method == http.MethodOptions {
+				writePreflight(w)
+				return
+			}
+		}
+
+		if !rt.allows(r.Method) {
+			w.Header().Set("Allow", rt.allowHeader())
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+			return
+		}
+
+		if maintenanceMode.Load() {
+			writeMaintenanceResponse(w)
+			return
+		}
+
+		rc := &RequestContext{
+			RequestID: requestIDFrom(r),
+			TraceID:   traceIDFrom(r),
+			ClientIP:  clientIPFromRequest(r, cfg.TrustedProxies),
+			Route:     rt.path,
+			UserAgent: truncateHeader(r.UserAgent()),
+			Referer:   truncateHeader(r.Referer()),
+			Start:     time.Now(),
+		}
+		r = withRequestContext(r, rc)
+		r.Header.Set(cfg.RequestIDHeader, rc.RequestID)
+		w.Header().Set(cfg.RequestIDHeader, rc.RequestID)
+
+		// GET and HEAD carry the request in URL parameters, e.g. for
+		// persisted queries, and have no body.
+		g := &graphqlRequest{
+			w:     w,
+			r:     r,
+			rc:    rc,
+			isGet: r.Method == http.MethodGet || r.Method == http.MethodHead,
+		}
+
+		// The stage order is deliberate: size and auth are checked before
+		// the client uses up rate-limit budget, and nothing is parsed for a
+		// request that would be refused anyway.
+		stages := []struct {
+			name string
+			run  func() *rejection
+		}{
+			{"shed", g.shedLoad},                    // log backlog
+			{"required_headers", g.requireHeaders},  // required headers
+			{"read_body", g.readBody},               // size
+			{"authenticate", g.authenticate},        // auth
+			{"rate_limit", g.rateLimit},             // rate limit
+			{"parse", g.parse},                      // parse
+			{"operation_rate_limit", g.opRateLimit}, // per-operation rate limit
+			{"validate", g.validate},                // query policy
+			{"admit", g.admit},                      // concurrency limit
+		}
+		defer g.releaseSlot()
+		defer g.releaseBuffers()
+		for _, stage := range stages {
+			start := time.Now()
+			rej := stage.run()
+			rc.recordStage(stage.name, time.Since(start))
+			if rej != nil {
+				rejectRequest(w, g.r, rej)
+				return
+			}
+		}
+		g.proxy(rt)
+	}
+}
+
+// shedLoad turns requests away while the log queue is above
+// LOG_QUEUE_SHED_THRESHOLD, for deployments that would rather refuse traffic
+// than serve it unlogged. By default entries are dropped and serving goes on.
+func (g *graphqlRequest) shedLoad() *rejection {
+	if cfg.LogQueueShedThreshold <= 0 || logQueueLen() < cfg.LogQueueShedThreshold {
+		return nil
+	}
+	g.w.Header().Set("Retry-After", "1")
+	return reject(http.StatusServiceUnavailable, "log_backlog", "Server is busy, please retry later")
+}
+
+// requireHeaders rejects a request missing any of REQUIRED_HEADERS, or
+// sending one empty.
+func (g *graphqlRequest) requireHeaders() *rejection {
+	for _, name := range cfg.RequiredHeaders {
+		if strings.TrimSpace(g.r.Header.Get(name)) == "" {
+			return reject(http.StatusBadRequest, "missing_header", "Missing required header "+http.CanonicalHeaderKey(name))
+		}
+	}
+	return nil
+}
+
+// readBody reads the body up to MAX_BODY_BYTES. BODY_READ_TIMEOUT bounds the
+// whole read, so a client trickling its body in a byte at a time is cut off
+// with a 408 instead of holding the handler indefinitely.
+func (g *graphqlRequest) readBody() *rejection {
+	if g.r.Body == nil || g.isGet {
+		return nil
+	}
+	if cfg.BodyReadTimeout > 0 {
+		rc := http.NewResponseController(g.w)
+		if err := rc.SetReadDeadline(time.Now().Add(cfg.BodyReadTimeout)); err == nil {
+			defer rc.SetReadDeadline(time.Time{})
+		}
+	}
+	g.bodyBuf = getBodyBuffer()
+	_, err := g.bodyBuf.ReadFrom(http.MaxBytesReader(g.w, g.r.Body, cfg.MaxBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return reject(http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		g.w.Header().Set("Connection", "close")
+		return reject(http.StatusRequestTimeout, "body_timeout", "Timed out reading the request body")
+	}
+	if err != nil {
+		return reject(http.StatusBadRequest, "bad_request", "Error reading request body")
+	}
+	g.body = g.bodyBuf.Bytes()
+	return nil
+}
+
+// releaseBuffers returns the body buffers once the handler is done. The
+// client's body is only read by the stages, so its buffer is free at once;
+// the rewritten body is shared with the upstream request and is freed when
+// that is done with it too.
+func (g *graphqlRequest) releaseBuffers() {
+	if g.bodyBuf != nil {
+		putBodyBuffer(g.bodyBuf)
+	}
+	if g.newBodyBuf != nil {
+		g.newBodyBuf.release()
+	}
+}
+
+// authenticate verifies the HMAC signature. Signatures cover the body exactly
+// as the client sent it, so this must run before any sanitizing or
+// re-marshalling. A GET has no body and carries its query, variables and
+// extensions in the URL, so there the signature covers the raw query string.
+func (g *graphqlRequest) authenticate() *rejection {
+	if cfg.HMACSecret == "" {
+		return nil
+	}
+	signature := g.r.Header.Get(signatureHeader)
+	if signature == "" && cfg.HMACRequired {
+		return reject(http.StatusUnauthorized, "auth", "Missing signature")
+	}
+	signed := g.body
+	if g.isGet {
+		signed = []byte(g.r.URL.RawQuery)
+	}
+	if signature != "" && !verifySignature(signed, signature, []byte(cfg.HMACSecret)) {
+		return reject(http.StatusUnauthorized, "auth", "Invalid signature")
+	}
+	return nil
+}
+
+func (g *graphqlRequest) rateLimit() *rejection {
+	g.rc.LoadTest = isLoadTestRequest(g.r)
+	g.r.Header.Del(loadTestHeader)
+	if g.rc.LoadTest || rateLimitExempt(g.r.URL.Path) {
+		return nil
+	}
+
+	limit := checkRateLimit(g.rc.ClientIP)
+	if cfg.RateLimitHeaders {
+		setRateLimitHeaders(g.w, limit)
+	}
+	if limit.quotaExceeded {
+		retryAfter := int(math.Ceil(time.Until(limit.reset).Seconds()))
+		g.w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return reject(http.StatusTooManyRequests, "daily_quota", "Daily quota exceeded")
+	}
+	if limit.penalized {
+		retryAfter := int(math.Ceil(time.Until(limit.reset).Seconds()))
+		g.w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	if limit.limited {
+		return reject(http.StatusTooManyRequests, "rate_limit", "Rate limit exceeded")
+	}
+	return nil
+}
+
+// opRateLimit applies OPERATION_RATE_LIMITS, which needs the operation name
+// and so runs after parse. Load-test traffic is exempt as with the global
+// limit.
+func (g *graphqlRequest) opRateLimit() *rejection {
+	limit, ok := cfg.OperationRateLimits[g.rc.OperationName]
+	if !ok || g.rc.LoadTest || rateLimitExempt(g.r.URL.Path) {
+		return nil
+	}
+	if checkOperationRateLimit(g.rc.ClientIP, g.rc.OperationName, limit).limited {
+		return reject(http.StatusTooManyRequests, "operation_rate_limit", "Rate limit exceeded for operation "+g.rc.OperationName)
+	}
+	return nil
+}
+
+// parse decodes the payload into the JSON shape the backend expects,
+// sanitizes the query and identifies the operation.
+func (g *graphqlRequest) parse() *rejection {
+	r, rc := g.r, g.rc
+
+	switch {
+	case g.isGet:
+		params := r.URL.Query()
+		payload, err := rawGraphQLPayload([]byte(params.Get("query")), params)
+		if err != nil {
+			return reject(http.StatusBadRequest, "depth", err.Error())
+		}
+		g.payload = payload
+		// The backend only accepts POSTed JSON.
+		r.Method = http.MethodPost
+		r.Header.Set("Content-Type", "application/json")
+	default:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/graphql":
+			// Raw query body; the backend only understands the JSON shape.
+			payload, err := rawGraphQLPayload(g.body, r.URL.Query())
+			if err != nil {
+				return reject(http.StatusBadRequest, "depth", err.Error())
+			}
+			g.payload = payload
+			r.Header.Set("Content-Type", "application/json")
+		case "application/json":
+			if cfg.MaxJSONDepth > 0 {
+				if err := checkJSONDepth(g.body, cfg.MaxJSONDepth); err != nil {
+					return reject(http.StatusBadRequest, "depth", err.Error())
+				}
+			}
+			if err := json.Unmarshal(g.body, &g.payload); err != nil {
+				return reject(http.StatusBadRequest, "bad_request", "Invalid JSON body")
+			}
+		default:
+			return reject(http.StatusUnsupportedMediaType, "media_type", "Unsupported Media Type")
+		}
+	}
+
+	if query, ok := g.payload["query"].(string); ok {
+		rc.OriginalQuery = query
+		var changes int
+		rc.SanitizedQuery, changes = sanitizeGraphQLQuery(query)
+		g.payload["query"] = rc.SanitizedQuery
+		if cfg.SanitizeHeader && rc.SanitizedQuery != query {
+			g.w.Header().Set("X-Query-Sanitized", "true")
+			g.w.Header().Set("X-Query-Sanitized-Changes", strconv.Itoa(changes))
+		}
+	}
+	// A persisted query may be sent as just its hash in extensions, which the
+	// backend resolves; anything else needs query text.
+	if strings.TrimSpace(rc.SanitizedQuery) == "" && !hasPersistedQuery(g.payload) {
+		if _, ok := g.payload["query"]; !ok {
+			return reject(http.StatusBadRequest, "bad_request", "Request has no query")
+		}
+		return reject(http.StatusBadRequest, "bad_request", "Query must not be empty")
+	}
+	rc.Variables, _ = g.payload["variables"].(map[string]interface{})
+	if err := checkVariableLimits(rc.Variables); err != nil {
+		return reject(http.StatusBadRequest, "variables", err.Error())
+	}
+	if cfg.StrictOperationName && isAmbiguousOperation(g.payload, rc.SanitizedQuery) {
+		return reject(http.StatusBadRequest, "bad_request", "operationName is required when the document contains multiple operations")
+	}
+	rc.OperationName = operationName(g.payload, rc.SanitizedQuery)
+	if rc.OperationName == "" && cfg.DefaultOperationName != "" {
+		name := defaultOperationName(cfg.DefaultOperationName, rc.SanitizedQuery)
+		if query, ok := nameAnonymousOperation(rc.SanitizedQuery, name); ok {
+			rc.SanitizedQuery = query
+			rc.OperationName = name
+			g.payload["query"] = query
+			g.payload["operationName"] = name
+		}
+	}
+	rc.OperationType = operationType(rc.SanitizedQuery, rc.OperationName)
+	if g.isGet && rc.OperationType == "mutation" {
+		g.w.Header().Set("Allow", http.MethodPost)
+		return reject(http.StatusMethodNotAllowed, "method", "Mutations are not allowed over GET")
+	}
+
+	buf := getBodyBuffer()
+	json.NewEncoder(buf).Encode(g.payload)
+	g.newBodyBuf = newSharedBuffer(buf)
+	g.newBody = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	r.Body = g.newBodyBuf.reader(g.newBody)
+	r.ContentLength = int64(len(g.newBody))
+	return nil
+}
+
+// validate applies the query-level policies.
+func (g *graphqlRequest) validate() *rejection {
+	rc := g.rc
+	// An operationName that matches no operation in the document resolves to
+	// no operation type, so it cannot smuggle another operation past the
+	// allowlist.
+	if len(cfg.AllowedOperations) > 0 {
+		if rc.OperationName == "" {
+			return reject(http.StatusForbidden, "operation", "Anonymous operations are not allowed")
+		}
+		if rc.OperationType == "" || !slices.Contains(cfg.AllowedOperations, rc.OperationName) {
+			return reject(http.StatusForbidden, "operation", "Operation "+rc.OperationName+" is not allowed")
+		}
+	}
+	if cfg.DisableIntrospection && isIntrospectionQuery(rc.SanitizedQuery) &&
+		!ipInNets(rc.ClientIP, cfg.IntrospectionAllowedCIDRs) {
+		return reject(http.StatusForbidden, "introspection", "Introspection is disabled")
+	}
+	if cfg.ReadOnly && (rc.OperationType == "mutation" || rc.OperationType == "subscription") {
+		return reject(http.StatusForbidden, "read_only", "The API is read-only; "+rc.OperationType+"s are not allowed")
+	}
+	if cfg.SchemaValidation {
+		if problems := validateAgainstSchema(rc.SanitizedQuery); problems != "" {
+			return reject(http.StatusBadRequest, "schema", "Query does not match the schema: "+problems)
+		}
+	}
+	if problems := checkVariableSchema(rc.OperationName, rc.Variables); problems != "" {
+		return reject(http.StatusBadRequest, "variables", "Variables do not match the schema for "+rc.OperationName+": "+problems)
+	}
+	if cfg.MaxQueryDepth > 0 {
+		if depth, path, ok := queryDepth(rc.SanitizedQuery, rc.OperationName); ok && depth > cfg.MaxQueryDepth {
+			msg := fmt.Sprintf("Query depth %d exceeds the maximum of %d at %s", depth, cfg.MaxQueryDepth, strings.Join(path, "."))
+			return rejectLimit(http.StatusBadRequest, "depth", msg, depth, cfg.MaxQueryDepth, map[string]interface{}{"path": path})
+		}
+	}
+	if cfg.MaxQueryCost > 0 || cfg.QueryCostHeader || cfg.MaxConditionalSelections > 0 {
+		if result, ok := queryCost(rc.SanitizedQuery, rc.OperationName, rc.Variables); ok {
+			cost := result.cost
+			if cfg.QueryCostHeader {
+				g.w.Header().Set("X-Query-Cost", strconv.Itoa(cost))
+				if cfg.MaxQueryCost > 0 {
+					g.w.Header().Set("X-Query-Cost-Remaining", strconv.Itoa(max(cfg.MaxQueryCost-cost, 0)))
+				}
+			}
+			if cfg.MaxQueryCost > 0 && cost > cfg.MaxQueryCost {
+				return rejectLimit(http.StatusBadRequest, "cost", fmt.Sprintf("Query cost %d exceeds the maximum of %d", cost, cfg.MaxQueryCost), cost, cfg.MaxQueryCost, nil)
+			}
+			if limit := cfg.MaxConditionalSelections; limit > 0 && result.conditional > limit {
+				msg := fmt.Sprintf("Query has %d selections under @skip or @include, more than the maximum of %d", result.conditional, limit)
+				return rejectLimit(http.StatusBadRequest, "cost", msg, result.conditional, limit, nil)
+			}
+		}
+	}
+	if name := deniedDirective(rc.SanitizedQuery, cfg.DeniedDirectives); name != "" {
+		return reject(http.StatusForbidden, "directive", "Directive @"+name+" is not allowed")
+	}
+	return nil
+}
+
+// admit waits for a MAX_CONCURRENT_REQUESTS slot. It runs last so that only
+// requests that will actually be proxied wait in the queue.
+func (g *graphqlRequest) admit() *rejection {
+	if concurrencyLimiter == nil {
+		return nil
+	}
+	if err := concurrencyLimiter.acquire(g.r.Context(), g.rc.ClientIP, cfg.QueueTimeout); err != nil {
+		g.w.Header().Set("Retry-After", "1")
+		return reject(http.StatusServiceUnavailable, "overloaded", "Server is busy, please retry later")
+	}
+	g.admitted = true
+	return nil
+}
+
+func (g *graphqlRequest) releaseSlot() {
+	if g.admitted {
+		concurrencyLimiter.release()
+	}
+}
+
+func (g *graphqlRequest) proxy(rt route) {
+	rc := g.rc
+	setForwardedHeaders(g.r, rc.ClientIP)
+	backends := activeBackends.Load()
+	backend := backends.forOperation(rc.OperationType)
+	// Canary requests are not coalesced, so a canary response is never shared
+	// with a request meant for the stable backend.
+	canary := backend == backends.primary && backends.useCanary(rc.ClientIP)
+	if canary {
+		backend = backends.canary
+	}
+	canaryRequestsTotal.WithLabelValues(strconv.FormatBool(canary)).Inc()
+
+	r, cancel := withRouteTimeout(g.r, rt)
+	defer cancel()
+
+	w := g.w
+	if cfg.CORSEnabled && !cfg.CORSStripBackendHeaders {
+		w = backendCORSWriter{w}
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	var out http.ResponseWriter = rec
+	// Incremental responses are streamed straight through: coalescing would
+	// hold every part until the stream ends, and shadow diffs only compare
+	// single JSON bodies.
+	streamed := usesIncrementalDelivery(rc.SanitizedQuery)
+	var tee *teeWriter
+	if backends.shadow != nil && rc.OperationType == "query" && !streamed {
+		tee = &teeWriter{ResponseWriter: rec, limit: shadowMaxBodyBytes}
+		out = tee
+	}
+	start := time.Now()
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" && cfg.IdempotencyTTL > 0 && !streamed {
+		serveIdempotent(out, r, rc.ClientIP, key, g.newBody, backend)
+	} else if cfg.CoalesceQueries && rc.OperationType == "query" && !streamed && !canary {
+		key := coalesceKey(r, rc.SanitizedQuery, rc.OperationName, g.payload["variables"])
+		serveCoalesced(out, r, key, backend)
+	} else {
+		backend.ServeHTTP(out, r)
+	}
+	elapsed := time.Since(start)
+	rc.recordStage("proxy", elapsed)
+	observeOperation(rc.OperationName, elapsed)
+	if tee != nil {
+		// The shadow request outlives this handler, so it gets its own copy
+		// of the body rather than the pooled buffer.
+		go mirrorToShadow(backends.shadow, r, bytes.Clone(g.newBody), rec.status, tee)
+	}
+
+	slow := cfg.SlowQueryThreshold > 0 && elapsed > cfg.SlowQueryThreshold
+	if slow {
+		slowQueriesTotal.Inc()
+		slog.WarnContext(r.Context(), "Slow query", "operation", rc.OperationName, "duration", elapsed)
+	}
+
+	if cfg.LogMutationsOnly && rc.OperationType != "mutation" {
+		return
+	}
+	entry := rc.logEntry()
+	entry.Status = rec.status
+	entry.DurationMs = elapsed.Milliseconds()
+	if !shouldLogQueryText(rec.status, slow) {
+		entry.OriginalQuery = ""
+		entry.SanitizedQuery = ""
+		entry.Variables = nil
+	}
+	writeLog(entry)
+}
+
+// notFoundHandler answers paths that aren't GraphQL routes with the standard
+// error envelope and no CORS headers.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeNegotiatedError(w, r, http.StatusNotFound, "Not Found", nil)
+}
+
+// rejectRequest answers with the rejection's status, logs it and records it in
+// the audit log. Rejections are always logged, including under
+// LOG_MUTATIONS_ONLY.
+func rejectRequest(w http.ResponseWriter, r *http.Request, rej *rejection) {
+	writeNegotiatedError(w, r, rej.status, rej.msg, rej.details)
+	rc := requestContextFrom(r.Context())
+	entry := rc.logEntry()
+	entry.Status = rej.status
+	entry.Rejection = rej.msg
+	writeLog(entry)
+	auditRejection(rc, rej)
+}
+
+// shouldLogQueryText decides whether an entry keeps the full query text.
+// Rejected and slow requests always do; otherwise it is sampled.
+func shouldLogQueryText(status int, slow bool) bool {
+	if status >= http.StatusBadRequest || slow {
+		return true
+	}
+	return rand.Float64() < cfg.QuerySampleRate
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentTypeEnforcement(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	tests := []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		resp, body := send(t, http.MethodPost, p.URL+"/public", `{"query":"{ a }"}`, map[string]string{"Content-Type": tt.contentType})
+		if resp.StatusCode != tt.want {
+			t.Errorf("Content-Type %q: status = %d, want %d", tt.contentType, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnsupportedMediaType && errorMessage(t, body) != "Unsupported Media Type" {
+			t.Errorf("Content-Type %q: body = %s", tt.contentType, body)
+		}
+	}
+	if n := len(p.backend.received()); n != 2 {
+		t.Errorf("backend received %d requests, want 2", n)
+	}
+}
+
+func TestApplicationGraphQLBody(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	resp, _ := send(t, http.MethodPost, p.URL+"/public?operationName=Q&variables=%7B%22id%22%3A7%7D",
+		"query Q($id: Int) { a(id: $id) }", map[string]string{"Content-Type": "application/graphql"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	got := p.backend.last(t)
+	if ct := got.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("forwarded Content-Type = %q", ct)
+	}
+	want := `{"operationName":"Q","query":"query Q($id: Int) { a(id: $id) }","variables":{"id":7}}`
+	if got.Body != want {
+		t.Errorf("forwarded body = %s, want %s", got.Body, want)
+	}
+	if entry := p.lastLog(t); entry.OperationName != "Q" {
+		t.Errorf("logged operation = %q", entry.OperationName)
+	}
+}
+
+func TestDisableIntrospection(t *testing.T) {
+	body := `{"query":"{ __schema { types { name } } }"}`
+	tests := []struct {
+		name  string
+		env   map[string]string
+		query string
+		want  int
+	}{
+		{"enabled by default", nil, body, http.StatusOK},
+		{"blocked", map[string]string{"DISABLE_INTROSPECTION": "true"}, body, http.StatusForbidden},
+		{"ordinary queries pass", map[string]string{"DISABLE_INTROSPECTION": "true"}, `{"query":"{ a { __typename } }"}`, http.StatusOK},
+		{"trusted CIDR bypasses", map[string]string{"DISABLE_INTROSPECTION": "true", "INTROSPECTION_ALLOWED_CIDRS": "127.0.0.0/8"}, body, http.StatusOK},
+		{"other CIDR does not", map[string]string{"DISABLE_INTROSPECTION": "true", "INTROSPECTION_ALLOWED_CIDRS": "10.0.0.0/8"}, body, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, tt.env, nil)
+			resp, respBody := p.post(t, "/public", tt.query, nil)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusForbidden && errorMessage(t, respBody) != "Introspection is disabled" {
+				t.Errorf("body = %s", respBody)
+			}
+		})
+	}
+}
+
+func TestQueryTextSampling(t *testing.T) {
+	query := `{"query":"query Q($id: ID) { a(id: $id) }","variables":{"id":"1"}}`
+
+	t.Run("metadata only when not sampled", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"LOG_QUERY_SAMPLE_RATE": "0"}, nil)
+		p.post(t, "/public", query, nil)
+		entry := p.lastLog(t)
+		if entry.OriginalQuery != "" || entry.SanitizedQuery != "" || entry.Variables != nil {
+			t.Errorf("unsampled entry kept query text: %+v", entry)
+		}
+		if entry.OperationName != "Q" || entry.Status != http.StatusOK || entry.IP == "" || entry.RequestID == "" {
+			t.Errorf("unsampled entry lost metadata: %+v", entry)
+		}
+	})
+
+	t.Run("rejections always keep the query", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"LOG_QUERY_SAMPLE_RATE": "0", "READ_ONLY": "true"}, nil)
+		p.post(t, "/public", `{"query":"mutation M { a }"}`, nil)
+		if entry := p.lastLog(t); entry.OriginalQuery != "mutation M { a }" || entry.Status != http.StatusForbidden {
+			t.Errorf("rejected entry = %+v", entry)
+		}
+	})
+
+	t.Run("full text when sampled", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"LOG_QUERY_SAMPLE_RATE": "1"}, nil)
+		p.post(t, "/public", query, nil)
+		entry := p.lastLog(t)
+		if entry.OriginalQuery == "" || entry.SanitizedQuery == "" || entry.Variables["id"] != "1" {
+			t.Errorf("sampled entry = %+v", entry)
+		}
+	})
+}
+
+func TestShouldLogQueryText(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_QUERY_SAMPLE_RATE": "0"})
+	if shouldLogQueryText(http.StatusOK, false) {
+		t.Error("sampled an OK request at rate 0")
+	}
+	if !shouldLogQueryText(http.StatusBadRequest, false) || !shouldLogQueryText(http.StatusOK, true) {
+		t.Error("errors and slow requests must always keep their text")
+	}
+
+	useConfig(t, map[string]string{"LOG_QUERY_SAMPLE_RATE": "0.5"})
+	kept := 0
+	for i := 0; i < 2000; i++ {
+		if shouldLogQueryText(http.StatusOK, false) {
+			kept++
+		}
+	}
+	if kept < 800 || kept > 1200 {
+		t.Errorf("kept %d of 2000 at rate 0.5", kept)
+	}
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"MAX_JSON_DEPTH": "4"}, nil)
+	ok := `{"query":"{ a }","variables":{"in":{"x":[1]}}}`
+	deep := `{"query":"{ a }","variables":{"in":{"x":[[1]]}}}`
+	if resp, _ := p.post(t, "/public", ok, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("payload within the limit: status = %d", resp.StatusCode)
+	}
+	resp, body := p.post(t, "/public", deep, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("deep payload: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if msg := errorMessage(t, body); msg != "JSON nesting too deep: exceeds 4 levels" {
+		t.Errorf("message = %q", msg)
+	}
+	if n := len(p.backend.received()); n != 1 {
+		t.Errorf("backend received %d requests, want 1", n)
+	}
+}
+
+func TestMaxJSONDepthInURLParameters(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"MAX_JSON_DEPTH": "4", "ROUTE_METHODS": "/public=POST|GET"}, nil)
+	deep := url.QueryEscape(`{"in":{"x":[[[1]]]}}`)
+	for name, request := range map[string]func() (*http.Response, string){
+		"GET": func() (*http.Response, string) {
+			return send(t, http.MethodGet, p.URL+"/public?query="+url.QueryEscape("{ a }")+"&variables="+deep, "", nil)
+		},
+		"application/graphql": func() (*http.Response, string) {
+			return send(t, http.MethodPost, p.URL+"/public?variables="+deep, "{ a }", map[string]string{"Content-Type": "application/graphql"})
+		},
+	} {
+		resp, body := request()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", name, resp.StatusCode, http.StatusBadRequest)
+			continue
+		}
+		if msg := errorMessage(t, body); msg != "JSON nesting too deep: exceeds 4 levels" {
+			t.Errorf("%s: message = %q", name, msg)
+		}
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Errorf("backend received %d requests, want 0", n)
+	}
+}
+
+func TestLogMutationsOnly(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"LOG_MUTATIONS_ONLY": "true"}, nil)
+
+	p.post(t, "/public", `{"query":"query Read { a }"}`, nil)
+	if n := len(p.logs.recent()); n != 0 {
+		t.Fatalf("query was logged: %d entries", n)
+	}
+
+	p.post(t, "/public", `{"query":"mutation Buy { buy }"}`, nil)
+	if entry := p.lastLog(t); entry.OperationName != "Buy" {
+		t.Errorf("logged operation = %q, want the mutation", entry.OperationName)
+	}
+
+	resp, _ := p.post(t, "/public", `{}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if entry := p.lastLog(t); entry.Rejection == "" || entry.Status != http.StatusBadRequest {
+		t.Errorf("rejection not logged: %+v", entry)
+	}
+	if n := len(p.logs.recent()); n != 2 {
+		t.Errorf("entries = %d, want the mutation and the rejection", n)
+	}
+}
+
+func TestRouteMethods(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"ROUTE_METHODS": "/public=POST|GET"}, nil)
+
+	resp, _ := send(t, http.MethodGet, p.URL+"/public?query="+url.QueryEscape("{ items }"), "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	got := p.backend.last(t)
+	if got.Method != http.MethodPost || !strings.Contains(got.Body, `"query":"{ items }"`) {
+		t.Errorf("backend received %s %s", got.Method, got.Body)
+	}
+
+	resp, _ = send(t, http.MethodDelete, p.URL+"/public", "", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	if allow := resp.Header.Get("Allow"); allow != "POST, GET, OPTIONS" {
+		t.Errorf("Allow = %q", allow)
+	}
+
+	resp, _ = send(t, http.MethodGet, p.URL+"/public?query="+url.QueryEscape("mutation { buy }"), "", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET mutation status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDefaultRouteMethods(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	resp, _ := send(t, http.MethodGet, p.URL+"/public?query="+url.QueryEscape("{ items }"), "", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	if allow := resp.Header.Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("Allow = %q", allow)
+	}
+}
+
+func TestGetPersistedQuery(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"ROUTE_METHODS": "/public=POST|GET"}, nil)
+	extensions := `{"persistedQuery":{"version":1,"sha256Hash":"abc123"}}`
+	resp, body := send(t, http.MethodGet, p.URL+"/public?operationName=Items&extensions="+url.QueryEscape(extensions), "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	var forwarded map[string]interface{}
+	if err := json.Unmarshal([]byte(p.backend.last(t).Body), &forwarded); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPersistedQuery(forwarded) || forwarded["operationName"] != "Items" {
+		t.Errorf("forwarded payload = %v, want the persisted query hash", forwarded)
+	}
+}
+
+func TestDeniedDirectives(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"DENIED_DIRECTIVES": "debug"}, nil)
+	resp, body := p.post(t, "/public", `{"query":"{ a @debug }"}`, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("denied directive status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if msg := errorMessage(t, body); msg != "Directive @debug is not allowed" {
+		t.Errorf("message = %q", msg)
+	}
+	if resp, _ := p.post(t, "/public", `{"query":"{ a @include(if: true) }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("allowed directive status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if n := len(p.backend.received()); n != 1 {
+		t.Errorf("backend received %d requests, want only the allowed one", n)
+	}
+}
+
+func TestVariableLimits(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"MAX_VARIABLES": "2", "MAX_VARIABLE_KEY_LENGTH": "8"}, nil)
+	tests := []struct {
+		name      string
+		variables string
+		want      int
+	}{
+		{"within limits", `{"a":1,"b":2}`, http.StatusOK},
+		{"too many keys", `{"a":1,"b":2,"c":3}`, http.StatusBadRequest},
+		{"long key", `{"` + strings.Repeat("k", 9) + `":1}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := p.post(t, "/public", `{"query":"{ a }","variables":`+tt.variables+`}`, nil)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestStageFailuresUseErrorEnvelope(t *testing.T) {
+	dead := newStubBackend(t, nil)
+	dead.Close()
+	tests := []struct {
+		name    string
+		env     map[string]string
+		body    string
+		header  map[string]string
+		status  int
+		message string
+	}{
+		{"size", map[string]string{"MAX_BODY_BYTES": "16"}, `{"query":"{ aVeryLongFieldName }"}`, nil, http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"auth", map[string]string{"HMAC_SECRET": "s"}, `{"query":"{ a }"}`, nil, http.StatusUnauthorized, "Missing signature"},
+		{"rate limit", map[string]string{"RATE_LIMIT_PER_MINUTE": "1"}, `{"query":"{ a }"}`, nil, http.StatusTooManyRequests, ""},
+		{"malformed JSON", nil, `{"query":`, nil, http.StatusBadRequest, "Invalid JSON body"},
+		{"JSON that is not an object", nil, `["{ a }"]`, nil, http.StatusBadRequest, "Invalid JSON body"},
+		{"missing query", nil, `{}`, nil, http.StatusBadRequest, "Request has no query"},
+		{"dead backend", map[string]string{"BACKEND_URL": dead.URL}, `{"query":"{ a }"}`, nil, http.StatusBadGateway, "Backend unavailable"},
+		// Earlier stages win: size before auth, auth before rate limit,
+		// rate limit before parse.
+		{"size before auth", map[string]string{"MAX_BODY_BYTES": "16", "HMAC_SECRET": "s"}, `{"query":"{ aVeryLongFieldName }"}`, nil, http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"auth before rate limit", map[string]string{"HMAC_SECRET": "s", "RATE_LIMIT_PER_MINUTE": "1"}, `{"query":"{ a }"}`, nil, http.StatusUnauthorized, "Missing signature"},
+		{"rate limit before parse", map[string]string{"RATE_LIMIT_PER_MINUTE": "1"}, `{"query":`, nil, http.StatusTooManyRequests, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, tt.env, nil)
+			if tt.env["RATE_LIMIT_PER_MINUTE"] == "1" {
+				// Use up the budget.
+				checkRateLimit("127.0.0.1")
+			}
+			resp, body := p.post(t, "/public", tt.body, tt.header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			msg := errorMessage(t, body)
+			if tt.message != "" && msg != tt.message {
+				t.Errorf("message = %q, want %q", msg, tt.message)
+			}
+		})
+	}
+}
+
+func TestDefaultOperationNameInjection(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"DEFAULT_OPERATION_NAME": "Anonymous"}, nil)
+	tests := []struct {
+		body      string
+		wantName  interface{}
+		wantQuery string
+	}{
+		{`{"query":"{ a }"}`, "Anonymous", "query Anonymous { a }"},
+		{`{"query":"query Named { a }"}`, nil, "query Named { a }"},
+		{`{"query":"query A { a } query B { b }","operationName":"A"}`, "A", "query A { a } query B { b }"},
+	}
+	for _, tt := range tests {
+		p.post(t, "/public", tt.body, nil)
+		var forwarded map[string]interface{}
+		if err := json.Unmarshal([]byte(p.backend.last(t).Body), &forwarded); err != nil {
+			t.Fatal(err)
+		}
+		if forwarded["operationName"] != tt.wantName || forwarded["query"] != tt.wantQuery {
+			t.Errorf("%s forwarded as %v", tt.body, forwarded)
+		}
+	}
+	if name := p.lastLog(t).OperationName; name != "A" {
+		t.Errorf("logged operation = %q", name)
+	}
+}
+
+func TestUnknownPathNotFound(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+		path   string
+	}{
+		{"unrouted path", "/public", "/private"},
+		{"subpath of a route", "/public", "/public/extra"},
+		{"root route with another path", "/", "/other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, map[string]string{"GRAPHQL_ROUTES": tt.routes}, nil)
+			resp, body := p.post(t, tt.path, `{"query":"{ a }"}`, map[string]string{"Origin": "http://localhost:3000"})
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+			}
+			var env errorEnvelope
+			if err := json.Unmarshal([]byte(body), &env); err != nil {
+				t.Fatalf("body %q: %v", body, err)
+			}
+			if len(env.Errors) != 1 || env.Errors[0].Message != "Not Found" || env.Errors[0].Extensions["code"] != "NOT_FOUND" {
+				t.Errorf("envelope = %+v", env)
+			}
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					t.Errorf("unknown path got CORS header %s", name)
+				}
+			}
+			if n := len(p.backend.received()); n != 0 {
+				t.Errorf("backend received %d requests", n)
+			}
+		})
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"READ_ONLY": "true"}, nil)
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"query":"mutation { buy }"}`, http.StatusForbidden},
+		{`{"query":"subscription { updates }"}`, http.StatusForbidden},
+		{`{"query":"query { items }"}`, http.StatusOK},
+		{`{"query":"{ items }"}`, http.StatusOK},
+		{`{"query":"query A { a } mutation B { b }","operationName":"A"}`, http.StatusOK},
+		{`{"query":"query A { a } mutation B { b }","operationName":"B"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		resp, body := p.post(t, "/public", tt.body, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.body, resp.StatusCode, tt.want, body)
+		}
+	}
+
+	_, body := p.post(t, "/public", `{"query":"mutation { buy }"}`, nil)
+	if msg := errorMessage(t, body); msg != "The API is read-only; mutations are not allowed" {
+		t.Errorf("message = %q", msg)
+	}
+}
+
+func TestAllowedOperations(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"ALLOWED_OPERATIONS": "GetItems,Buy"}, nil)
+	tests := []struct {
+		name, body string
+		want       int
+		message    string
+	}{
+		{"allowed query", `{"query":"query GetItems { items }"}`, http.StatusOK, ""},
+		{"allowed mutation", `{"query":"mutation Buy { buy }","operationName":"Buy"}`, http.StatusOK, ""},
+		{"allowed operation picked from several", `{"query":"query Other { a } query GetItems { items }","operationName":"GetItems"}`, http.StatusOK, ""},
+		{"unknown operation", `{"query":"query DropAll { a }"}`, http.StatusForbidden, "Operation DropAll is not allowed"},
+		{"other operation picked from several", `{"query":"query GetItems { items } query Other { a }","operationName":"Other"}`, http.StatusForbidden, "Operation Other is not allowed"},
+		{"allowed name matching no operation", `{"query":"query Other { a }","operationName":"GetItems"}`, http.StatusForbidden, "Operation GetItems is not allowed"},
+		{"anonymous operation", `{"query":"{ items }"}`, http.StatusForbidden, "Anonymous operations are not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := p.post(t, "/public", tt.body, nil)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.want, body)
+			}
+			if tt.message != "" {
+				if msg := errorMessage(t, body); msg != tt.message {
+					t.Errorf("message = %q, want %q", msg, tt.message)
+				}
+			}
+		})
+	}
+	if n := len(p.backend.received()); n != 3 {
+		t.Errorf("backend received %d requests, want only the 3 allowed ones", n)
+	}
+
+	p = newTestProxy(t, map[string]string{"ALLOWED_OPERATIONS": ""}, nil)
+	if resp, _ := p.post(t, "/public", `{"query":"{ items }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("anonymous operation without an allowlist: status = %d", resp.StatusCode)
+	}
+}
+
+func TestVariableArrayLimits(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"MAX_VARIABLE_ARRAY_LENGTH": "100"}, nil)
+	ids := func(n int) string {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = strconv.Itoa(i)
+		}
+		return `{"query":"query Q($ids: [ID!]) { items(ids: $ids) }","variables":{"ids":[` + strings.Join(items, ",") + `]}}`
+	}
+	if resp, body := p.post(t, "/public", ids(100), nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("100 ids: status = %d: %s", resp.StatusCode, body)
+	}
+	resp, body := p.post(t, "/public", ids(100000), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("100000 ids: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if msg := errorMessage(t, body); !strings.Contains(msg, `array in variable "ids" too long`) {
+		t.Errorf("message = %q", msg)
+	}
+	if n := len(p.backend.received()); n != 1 {
+		t.Errorf("backend received %d requests, want 1", n)
+	}
+}
+
+func TestAmbiguousOperation(t *testing.T) {
+	ambiguous := `{"query":"query A { a } query B { b }"}`
+	named := `{"query":"query A { a } query B { b }","operationName":"B"}`
+
+	p := newTestProxy(t, map[string]string{"STRICT_OPERATION_NAME": "true"}, nil)
+	resp, body := p.post(t, "/public", ambiguous, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("strict, ambiguous: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if msg := errorMessage(t, body); msg != "operationName is required when the document contains multiple operations" {
+		t.Errorf("message = %q", msg)
+	}
+	for _, ok := range []string{named, `{"query":"query A { a }"}`, `{"query":"{ a } fragment F on Query { b }"}`} {
+		if resp, body := p.post(t, "/public", ok, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("strict, %s: status = %d: %s", ok, resp.StatusCode, body)
+		}
+	}
+	if n := len(p.backend.received()); n != 3 {
+		t.Errorf("backend received %d requests, want 3", n)
+	}
+
+	p = newTestProxy(t, map[string]string{"STRICT_OPERATION_NAME": "false"}, nil)
+	if resp, _ := p.post(t, "/public", ambiguous, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("lenient, ambiguous: status = %d, want it forwarded", resp.StatusCode)
+	}
+	if body := p.backend.last(t).Body; !strings.Contains(body, "query B { b }") {
+		t.Errorf("forwarded body = %s", body)
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	tests := []struct {
+		name, body, want string
+	}{
+		{"empty string", `{"query":""}`, "Query must not be empty"},
+		{"whitespace only", `{"query":"  \n\t "}`, "Query must not be empty"},
+		{"missing query key", `{"operationName":"Items"}`, "Request has no query"},
+		{"query not a string", `{"query":42}`, "Query must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := p.post(t, "/public", tt.body, nil)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			if msg := errorMessage(t, body); msg != tt.want {
+				t.Errorf("message = %q, want %q", msg, tt.want)
+			}
+		})
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Errorf("backend received %d requests, want none", n)
+	}
+
+	persisted := `{"extensions":{"persistedQuery":{"version":1,"sha256Hash":"abc"}}}`
+	if resp, body := p.post(t, "/public", persisted, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("persisted query without text: status = %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"BODY_READ_TIMEOUT": "100ms"}, nil)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(p.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Send the headers and part of the body, then stall like a slow client.
+	const body = `{"query":"{ a }"}`
+	fmt.Fprintf(conn, "POST /public HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body[:5])
+	start := time.Now()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("the 408 took %v", waited)
+	}
+	if !resp.Close {
+		t.Error("connection kept open after a body timeout")
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Errorf("backend received %d requests, want none", n)
+	}
+
+	// A body that arrives in time is unaffected, and the deadline doesn't
+	// outlive the read: a slow backend is not cut off by it.
+	p = newTestProxy(t, map[string]string{"BODY_READ_TIMEOUT": "50ms"}, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte(`{"data":{}}`))
+	})
+	if resp, body := p.post(t, "/public", body, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("prompt body: status = %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"REQUIRED_HEADERS": "x-client-id, X-Client-Version"}, nil)
+	query := `{"query":"{ a }"}`
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{"none", nil, "Missing required header X-Client-Id"},
+		{"one missing", map[string]string{"X-Client-Id": "shop-web"}, "Missing required header X-Client-Version"},
+		{"blank value", map[string]string{"X-Client-Id": " ", "X-Client-Version": "1.2"}, "Missing required header X-Client-Id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := p.post(t, "/public", query, tt.header)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			if msg := errorMessage(t, body); msg != tt.want {
+				t.Errorf("message = %q, want %q", msg, tt.want)
+			}
+		})
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Fatalf("backend received %d requests, want none", n)
+	}
+
+	resp, _ := p.post(t, "/public", query, map[string]string{"X-Client-Id": "shop-web", "X-Client-Version": "1.2"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("with both headers: status = %d", resp.StatusCode)
+	}
+	if id := p.backend.last(t).Header.Get("X-Client-Id"); id != "shop-web" {
+		t.Errorf("upstream X-Client-Id = %q", id)
+	}
+
+	p = newTestProxy(t, map[string]string{"REQUIRED_HEADERS": ""}, nil)
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("no required headers configured: status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const readinessPingTimeout = 2 * time.Second
+
+// healthzHandler is the liveness probe. It only shows that the server is
+// serving requests and deliberately checks no dependency, so a brief MongoDB
+// or backend outage doesn't get the process restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler is the readiness probe: it pings MongoDB and reports 503
+// while it is unreachable. Without a connection it is only ready when
+// nothing needs MongoDB or LOG_FALLBACK=memory lets requests be served
+// anyway.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	conn := mongoConn.Load()
+	if conn == nil {
+		if cfg.LogFallback != "memory" && len(mongoRequiredBy()) > 0 {
+			http.Error(w, "MongoDB not connected", http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessPingTimeout)
+		defer cancel()
+		if err := conn.client.Ping(ctx, nil); err != nil {
+			slog.WarnContext(r.Context(), "Readiness check failed", "err", err)
+			http.Error(w, "MongoDB unreachable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestReadyzWithoutMongo(t *testing.T) {
+	prev := mongoConn.Swap(nil)
+	t.Cleanup(func() { mongoConn.Store(prev) })
+	tests := []struct {
+		name string
+		env  map[string]string
+		want int
+	}{
+		{"mongo sink", map[string]string{"LOG_SINK": "mongo"}, http.StatusServiceUnavailable},
+		{"mongo sink with memory fallback", map[string]string{"LOG_SINK": "mongo", "LOG_FALLBACK": "memory"}, http.StatusOK},
+		{"kafka sink", map[string]string{"LOG_SINK": "kafka"}, http.StatusOK},
+		{"kafka sink with audit", map[string]string{"LOG_SINK": "kafka", "AUDIT_LOG": "true"}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"AUDIT_LOG": "", "SHADOW_BACKEND_URL": "", "ADMIN_TOKEN": "", "LOG_FALLBACK": ""}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			useConfig(t, env)
+			if rec := serve(readyzHandler, http.MethodGet, "/readyz", "", nil); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthzWithMongoUnreachable(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_SINK": "mongo", "BACKEND_URL": "http://127.0.0.1:1"})
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100&connectTimeoutMS=100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	prev := mongoConn.Swap(&mongoHandles{client: client})
+	t.Cleanup(func() { mongoConn.Store(prev) })
+
+	if rec := serve(readyzHandler, http.MethodGet, "/readyz", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz = %d, want %d with MongoDB unreachable", rec.Code, http.StatusServiceUnavailable)
+	}
+	start := time.Now()
+	rec := serve(healthzHandler, http.MethodGet, "/healthz", "", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("healthz = %d %q, want 200 ok", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("healthz took %v, as if it waited on a dependency", elapsed)
+	}
+	mongoConn.Store(nil)
+	if rec := serve(healthzHandler, http.MethodGet, "/healthz", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("healthz without MongoDB = %d", rec.Code)
+	}
+}
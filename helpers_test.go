@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// useConfig sets env for the rest of the test and reloads cfg from it,
+// putting the previous cfg back when the test ends.
+func useConfig(t testing.TB, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	prev, prevChars := cfg, dangerousChars
+	t.Cleanup(func() { cfg, dangerousChars = prev, prevChars })
+	cfg = loadConfig()
+	dangerousChars = cfg.SanitizePattern
+}
+
+// resetRateLimits forgets every tracked IP, since all test clients share
+// 127.0.0.1.
+func resetRateLimits() {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	rateLimitStore = make(map[string]*list.Element)
+	rateLimitLRU = list.New()
+}
+
+// recordedRequest is what a stubBackend saw of a proxied request.
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Host   string
+	Proto  string
+	Header http.Header
+	Body   string
+}
+
+// stubBackend records the requests it receives and answers them with
+// respond, or with an empty data object if respond is nil. respond can still
+// read the request body.
+type stubBackend struct {
+	*httptest.Server
+	respond func(w http.ResponseWriter, r *http.Request)
+
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func newStubBackend(t testing.TB, respond func(w http.ResponseWriter, r *http.Request)) *stubBackend {
+	t.Helper()
+	b := &stubBackend{respond: respond}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *stubBackend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	b.mu.Lock()
+	b.requests = append(b.requests, recordedRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Host:   r.Host,
+		Proto:  r.Proto,
+		Header: r.Header.Clone(),
+		Body:   string(body),
+	})
+	b.mu.Unlock()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if b.respond != nil {
+		b.respond(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"data":{}}`)
+}
+
+func (b *stubBackend) received() []recordedRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]recordedRequest(nil), b.requests...)
+}
+
+// last returns the most recent request, failing the test if there was none.
+func (b *stubBackend) last(t *testing.T) recordedRequest {
+	t.Helper()
+	reqs := b.received()
+	if len(reqs) == 0 {
+		t.Fatal("backend received no requests")
+	}
+	return reqs[len(reqs)-1]
+}
+
+// testProxy is the public mux built as main builds it, in front of a
+// stubBackend, logging to memory.
+type testProxy struct {
+	*httptest.Server
+	backend *stubBackend
+	logs    *memorySink
+}
+
+// newTestProxy starts a proxy configured by env. Audit logging is off unless
+// env turns it on.
+func newTestProxy(t testing.TB, env map[string]string, respond func(w http.ResponseWriter, r *http.Request)) *testProxy {
+	t.Helper()
+	backend := newStubBackend(t, respond)
+	merged := map[string]string{"BACKEND_URL": backend.URL, "AUDIT_LOG": "false"}
+	for k, v := range env {
+		merged[k] = v
+	}
+	useConfig(t, merged)
+	resetRateLimits()
+
+	logs := newMemorySink(100)
+	prevSink := logSink
+	logSink = logs
+	t.Cleanup(func() { logSink = prevSink })
+
+	set, err := loadBackendSet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevSet := activeBackends.Swap(set)
+	t.Cleanup(func() { activeBackends.Store(prevSet) })
+
+	mux, _ := newMuxes()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &testProxy{Server: srv, backend: backend, logs: logs}
+}
+
+// post sends body to path as application/json.
+func (p *testProxy) post(t *testing.T, path, body string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	h := map[string]string{"Content-Type": "application/json"}
+	for k, v := range header {
+		h[k] = v
+	}
+	return send(t, http.MethodPost, p.URL+path, body, h)
+}
+
+// lastLog returns the newest log entry, failing the test if there is none.
+func (p *testProxy) lastLog(t *testing.T) logEntry {
+	t.Helper()
+	entries := p.logs.recent()
+	if len(entries) == 0 {
+		t.Fatal("no log entries written")
+	}
+	return entries[0]
+}
+
+// send makes a request and returns the response with its body read.
+func send(t *testing.T, method, url, body string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// serve runs h on a recorded request.
+func serve(h http.HandlerFunc, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// errorMessage returns the first error message of an error envelope.
+func errorMessage(t *testing.T, body string) string {
+	t.Helper()
+	var env errorEnvelope
+	if err := json.Unmarshal([]byte(body), &env); err != nil || len(env.Errors) == 0 {
+		t.Fatalf("not an error envelope: %q", body)
+	}
+	return env.Errors[0].Message
+}
+
+// useMockMongo points mongoConn at mt's mock deployment until the test ends,
+// with write slots for the inserts as initMongo would set up.
+func useMockMongo(mt *mtest.T) {
+	prev, prevSlots := mongoConn.Load(), mongoWriteSlots
+	mongoConn.Store(&mongoHandles{
+		client: mt.Client,
+		logs:   mt.Coll,
+		shadow: mt.DB.Collection("shadow_diffs"),
+		audit:  mt.DB.Collection("audit_log"),
+	})
+	mongoWriteSlots = make(chan struct{}, 1)
+	mt.Cleanup(func() {
+		mongoConn.Store(prev)
+		mongoWriteSlots = prevSlots
+	})
+}
+
+func newMockMongo(t *testing.T) *mtest.T {
+	return mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+}
+
+// logRecorder collects the records logged through slog while installed.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+// captureLogs makes slog's default logger record into the returned
+// logRecorder until the test ends. The recorder is wrapped in
+// contextHandler as in initLogger, so request attributes are included.
+func captureLogs(t *testing.T) *logRecorder {
+	rec := &logRecorder{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{rec}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return rec
+}
+
+func (l *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (l *logRecorder) Handle(_ context.Context, r slog.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r.Clone())
+	return nil
+}
+
+func (l *logRecorder) WithAttrs([]slog.Attr) slog.Handler { return l }
+func (l *logRecorder) WithGroup(string) slog.Handler      { return l }
+
+// find returns the attributes of the first record with msg, and whether there
+// was one.
+func (l *logRecorder) find(msg string) (map[string]slog.Value, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		return attrs, true
+	}
+	return nil, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyEntry is the stored outcome for one client's Idempotency-Key.
+// resp is nil while the first request is still in flight.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	resp        *bufferedResponse
+	expires     time.Time
+}
+
+var (
+	idempotencyMu    sync.Mutex
+	idempotencyStore = make(map[string]*idempotencyEntry)
+	idempotencyStats = newCacheStats("idempotency")
+)
+
+// serveIdempotent proxies the first request with a given Idempotency-Key
+// through next and answers repeats from this client within IDEMPOTENCY_TTL
+// with the stored response. Reusing a key for a different body is a 422 and a
+// repeat that arrives while the first is in flight is a 409. Backend failures
+// (5xx) and requests the client gave up on are not stored, so the client can
+// retry them.
+func serveIdempotent(w http.ResponseWriter, r *http.Request, clientIP, key string, body []byte, next http.Handler) {
+	storeKey := clientIP + "\x00" + key
+	fingerprint := sha256.Sum256(body)
+	now := time.Now()
+
+	idempotencyMu.Lock()
+	if e, ok := idempotencyStore[storeKey]; ok && now.Before(e.expires) {
+		// resp is set by the request that owns the key, so read it under
+		// the lock.
+		stored, resp := e.fingerprint, e.resp
+		idempotencyMu.Unlock()
+		switch {
+		case stored != fingerprint:
+			writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+		case resp == nil:
+			writeError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+		default:
+			idempotencyStats.hit()
+			w.Header().Set("Idempotent-Replayed", "true")
+			resp.replay(w)
+		}
+		return
+	}
+	if len(idempotencyStore) >= cfg.IdempotencyMaxKeys {
+		pruneIdempotencyStore(now)
+	}
+	entry := &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(cfg.IdempotencyTTL)}
+	stored := len(idempotencyStore) < cfg.IdempotencyMaxKeys
+	if stored {
+		idempotencyStore[storeKey] = entry
+	}
+	idempotencyMu.Unlock()
+
+	idempotencyStats.miss()
+	buf := newBufferedResponse()
+	next.ServeHTTP(buf, r)
+
+	if stored {
+		idempotencyMu.Lock()
+		if buf.status >= http.StatusInternalServerError || buf.status == statusClientClosedRequest || r.Context().Err() != nil {
+			delete(idempotencyStore, storeKey)
+		} else {
+			entry.resp = buf
+			entry.expires = time.Now().Add(cfg.IdempotencyTTL)
+		}
+		idempotencyMu.Unlock()
+	}
+	buf.replay(w)
+}
+
+// pruneIdempotencyStore drops expired entries. idempotencyMu must be held.
+func pruneIdempotencyStore(now time.Time) {
+	for k, e := range idempotencyStore {
+		if e.resp != nil && !now.Before(e.expires) {
+			delete(idempotencyStore, k)
+		}
+	}
+}
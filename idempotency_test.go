@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func resetIdempotency(t *testing.T) {
+	clear := func() {
+		idempotencyMu.Lock()
+		idempotencyStore = make(map[string]*idempotencyEntry)
+		idempotencyMu.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// countingBackend answers each request with how many it has seen, failing
+// with a 503 while fail is set.
+func countingBackend(fail *atomic.Bool) func(w http.ResponseWriter, r *http.Request) {
+	var n atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail != nil && fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, `{"data":{"n":%d}}`, n.Add(1))
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"IDEMPOTENCY_TTL": "1m"}, countingBackend(nil))
+	resetIdempotency(t)
+	mutation := `{"query":"mutation Buy { buy(id: 1) }"}`
+	key := map[string]string{"Idempotency-Key": "k1"}
+
+	resp, first := p.post(t, "/public", mutation, key)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first: %d, replayed %q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	resp, second := p.post(t, "/public", mutation, key)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat: %d, replayed %q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if second != first {
+		t.Errorf("repeat body = %s, want the cached %s", second, first)
+	}
+	if n := len(p.backend.received()); n != 1 {
+		t.Errorf("backend received %d requests, want 1", n)
+	}
+
+	resp, body := p.post(t, "/public", `{"query":"mutation Buy { buy(id: 2) }"}`, key)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with a different body: %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	} else if msg := errorMessage(t, body); !strings.Contains(msg, "different request") {
+		t.Errorf("message = %q", msg)
+	}
+
+	p.post(t, "/public", mutation, map[string]string{"Idempotency-Key": "k2"})
+	p.post(t, "/public", mutation, nil)
+	p.post(t, "/public", mutation, nil)
+	if n := len(p.backend.received()); n != 4 {
+		t.Errorf("backend received %d requests, want each new key and keyless request proxied", n)
+	}
+}
+
+func TestIdempotencyDisabled(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"IDEMPOTENCY_TTL": "0"}, countingBackend(nil))
+	resetIdempotency(t)
+	for i := 0; i < 2; i++ {
+		p.post(t, "/public", `{"query":"mutation { buy }"}`, map[string]string{"Idempotency-Key": "k"})
+	}
+	if n := len(p.backend.received()); n != 2 {
+		t.Errorf("backend received %d requests, want 2 with IDEMPOTENCY_TTL=0", n)
+	}
+}
+
+func TestIdempotencySkipsServerErrors(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	p := newTestProxy(t, map[string]string{"IDEMPOTENCY_TTL": "1m"}, countingBackend(&fail))
+	resetIdempotency(t)
+	mutation := `{"query":"mutation { buy }"}`
+	key := map[string]string{"Idempotency-Key": "k"}
+
+	if resp, _ := p.post(t, "/public", mutation, key); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	fail.Store(false)
+	resp, _ := p.post(t, "/public", mutation, key)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a 5xx: %d, replayed %q; want it proxied again", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{})
+	p := newTestProxy(t, map[string]string{"IDEMPOTENCY_TTL": "1m"}, func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		w.Write([]byte(`{"data":{}}`))
+	})
+	resetIdempotency(t)
+	mutation := `{"query":"mutation { buy }"}`
+	key := map[string]string{"Idempotency-Key": "k"}
+
+	done := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, p.URL+"/public", strings.NewReader(mutation))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "k")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first request never reached the backend")
+	}
+	if resp, _ := p.post(t, "/public", mutation, key); resp.StatusCode != http.StatusConflict {
+		t.Errorf("repeat while in flight: %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("first request: %d", status)
+	}
+}
+
+func TestIdempotencyKeysArePerClient(t *testing.T) {
+	useConfig(t, map[string]string{"IDEMPOTENCY_TTL": "1m"})
+	resetIdempotency(t)
+	handler := countingBackend(nil)
+	body := []byte(`{"query":"mutation { buy }"}`)
+	call := func(ip string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		serveIdempotent(rec, httptest.NewRequest(http.MethodPost, "/public", nil), ip, "k", body, http.HandlerFunc(handler))
+		return rec
+	}
+	a, b, again := call("10.0.0.1"), call("10.0.0.2"), call("10.0.0.1")
+	if a.Body.String() == b.Body.String() {
+		t.Errorf("second client got the first client's response %s", b.Body)
+	}
+	if again.Body.String() != a.Body.String() || again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat from the first client = %s, want its cached %s", again.Body, a.Body)
+	}
+}
+
+func TestIdempotencyRetryAfterDisconnect(t *testing.T) {
+	arrived := make(chan struct{})
+	var calls atomic.Int32
+	p := newTestProxy(t, map[string]string{"IDEMPOTENCY_TTL": "1m"}, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(arrived)
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"buy":true}}`))
+	})
+	resetIdempotency(t)
+	mutation := `{"query":"mutation Buy { buy(id: 1) }"}`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, p.URL+"/public", strings.NewReader(mutation))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "k1")
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("request succeeded after being canceled")
+	}
+	// Wait for the abandoned request to finish with its key.
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.logs.recent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp, body := p.post(t, "/public", mutation, map[string]string{"Idempotency-Key": "k1"})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry: %d, replayed %q, want a fresh response", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if body != `{"data":{"buy":true}}` {
+		t.Errorf("retry body = %s", body)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("backend called %d times, want the retry forwarded", n)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaBatchTimeout bounds how long the writer waits to fill a partition's
+// batch. kafka-go defaults to a second, and with a synchronous writer every
+// flush would wait that long on each partially filled partition.
+const kafkaBatchTimeout = 10 * time.Millisecond
+
+// messageWriter is the part of kafka.Writer the sink uses.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// newKafkaSink publishes entries as JSON keyed by client IP, so all entries
+// for one client land on the same partition in order.
+func newKafkaSink() (*batchSink[logEntry], error) {
+	if len(cfg.KafkaBrokers) == 0 || cfg.KafkaTopic == "" {
+		return nil, errors.New("LOG_SINK=kafka requires KAFKA_BROKERS and KAFKA_TOPIC")
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.KafkaBrokers...),
+		Topic:        cfg.KafkaTopic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    cfg.LogBatchSize,
+		BatchTimeout: kafkaBatchTimeout,
+		RequiredAcks: kafka.RequireOne,
+	}
+	return newKafkaWriterSink(writer), nil
+}
+
+// newKafkaWriterSink batches entries into writer. A failed write drops its
+// batch and counts it, as the other sinks do.
+func newKafkaWriterSink(writer messageWriter) *batchSink[logEntry] {
+	return newBatchSink("kafka", func(ctx context.Context, entries []logEntry) error {
+		return writer.WriteMessages(ctx, kafkaMessages(entries)...)
+	})
+}
+
+func kafkaMessages(entries []logEntry) []kafka.Message {
+	msgs := make([]kafka.Message, 0, len(entries))
+	for _, entry := range entries {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			slog.Error("Error encoding log entry for Kafka", "err", err)
+			continue
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(entry.IP), Value: value})
+	}
+	return msgs
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestNewKafkaSinkRequiresBrokersAndTopic(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"KAFKA_BROKERS": "", "KAFKA_TOPIC": "logs"},
+		{"KAFKA_BROKERS": "localhost:9092", "KAFKA_TOPIC": ""},
+	} {
+		useConfig(t, env)
+		if _, err := newKafkaSink(); err == nil {
+			t.Errorf("newKafkaSink with %v succeeded", env)
+		}
+	}
+}
+
+func TestKafkaMessages(t *testing.T) {
+	entries := []logEntry{
+		{IP: "203.0.113.7", OperationName: "A", Status: 200},
+		{IP: "198.51.100.1", OperationName: "B", Status: 429},
+	}
+	msgs := kafkaMessages(entries)
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg.Key) != entries[i].IP {
+			t.Errorf("message %d key = %q, want the client IP", i, msg.Key)
+		}
+		var decoded logEntry
+		if err := json.Unmarshal(msg.Value, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.OperationName != entries[i].OperationName || decoded.Status != entries[i].Status {
+			t.Errorf("message %d = %+v, want %+v", i, decoded, entries[i])
+		}
+	}
+}
+
+// fakeKafkaWriter hands each published batch to batches, or fails with err.
+type fakeKafkaWriter struct {
+	batches chan []kafka.Message
+	err     error
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.batches <- msgs
+	return nil
+}
+
+func TestKafkaSinkPublishes(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_BATCH_SIZE": "2", "LOG_FLUSH_INTERVAL": "20ms", "LOG_QUEUE_SIZE": "10"})
+	writer := &fakeKafkaWriter{batches: make(chan []kafka.Message, 10)}
+	s := newKafkaWriterSink(writer)
+	s.Write(logEntry{IP: "203.0.113.7", OperationName: "A"})
+	s.Write(logEntry{IP: "198.51.100.1", OperationName: "B"})
+
+	select {
+	case msgs := <-writer.batches:
+		if len(msgs) != 2 {
+			t.Fatalf("published %d messages, want 2", len(msgs))
+		}
+		for i, want := range []string{"203.0.113.7", "198.51.100.1"} {
+			if string(msgs[i].Key) != want {
+				t.Errorf("message %d key = %q, want %q", i, msgs[i].Key, want)
+			}
+		}
+		var decoded logEntry
+		if err := json.Unmarshal(msgs[1].Value, &decoded); err != nil || decoded.OperationName != "B" {
+			t.Errorf("message 1 = %s (%v)", msgs[1].Value, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no batch published")
+	}
+}
+
+func TestKafkaSinkCountsFailedPublishes(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_BATCH_SIZE": "3", "LOG_FLUSH_INTERVAL": "20ms", "LOG_QUEUE_SIZE": "10"})
+	before := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("kafka"))
+	s := newKafkaWriterSink(&fakeKafkaWriter{err: errors.New("brokers unreachable")})
+	for i := 0; i < 3; i++ {
+		s.Write(logEntry{IP: "203.0.113.7"})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(logsDroppedTotal.WithLabelValues("kafka")) < before+3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("kafka")) - before; got != 3 {
+		t.Errorf("dropped %v entries, want the failed batch of 3", got)
+	}
+}
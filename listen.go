@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen opens LISTEN_ADDR or ADMIN_ADDR, each a TCP address such as :8080 or a Unix
+// socket given as unix:/path/to.sock. A stale socket file left by a previous
+// run is removed first; the new one is removed when the listener closes.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, cfg.ListenSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
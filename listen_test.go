@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	useConfig(t, map[string]string{"LISTEN_SOCKET_MODE": "0600"})
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	// A socket file left behind by an earlier run.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "over the socket")
+	})}
+	go srv.Serve(ln)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("socket mode = %v, want 0600", mode)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://proxy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "over the socket" {
+		t.Errorf("body = %q", body)
+	}
+
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still present after close: %v", err)
+	}
+}
+
+func TestListenRefusesNonSocketFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen("unix:" + path); err == nil {
+		ln.Close()
+		t.Fatal("listen replaced a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("the regular file was modified")
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if network := ln.Addr().Network(); network != "tcp" {
+		t.Errorf("network = %q, want tcp", network)
+	}
+}
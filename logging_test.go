@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestLogsCarryContextFields(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"SLOW_QUERY_THRESHOLD": "1ns"}, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{}}`))
+	})
+	logs := captureLogs(t)
+	p.post(t, "/public", `{"query":"query Items { items }"}`, map[string]string{"X-Request-ID": "req-42"})
+
+	attrs, ok := logs.find("Slow query")
+	if !ok {
+		t.Fatal("no slow query record")
+	}
+	if v := attrs["request_id"].String(); v != "req-42" {
+		t.Errorf("request_id = %q", v)
+	}
+	if v := attrs["ip"].String(); v != "127.0.0.1" {
+		t.Errorf("ip = %q", v)
+	}
+	if v := attrs["operation"].String(); v != "Items" {
+		t.Errorf("operation = %q", v)
+	}
+	if _, ok := attrs["duration"]; !ok {
+		t.Error("duration missing")
+	}
+}
+
+func TestContextHandlerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}).With("component", "test")
+	r := withRequestContext(httptest.NewRequest(http.MethodPost, "/public", nil),
+		&RequestContext{RequestID: "req-7", ClientIP: "203.0.113.7", TraceID: "trace-1"})
+
+	logger.InfoContext(r.Context(), "hello")
+	logger.InfoContext(context.Background(), "outside a request")
+
+	dec := json.NewDecoder(&buf)
+	var inRequest, outside map[string]string
+	if err := dec.Decode(&inRequest); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&outside); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"msg": "hello", "component": "test", "request_id": "req-7", "ip": "203.0.113.7", "trace_id": "trace-1"} {
+		if inRequest[key] != want {
+			t.Errorf("%s = %q, want %q", key, inRequest[key], want)
+		}
+	}
+	if _, ok := outside["request_id"]; ok {
+		t.Errorf("record outside a request has request fields: %v", outside)
+	}
+}
+
+func TestInitLoggerLevel(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	useConfig(t, map[string]string{"LOG_LEVEL": "warn", "LOG_FORMAT": "json"})
+	initLogger()
+	if slog.Default().Enabled(context.Background(), slog.LevelInfo) || !slog.Default().Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("LOG_LEVEL=warn not applied")
+	}
+
+	useConfig(t, map[string]string{"LOG_LEVEL": "loud"})
+	initLogger()
+	if !slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("an invalid LOG_LEVEL should fall back to info")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// LogSink receives one entry per proxied request. Write must never block the
+// request path.
+type LogSink interface {
+	Write(entry logEntry)
+}
+
+var logSink LogSink
+
+// writeLog hands entry to the configured sink and to any /admin/tap
+// subscribers.
+func writeLog(entry logEntry) {
+	logSink.Write(entry)
+	publishTap(entry)
+}
+
+var logsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "logs_dropped_total",
+	Help: "Log entries dropped because a sink queue was full or a write failed.",
+}, []string{"sink"})
+
+// batchSink buffers entries in a bounded queue and hands them to writeBatch
+// in batches. When the queue is full entries are dropped and counted rather
+// than slowing down requests. It carries log entries for the log sinks and
+// audit entries for the audit log.
+type batchSink[T any] struct {
+	name          string
+	queue         chan T
+	batchSize     int
+	flushInterval time.Duration
+	writeBatch    func(ctx context.Context, entries []T) error
+
+	// dropped counts entries dropped since the last warning; lastWarning
+	// (unix nanoseconds) throttles the warnings to one per dropWarningInterval.
+	dropped     atomic.Int64
+	lastWarning atomic.Int64
+
+	// closeMu orders Write against Close: once closed is set no entry can
+	// enter the queue, so the final drain in run sees all of them.
+	closeMu sync.RWMutex
+	closed  bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+const dropWarningInterval = 10 * time.Second
+
+func newBatchSink[T any](name string, writeBatch func(context.Context, []T) error) *batchSink[T] {
+	s := &batchSink[T]{
+		name:          name,
+		queue:         make(chan T, cfg.LogQueueSize),
+		batchSize:     cfg.LogBatchSize,
+		flushInterval: cfg.LogFlushInterval,
+		writeBatch:    writeBatch,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *batchSink[T]) Write(entry T) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		logsDroppedTotal.WithLabelValues(s.name).Inc()
+		return
+	}
+	select {
+	case s.queue <- entry:
+	default:
+		logsDroppedTotal.WithLabelValues(s.name).Inc()
+		s.dropped.Add(1)
+		s.warnDropped()
+	}
+}
+
+// Close stops taking entries, writes out everything still queued and waits
+// for that to finish or for ctx to end. Entries written after Close are
+// dropped and counted.
+func (s *batchSink[T]) Close(ctx context.Context) error {
+	s.closeMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	s.closeMu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *batchSink[T]) warnDropped() {
+	now := time.Now().UnixNano()
+	last := s.lastWarning.Load()
+	if now-last < int64(dropWarningInterval) || !s.lastWarning.CompareAndSwap(last, now) {
+		return
+	}
+	slog.Warn("Log queue full, dropping entries", "sink", s.name, "dropped", s.dropped.Swap(0))
+}
+
+func (s *batchSink[T]) queueLen() int {
+	return len(s.queue)
+}
+
+// logQueueLen reports how many entries the active sink has waiting, or 0 for
+// sinks without a queue.
+func logQueueLen() int {
+	if q, ok := logSink.(interface{ queueLen() int }); ok {
+		return q.queueLen()
+	}
+	return 0
+}
+
+func (s *batchSink[T]) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]T, 0, s.batchSize)
+	for {
+		select {
+		case entry := <-s.queue:
+			batch = append(batch, entry)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.stop:
+			s.drain(batch)
+			return
+		}
+		s.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain writes batch and whatever is left in the queue once Close has
+// stopped new entries from arriving.
+func (s *batchSink[T]) drain(batch []T) {
+	for {
+		select {
+		case entry := <-s.queue:
+			batch = append(batch, entry)
+			if len(batch) < s.batchSize {
+				continue
+			}
+			s.flush(batch)
+			batch = batch[:0]
+		default:
+			if len(batch) > 0 {
+				s.flush(batch)
+			}
+			return
+		}
+	}
+}
+
+func (s *batchSink[T]) flush(batch []T) {
+	ctx, cancel := context.WithTimeout(context.Background(), logWriteTimeout)
+	defer cancel()
+
+	if err := s.writeBatch(ctx, batch); err != nil {
+		slog.Error("Error writing log entries", "sink", s.name, "entries", len(batch), "err", err)
+		logsDroppedTotal.WithLabelValues(s.name).Add(float64(len(batch)))
+	}
+}
+
+func newLogSink(name string) (LogSink, error) {
+	switch name {
+	case "mongo":
+		if mongoConn.Load() == nil {
+			return nil, errors.New("LOG_SINK=mongo requires a MongoDB connection")
+		}
+		return newBatchSink("mongo", writeMongoBatch), nil
+	case "kafka":
+		return newKafkaSink()
+	case "opensearch":
+		return newOpenSearchSink()
+	default:
+		return nil, fmt.Errorf("unknown LOG_SINK %q", name)
+	}
+}
+
+// initLogSink sets up the configured sink. If that fails and LOG_FALLBACK is
+// memory, entries are kept in a ring buffer instead of stopping the proxy.
+func initLogSink() {
+	sink, err := newLogSink(cfg.LogSink)
+	if err != nil {
+		if cfg.LogFallback != "memory" {
+			fatal("Error initializing log sink", "sink", cfg.LogSink, "err", err)
+		}
+		slog.Error("Error initializing log sink, falling back to memory", "sink", cfg.LogSink, "err", err)
+		logSink = newMemorySink(cfg.LogFallbackSize)
+		return
+	}
+	logSink = sink
+	slog.Info("Logging to sink", "sink", cfg.LogSink)
+}
+
+// closeSinks flushes the log and audit queues at shutdown, once the servers
+// have stopped producing entries.
+func closeSinks(ctx context.Context) {
+	if c, ok := logSink.(interface{ Close(context.Context) error }); ok {
+		if err := c.Close(ctx); err != nil {
+			slog.Error("Error flushing log entries at shutdown", "sink", cfg.LogSink, "queued", logQueueLen(), "err", err)
+		}
+	}
+	if auditSink != nil {
+		if err := auditSink.Close(ctx); err != nil {
+			slog.Error("Error flushing audit entries at shutdown", "queued", auditSink.queueLen(), "err", err)
+		}
+	}
+}
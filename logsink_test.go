@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBatchSinkDropsWhenFull(t *testing.T) {
+	logs := captureLogs(t)
+	// No run loop, so nothing drains the queue.
+	s := &batchSink[logEntry]{name: "test_full", queue: make(chan logEntry, 2)}
+	before := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_full"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			s.Write(logEntry{IP: "192.0.2.1"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked on a full queue")
+	}
+
+	if got := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_full")); got != before+3 {
+		t.Errorf("logs_dropped_total = %v, want %v", got, before+3)
+	}
+	if s.queueLen() != 2 {
+		t.Errorf("queue length = %d, want 2", s.queueLen())
+	}
+	attrs, ok := logs.find("Log queue full, dropping entries")
+	if !ok {
+		t.Fatal("no drop warning logged")
+	}
+	if dropped := attrs["dropped"].Int64(); dropped != 1 {
+		t.Errorf("first warning reports %d drops, want 1", dropped)
+	}
+	logs.mu.Lock()
+	warnings := 0
+	for _, r := range logs.records {
+		if r.Message == "Log queue full, dropping entries" {
+			warnings++
+		}
+	}
+	logs.mu.Unlock()
+	if warnings != 1 {
+		t.Errorf("%d drop warnings logged, want them throttled to 1", warnings)
+	}
+	if s.dropped.Load() != 2 {
+		t.Errorf("drops pending the next warning = %d, want 2", s.dropped.Load())
+	}
+}
+
+func TestBatchSinkFlushes(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_BATCH_SIZE": "3", "LOG_FLUSH_INTERVAL": "50ms", "LOG_QUEUE_SIZE": "10"})
+	batches := make(chan []logEntry, 10)
+	s := newBatchSink("test_flush", func(ctx context.Context, entries []logEntry) error {
+		batches <- append([]logEntry(nil), entries...)
+		return nil
+	})
+
+	for i := 0; i < 4; i++ {
+		s.Write(logEntry{Status: i})
+	}
+	// A full batch is written at once, the remainder on the next tick.
+	for _, want := range []int{3, 1} {
+		select {
+		case batch := <-batches:
+			if len(batch) != want {
+				t.Errorf("batch of %d, want %d", len(batch), want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no batch of %d written", want)
+		}
+	}
+}
+
+func TestBatchSinkCountsFailedWrites(t *testing.T) {
+	useConfig(t, nil)
+	s := &batchSink[logEntry]{name: "test_fail", writeBatch: func(context.Context, []logEntry) error {
+		return errors.New("unavailable")
+	}}
+	before := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_fail"))
+	s.flush([]logEntry{{}, {}})
+	if got := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_fail")); got != before+2 {
+		t.Errorf("logs_dropped_total = %v, want %v", got, before+2)
+	}
+}
+
+func TestBatchSinkCloseFlushes(t *testing.T) {
+	// The interval is long enough that only Close writes anything.
+	useConfig(t, map[string]string{"LOG_BATCH_SIZE": "3", "LOG_FLUSH_INTERVAL": "1h", "LOG_QUEUE_SIZE": "10"})
+	var written []logEntry
+	s := newBatchSink("test_close", func(ctx context.Context, entries []logEntry) error {
+		written = append(written, entries...)
+		return nil
+	})
+	for i := 0; i < 5; i++ {
+		s.Write(logEntry{Status: i})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Close has waited for run to finish, so written is safe to read.
+	if len(written) != 5 {
+		t.Errorf("%d entries written by Close, want 5", len(written))
+	}
+
+	before := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_close"))
+	s.Write(logEntry{})
+	if got := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_close")); got != before+1 {
+		t.Errorf("logs_dropped_total after a write past Close = %v, want %v", got, before+1)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestBatchSinkCloseTimesOut(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_FLUSH_INTERVAL": "1h"})
+	release := make(chan struct{})
+	defer close(release)
+	s := newBatchSink("test_close_timeout", func(ctx context.Context, entries []logEntry) error {
+		<-release
+		return nil
+	})
+	s.Write(logEntry{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close with a stuck writer = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// backedUpSink installs a log sink with no run loop holding queued entries out
+// of a queue of size, so the queue stays backed up until the test drains it.
+func backedUpSink(t *testing.T, name string, queued, size int) *batchSink[logEntry] {
+	s := &batchSink[logEntry]{name: name, queue: make(chan logEntry, size)}
+	for i := 0; i < queued; i++ {
+		s.queue <- logEntry{}
+	}
+	prev := logSink
+	logSink = s
+	t.Cleanup(func() { logSink = prev })
+	return s
+}
+
+func TestLogBacklogShedsLoad(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"LOG_QUEUE_SHED_THRESHOLD": "3"}, nil)
+	s := backedUpSink(t, "test_shed", 3, 10)
+
+	resp, body := p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if msg := errorMessage(t, body); msg != "Server is busy, please retry later" {
+		t.Errorf("message = %q", msg)
+	}
+	if resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q", resp.Header.Get("Retry-After"))
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Errorf("backend received %d requests while shedding", n)
+	}
+
+	// Drain below the high-water mark; the rejection above was queued too.
+	for len(s.queue) > 2 {
+		<-s.queue
+	}
+	if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("after draining: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestLogBacklogDropsByDefault(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"LOG_QUEUE_SHED_THRESHOLD": "0"}, nil)
+	backedUpSink(t, "test_keep_serving", 2, 2)
+	before := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_keep_serving"))
+
+	for i := 0; i < 3; i++ {
+		if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want it served with a full log queue", i+1, resp.StatusCode)
+		}
+	}
+	if got := testutil.ToFloat64(logsDroppedTotal.WithLabelValues("test_keep_serving")) - before; got != 3 {
+		t.Errorf("dropped %v entries, want 3", got)
+	}
+}
@@ -1,62 +1,102 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"io"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	mongoClient   *mongo.Client
-	mongoDatabase *mongo.Database
-	mongoLogsColl *mongo.Collection
-)
+// mongoHandles are the client and collections in use. They are swapped as a
+// whole when the Mongo supervisor reconnects; mongoConn is nil when running
+// without MongoDB.
+type mongoHandles struct {
+	client *mongo.Client
+	logs   *mongo.Collection
+	shadow *mongo.Collection
+	audit  *mongo.Collection
+}
 
-var dangerousChars = regexp.MustCompile(`[;&*+#=<>-]`)
+var mongoConn atomic.Pointer[mongoHandles]
 
-var rateLimitStore = make(map[string][]time.Time)
+const defaultSanitizePattern = `[;&*+#=<>-]`
 
-const (
-	maxRequestsPerMinute = 50
-	rateLimitWindow      = time.Minute
-)
+var dangerousChars = regexp.MustCompile(defaultSanitizePattern)
 
-func sanitizeGraphQLQuery(query string) string {
-	return dangerousChars.ReplaceAllString(query, "")
+// sanitizeGraphQLQuery strips dangerousChars from the query, or with
+// SANITIZE_MODE=strings only from string literals, and reports how many
+// matches were removed.
+func sanitizeGraphQLQuery(query string) (string, int) {
+	if cfg.SanitizeMode == "strings" {
+		return sanitizeStringLiterals(query)
+	}
+	removed := len(dangerousChars.FindAllStringIndex(query, -1))
+	return dangerousChars.ReplaceAllString(query, ""), removed
 }
 
-func logToMongo(ctx context.Context, ip, raw, sanitized string) {
-	entry := map[string]interface{}{
-		"ip":             ip,
-		"originalQuery":  raw,
-		"sanitizedQuery": sanitized,
-		"timestamp":      time.Now(),
-	}
+type logEntry struct {
+	ID             primitive.ObjectID     `bson:"_id,omitempty" json:"id,omitempty"`
+	RequestID      string                 `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	TraceID        string                 `bson:"traceId,omitempty" json:"traceId,omitempty"`
+	IP             string                 `bson:"ip" json:"ip"`
+	Route          string                 `bson:"route,omitempty" json:"route,omitempty"`
+	UserAgent      string                 `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	Referer        string                 `bson:"referer,omitempty" json:"referer,omitempty"`
+	OperationName  string                 `bson:"operationName,omitempty" json:"operationName,omitempty"`
+	Status         int                    `bson:"status" json:"status"`
+	DurationMs     int64                  `bson:"durationMs" json:"durationMs"`
+	LoadTest       bool                   `bson:"loadTest,omitempty" json:"loadTest,omitempty"`
+	Rejection      string                 `bson:"rejection,omitempty" json:"rejection,omitempty"`
+	OriginalQuery  string                 `bson:"originalQuery,omitempty" json:"originalQuery,omitempty"`
+	SanitizedQuery string                 `bson:"sanitizedQuery,omitempty" json:"sanitizedQuery,omitempty"`
+	Variables      map[string]interface{} `bson:"variables,omitempty" json:"variables,omitempty"`
+	StageTimingsUs map[string]int64       `bson:"stageTimingsUs,omitempty" json:"stageTimingsUs,omitempty"`
+	Timestamp      time.Time              `bson:"timestamp" json:"timestamp"`
+}
 
-	_, err := mongoLogsColl.InsertOne(ctx, entry)
-	if err != nil {
-		log.Printf("Error writing to MongoDB: %v", err)
+const (
+	logWriteTimeout     = 5 * time.Second
+	mongoConnectTimeout = 10 * time.Second
+	shutdownTimeout     = 30 * time.Second
+)
+
+// writeMongoBatch inserts a batch of entries. The insert is unordered so one
+// bad document doesn't stop the rest of the batch from being written.
+func writeMongoBatch(ctx context.Context, entries []logEntry) error {
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
 	}
+	logs := mongoConn.Load().logs
+	err := withMongoWriteSlot(ctx, func() error {
+		_, err := logs.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		return err
+	})
+	reportMongoResult(err)
+	return err
 }
 
 func extractClientIP(remoteAddr string) string {
 	ip, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		log.Printf("Failed to split remote address: %v", err)
+		slog.Warn("Failed to split remote address", "addr", remoteAddr, "err", err)
 		return remoteAddr
 	}
 	if ip == "::1" { // IPv6 Loopback Address
@@ -65,130 +105,282 @@ func extractClientIP(remoteAddr string) string {
 	return ip
 }
 
-func isRateLimited(ip string) bool {
-	now := time.Now()
-	requests := rateLimitStore[ip]
-
-	// Remove timestamps outside the current window
-	var recentRequests []time.Time
-	for _, t := range requests {
-		if now.Sub(t) <= rateLimitWindow {
-			recentRequests = append(recentRequests, t)
-		}
+// mongoRequiredBy lists the enabled settings that store or read data in
+// MongoDB. With none of them the proxy runs without connecting to it at all.
+// The admin endpoints don't need it of their own accord: /admin/logs,
+// /admin/stats and /admin/replay read the logs LOG_SINK=mongo writes and
+// answer 503 without it, and the rest never touch MongoDB.
+func mongoRequiredBy() []string {
+	var settings []string
+	if cfg.LogSink == "mongo" {
+		settings = append(settings, "LOG_SINK=mongo")
+	}
+	if cfg.AuditLog {
+		settings = append(settings, "AUDIT_LOG")
+	}
+	if cfg.ShadowBackendURL != "" {
+		settings = append(settings, "SHADOW_BACKEND_URL")
 	}
+	return settings
+}
 
-	// Update the map with only recent requests
-	rateLimitStore[ip] = recentRequests
+// mongoBackedFeatures are what is unavailable without a MongoDB connection.
+const mongoBackedFeatures = "audit log, shadow diffs, /admin/logs, /admin/stats, /admin/replay"
 
-	// Check if the IP exceeded the limit
-	if len(recentRequests) >= maxRequestsPerMinute {
-		return true
+func initMongo() error {
+	mongoURI := os.Getenv("MONGO_URI")
+	if mongoURI == "" {
+		return errors.New("MONGO_URI not found in environment")
+	}
+	if err := validateMongoNames(cfg.MongoDB, cfg.MongoCollection); err != nil {
+		return err
 	}
 
-	// Add this request timestamp
-	rateLimitStore[ip] = append(rateLimitStore[ip], now)
-	return false
-}
+	mongoWriteSlots = make(chan struct{}, cfg.MongoMaxPoolSize)
 
-func graphqlMiddleware(target *url.URL) http.HandlerFunc {
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
 
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		resp.Header.Del("Access-Control-Allow-Origin")
-		resp.Header.Del("Access-Control-Allow-Methods")
-		resp.Header.Del("Access-Control-Allow-Headers")
-		resp.Header.Del("Access-Control-Allow-Credentials")
-		return nil
+	handles, err := connectMongo(ctx, mongoURI)
+	if err != nil {
+		return err
 	}
+	mongoConn.Store(handles)
+	slog.Info("Connected to MongoDB")
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if cfg.EnsureIndexes {
+		ensureLogIndexes(ctx, handles.logs)
+	}
+	go superviseMongo(mongoURI)
+	return nil
+}
 
-		if r.Method != http.MethodPost || r.URL.Path != "/public" {
-			http.Error(w, "Not Found", http.StatusNotFound)
-			return
-		}
+func connectMongo(ctx context.Context, uri string) (*mongoHandles, error) {
+	clientOpts := options.Client().
+		ApplyURI(uri).
+		SetMaxPoolSize(cfg.MongoMaxPoolSize).
+		SetPoolMonitor(mongoPoolMonitor())
 
-		ctx := r.Context()
-		var bodyBytes []byte
-		if r.Body != nil {
-			bodyBytes, _ = io.ReadAll(r.Body)
-		}
-		var payload map[string]interface{}
-		json.Unmarshal(bodyBytes, &payload)
+	client, err := mongo.Connect(ctx, clientOpts)
+	if err != nil {
+		return nil, fmt.Errorf("MongoDB connection error: %w", err)
+	}
 
-		originalQuery := ""
-		cleanedQuery := ""
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("MongoDB ping failed: %w", err)
+	}
 
-		if query, ok := payload["query"].(string); ok {
-			originalQuery = query
-			cleanedQuery = sanitizeGraphQLQuery(query)
-			payload["query"] = cleanedQuery
-		}
+	return newMongoHandles(client), nil
+}
 
-		newBody, _ := json.Marshal(payload)
-		r.Body = io.NopCloser(bytes.NewBuffer(newBody))
-		r.ContentLength = int64(len(newBody))
-		ip := extractClientIP(r.RemoteAddr)
-		if isRateLimited(ip) {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
-		}
-		go logToMongo(ctx, ip, originalQuery, cleanedQuery)
+// newMongoHandles opens the MONGO_DB collections on client.
+func newMongoHandles(client *mongo.Client) *mongoHandles {
+	db := client.Database(cfg.MongoDB)
+	return &mongoHandles{
+		client: client,
+		logs:   db.Collection(cfg.MongoCollection),
+		shadow: db.Collection("shadow_diffs"),
+		audit:  db.Collection(cfg.AuditCollection),
+	}
+}
 
-		proxy.ServeHTTP(w, r)
+// validateMongoNames rejects database and collection names MongoDB would
+// refuse, so a typo fails at startup rather than on the first insert.
+func validateMongoNames(db, coll string) error {
+	if strings.TrimSpace(db) == "" || strings.ContainsAny(db, "/\\. \"$") {
+		return fmt.Errorf("invalid MONGO_DB %q", db)
 	}
+	if strings.TrimSpace(coll) == "" || strings.Contains(coll, "$") || strings.HasPrefix(coll, "system.") {
+		return fmt.Errorf("invalid MONGO_COLLECTION %q", coll)
+	}
+	return nil
 }
 
-func initMongo() {
-	err := godotenv.Load()
+func ensureLogIndexes(ctx context.Context, logs *mongo.Collection) {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ip", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+	}
+
+	names, err := logs.Indexes().CreateMany(ctx, models)
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		slog.Error("MongoDB index creation failed", "err", err)
+		return
 	}
+	slog.Info("Ensured MongoDB indexes", "indexes", names)
+}
 
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		log.Fatal("MONGO_URI not found in environment")
+func main() {
+	parseFlags(os.Args[1:])
+	if err := godotenv.Load(envFile); err != nil {
+		if !envBool("TEST_MODE", false) {
+			fatal("Error loading .env file", "path", envFile, "err", err)
+		}
+		slog.Warn("No .env file loaded", "path", envFile, "err", err)
+	}
+	applyFlagOverrides()
+	cfg = loadConfig()
+	initLogger()
+	dangerousChars = cfg.SanitizePattern
+	if err := loadRejectionTemplate(); err != nil {
+		fatal("Error loading rejection template", "path", cfg.RejectionHTMLTemplate, "err", err)
+	}
+	if err := loadVariableSchemas(); err != nil {
+		fatal("Error loading variable schemas", "err", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	// TEST_MODE runs standalone: no MongoDB, logs kept in memory and a stub
+	// in place of the backend.
+	if cfg.TestMode {
+		logSink = newMemorySink(cfg.LogFallbackSize)
+		if err := startTestBackend(); err != nil {
+			fatal("Error starting test backend", "err", err)
+		}
+	} else {
+		// MongoDB is only connected when something is configured to use it.
+		// With LOG_FALLBACK=memory even then a missing MongoDB is not fatal:
+		// requests are still served and logged to memory, and the
+		// Mongo-backed features are unavailable.
+		if required := mongoRequiredBy(); len(required) == 0 {
+			slog.Info("Running without MongoDB", "unavailable", mongoBackedFeatures)
+		} else if err := initMongo(); err != nil {
+			if cfg.LogFallback != "memory" {
+				fatal("Error connecting to MongoDB", "required_by", required, "err", err)
+			}
+			slog.Error("Continuing without MongoDB", "unavailable", mongoBackedFeatures, "err", err)
+		}
+		initLogSink()
+		initAuditSink()
+	}
+	if err := initAccessLog(); err != nil {
+		fatal("Error opening access log", "path", cfg.AccessLog, "err", err)
+	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	backends, err := loadBackendSet(nil)
 	if err != nil {
-		log.Fatalf("MongoDB connection error: %v", err)
+		fatal("Error loading backends", "err", err)
 	}
-
-	if err := client.Ping(ctx, nil); err != nil {
-		log.Fatalf("MongoDB ping failed: %v", err)
+	if cfg.BackendStartupProbe {
+		probeBackends(backends)
 	}
+	swapBackends(backends)
+	if schemaNeeded() {
+		if err := refreshSchema(context.Background()); err != nil {
+			slog.Error("Backend schema unavailable until a refresh succeeds", "err", err)
+		}
+		if cfg.SchemaRefreshInterval > 0 {
+			go refreshSchemaPeriodically(cfg.SchemaRefreshInterval)
+		}
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		concurrencyLimiter = newFairLimiter(cfg.MaxConcurrentRequests)
+	}
+	setMaintenanceMode(cfg.MaintenanceMode)
+	go watchReloadSignal()
 
-	mongoClient = client
-	mongoDatabase = client.Database("Middleware_Logs")
-	mongoLogsColl = mongoDatabase.Collection("graphql_logs")
+	mux, adminMux := newMuxes()
+	servers := []*listener{{name: "public", addr: cfg.ListenAddr, handler: mux}}
+	if adminMux != mux {
+		servers = append(servers, &listener{name: "admin", addr: cfg.AdminAddr, handler: adminMux})
+	}
+	for _, s := range servers {
+		ln, err := listen(s.addr)
+		if err != nil {
+			fatal("Error listening", "listener", s.name, "addr", s.addr, "err", err)
+		}
+		s.ln = ln
+		s.srv = &http.Server{
+			Handler:           withAccessLog(withRecovery(s.handler)),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+		}
+		s.srv.RegisterOnShutdown(stopTaps)
+	}
 
-	log.Println("Connected to MongoDB")
+	// On SIGINT or SIGTERM, stop accepting connections on every listener and
+	// let in-flight requests finish, then flush the queued log and audit
+	// entries; closing a listener also removes a Unix socket file.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, s := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.srv.Shutdown(shutdownCtx); err != nil {
+					slog.Error("Error during shutdown", "listener", s.name, "err", err)
+				}
+			}()
+		}
+		wg.Wait()
+		closeSinks(shutdownCtx)
+	}()
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		slog.Info("Go middleware proxy listening", "listener", s.name, "addr", s.ln.Addr().String())
+		go func() { errs <- s.srv.Serve(s.ln) }()
+	}
+	for range servers {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", "err", err)
+		}
+	}
+	<-stopped
+	slog.Info("Server stopped")
 }
 
-func main() {
-	initMongo()
-
-	// target, _ := url.Parse("http://localhost:9090")
-	targetStr := os.Getenv("BACKEND_URL")
-	target, err := url.Parse(targetStr)
-	if err != nil {
-		log.Fatalf("Invalid BACKEND_URL: %v", err)
+// newMuxes builds the public mux and the one serving the admin, metrics and
+// pprof endpoints. An explicit mux keeps net/http/pprof's init-time
+// registrations on http.DefaultServeMux from ever being served. Without
+// ADMIN_ADDR both are the same mux; with it the admin endpoints are served
+// only on that address.
+func newMuxes() (mux, adminMux *http.ServeMux) {
+	mux = http.NewServeMux()
+	adminMux = mux
+	if cfg.AdminAddr != "" {
+		adminMux = http.NewServeMux()
+		adminMux.HandleFunc("/", notFoundHandler)
+	}
+	adminMux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc(cfg.LivenessPath, healthzHandler)
+	mux.HandleFunc(cfg.ReadinessPath, readyzHandler)
+	rootRouted := false
+	for _, rt := range loadRoutes() {
+		mux.HandleFunc(rt.path, graphqlMiddleware(rt))
+		rootRouted = rootRouted || rt.path == "/"
 	}
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/public", graphqlMiddleware(target))
+	if cfg.SchemaEndpoint {
+		mux.HandleFunc("/schema", schemaHandler)
+	}
+	adminMux.HandleFunc("/admin/logs", requireAdmin(adminLogsHandler))
+	adminMux.HandleFunc("/admin/stats", requireAdmin(adminStatsHandler))
+	adminMux.HandleFunc("/admin/maintenance", requireAdmin(adminMaintenanceHandler))
+	adminMux.HandleFunc("/admin/replay", requireAdmin(adminReplayHandler))
+	adminMux.HandleFunc("/admin/tap", requireAdmin(adminTapHandler))
+	adminMux.HandleFunc("/admin/logs/memory", requireAdmin(adminMemoryLogsHandler))
+	adminMux.HandleFunc("/admin/schema/refresh", requireAdmin(adminSchemaRefreshHandler))
+	if cfg.PprofEnabled {
+		registerPprof(adminMux)
+	}
+	if !rootRouted {
+		mux.HandleFunc("/", notFoundHandler)
+	}
+	return mux, adminMux
+}
 
-	log.Println("Go middleware proxy listening on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// listener is one address the proxy serves, with the handler behind it.
+type listener struct {
+	name    string
+	addr    string
+	handler http.Handler
+	ln      net.Listener
+	srv     *http.Server
 }
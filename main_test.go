@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestEnsureLogIndexes(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("creates ip and timestamp indexes", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		ensureLogIndexes(context.Background(), mt.Coll)
+
+		cmd := mt.GetStartedEvent().Command
+		if name := cmd.Lookup("createIndexes").StringValue(); name != mt.Coll.Name() {
+			mt.Fatalf("createIndexes = %q, want %q", name, mt.Coll.Name())
+		}
+		values, err := cmd.Lookup("indexes").Array().Values()
+		if err != nil {
+			mt.Fatal(err)
+		}
+		var keys []bson.D
+		for _, v := range values {
+			var key bson.D
+			if err := bson.Unmarshal(v.Document().Lookup("key").Document(), &key); err != nil {
+				mt.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		want := []bson.D{
+			{{Key: "ip", Value: int32(1)}, {Key: "timestamp", Value: int32(-1)}},
+			{{Key: "timestamp", Value: int32(-1)}},
+		}
+		if !reflect.DeepEqual(keys, want) {
+			mt.Errorf("indexes = %v, want %v", keys, want)
+		}
+	})
+
+	mt.Run("survives a failed creation", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Message: "unauthorized"}))
+		ensureLogIndexes(context.Background(), mt.Coll)
+	})
+}
+
+func TestSanitizeGraphQLQueryPattern(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		query       string
+		want        string
+		wantRemoved int
+	}{
+		{"default pattern", "", `{ a(x: "1;2") }`, `{ a(x: "12") }`, 1},
+		{"custom pattern", `[!]`, `{ a(x: "1;2!") }`, `{ a(x: "1;2") }`, 1},
+		{"invalid pattern falls back to the default", `[`, `{ a(x: "<b>") }`, `{ a(x: "b") }`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, map[string]string{"SANITIZE_PATTERN": tt.pattern})
+			got, removed := sanitizeGraphQLQuery(tt.query)
+			if got != tt.want || removed != tt.wantRemoved {
+				t.Errorf("sanitizeGraphQLQuery(%q) = %q, %d; want %q, %d", tt.query, got, removed, tt.want, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestProxyForwardsSanitizedQuery(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"SANITIZE_PATTERN": `[$]`}, nil)
+	resp, _ := p.post(t, "/public", `{"query":"{ a(x: \"$1-2\") }"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(p.backend.last(t).Body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if q := payload["query"]; q != `{ a(x: "1-2") }` {
+		t.Errorf("forwarded query = %q", q)
+	}
+	if entry := p.lastLog(t); entry.OriginalQuery != `{ a(x: "$1-2") }` {
+		t.Errorf("logged original query = %q", entry.OriginalQuery)
+	}
+}
+
+func TestMongoRequiredBy(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"mongo sink", map[string]string{"LOG_SINK": "mongo"}, []string{"LOG_SINK=mongo", "AUDIT_LOG"}},
+		{"kafka sink", map[string]string{"LOG_SINK": "kafka"}, nil},
+		{"kafka sink with audit", map[string]string{"LOG_SINK": "kafka", "AUDIT_LOG": "true"}, []string{"AUDIT_LOG"}},
+		{"mongo sink without audit", map[string]string{"LOG_SINK": "mongo", "AUDIT_LOG": "false"}, []string{"LOG_SINK=mongo"}},
+		{"opensearch sink with shadow", map[string]string{"LOG_SINK": "opensearch", "SHADOW_BACKEND_URL": "http://shadow"}, []string{"SHADOW_BACKEND_URL"}},
+		{"kafka sink with admin endpoints", map[string]string{"LOG_SINK": "kafka", "ADMIN_TOKEN": "t", "PPROF_ENABLED": "true"}, nil},
+		{"mongo sink with admin endpoints", map[string]string{"LOG_SINK": "mongo", "AUDIT_LOG": "false", "ADMIN_TOKEN": "t"}, []string{"LOG_SINK=mongo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"AUDIT_LOG": "", "SHADOW_BACKEND_URL": "", "ADMIN_TOKEN": ""}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			useConfig(t, env)
+			if got := mongoRequiredBy(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mongoRequiredBy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizedHeader(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"SANITIZE_HEADER": "true"}, nil)
+	resp, _ := p.post(t, "/public", `{"query":"{ a(x: \"<b>;\") }"}`, nil)
+	if v := resp.Header.Get("X-Query-Sanitized"); v != "true" {
+		t.Errorf("X-Query-Sanitized = %q for a changed query", v)
+	}
+	if v := resp.Header.Get("X-Query-Sanitized-Changes"); v != "3" {
+		t.Errorf("X-Query-Sanitized-Changes = %q, want 3", v)
+	}
+
+	resp, _ = p.post(t, "/public", `{"query":"{ a(x: \"b\") }"}`, nil)
+	if v := resp.Header.Get("X-Query-Sanitized"); v != "" {
+		t.Errorf("X-Query-Sanitized = %q for an unchanged query", v)
+	}
+	if v := resp.Header.Get("X-Query-Sanitized-Changes"); v != "" {
+		t.Errorf("X-Query-Sanitized-Changes = %q for an unchanged query", v)
+	}
+}
+
+func TestSanitizedHeaderDisabled(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"SANITIZE_HEADER": "false"}, nil)
+	resp, _ := p.post(t, "/public", `{"query":"{ a(x: \"<b>\") }"}`, nil)
+	if v := resp.Header.Get("X-Query-Sanitized"); v != "" {
+		t.Errorf("X-Query-Sanitized = %q with SANITIZE_HEADER=false", v)
+	}
+}
+
+func TestConfiguredMongoNames(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("inserts use MONGO_DB and MONGO_COLLECTION", func(mt *mtest.T) {
+		useConfig(mt.T, map[string]string{"MONGO_DB": "shop", "MONGO_COLLECTION": "requests", "AUDIT_COLLECTION": "rejections"})
+		useMockMongo(mt)
+		mongoConn.Store(newMongoHandles(mt.Client))
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := writeMongoBatch(context.Background(), []logEntry{{IP: "203.0.113.7"}}); err != nil {
+			mt.Fatal(err)
+		}
+		evt := mt.GetStartedEvent()
+		if evt.DatabaseName != "shop" || evt.Command.Lookup("insert").StringValue() != "requests" {
+			mt.Errorf("log insert went to %s.%s, want shop.requests", evt.DatabaseName, evt.Command.Lookup("insert").StringValue())
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := writeAuditBatch(context.Background(), []auditEntry{{IP: "203.0.113.7"}}); err != nil {
+			mt.Fatal(err)
+		}
+		evt = mt.GetStartedEvent()
+		if evt.DatabaseName != "shop" || evt.Command.Lookup("insert").StringValue() != "rejections" {
+			mt.Errorf("audit insert went to %s.%s, want shop.rejections", evt.DatabaseName, evt.Command.Lookup("insert").StringValue())
+		}
+	})
+}
+
+func TestValidateMongoNames(t *testing.T) {
+	tests := []struct {
+		db, coll string
+		valid    bool
+	}{
+		{"Middleware_Logs", "graphql_logs", true},
+		{"shop", "logs.v2", true},
+		{"", "graphql_logs", false},
+		{"  ", "graphql_logs", false},
+		{"my.db", "graphql_logs", false},
+		{"a/b", "graphql_logs", false},
+		{"Middleware_Logs", "", false},
+		{"Middleware_Logs", "logs$", false},
+		{"Middleware_Logs", "system.users", false},
+	}
+	for _, tt := range tests {
+		if err := validateMongoNames(tt.db, tt.coll); (err == nil) != tt.valid {
+			t.Errorf("validateMongoNames(%q, %q) = %v, want valid %v", tt.db, tt.coll, err, tt.valid)
+		}
+	}
+}
+
+func TestLogVariablesDisabled(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("variables are forwarded but not stored", func(mt *mtest.T) {
+		p := newTestProxy(mt.T, map[string]string{"LOG_VARIABLES": "false", "LOG_QUERY_SAMPLE_RATE": "1"}, nil)
+		resp, _ := p.post(mt.T, "/public", `{"query":"query Q($card: String) { pay(card: $card) }","variables":{"card":"4111111111111111"}}`, nil)
+		if resp.StatusCode != http.StatusOK {
+			mt.Fatalf("status = %d", resp.StatusCode)
+		}
+		if body := p.backend.last(mt.T).Body; !strings.Contains(body, `"card":"4111111111111111"`) {
+			mt.Errorf("forwarded body = %s, want the variables kept", body)
+		}
+		entry := p.lastLog(mt.T)
+		if entry.Variables != nil {
+			mt.Errorf("logged variables = %v", entry.Variables)
+		}
+		if !strings.Contains(entry.OriginalQuery, "pay(card: $card)") {
+			mt.Errorf("logged query = %q, want the query structure kept", entry.OriginalQuery)
+		}
+
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := writeMongoBatch(context.Background(), []logEntry{entry}); err != nil {
+			mt.Fatal(err)
+		}
+		doc := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		if _, err := doc.LookupErr("variables"); err == nil {
+			mt.Errorf("stored document has variables: %s", doc)
+		}
+		if strings.Contains(doc.String(), "4111111111111111") {
+			mt.Errorf("stored document contains the variable value: %s", doc)
+		}
+	})
+
+	mt.Run("variables are stored by default", func(mt *mtest.T) {
+		p := newTestProxy(mt.T, map[string]string{"LOG_VARIABLES": "", "LOG_QUERY_SAMPLE_RATE": "1"}, nil)
+		p.post(mt.T, "/public", `{"query":"query Q($n: Int) { a(n: $n) }","variables":{"n":3}}`, nil)
+		if v := p.lastLog(mt.T).Variables; v["n"] != float64(3) {
+			mt.Errorf("logged variables = %v", v)
+		}
+	})
+}
+
+func TestAdminListener(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"ADMIN_ADDR": "127.0.0.1:9090", "ADMIN_TOKEN": "secret", "PPROF_ENABLED": "true"}, nil)
+	public, adminMux := newMuxes()
+	admin := httptest.NewServer(adminMux)
+	t.Cleanup(admin.Close)
+	token := map[string]string{"Authorization": "Bearer secret"}
+
+	for _, path := range []string{"/metrics", "/admin/logs/memory", "/debug/pprof/"} {
+		if resp, _ := send(t, http.MethodGet, p.URL+path, "", token); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("public %s: status = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+		if resp, _ := send(t, http.MethodGet, admin.URL+path, "", token); resp.StatusCode != http.StatusOK {
+			t.Errorf("admin %s: status = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+	if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("public /public: status = %d", resp.StatusCode)
+	}
+	if _, body := send(t, http.MethodGet, admin.URL+"/metrics", "", nil); !strings.Contains(body, "graphql_stage_duration_seconds") {
+		t.Error("admin /metrics has no proxy metrics")
+	}
+	for _, path := range []string{"/public", "/healthz"} {
+		if resp, _ := send(t, http.MethodGet, admin.URL+path, "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("admin %s: status = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+	if public == adminMux {
+		t.Error("ADMIN_ADDR set but the admin endpoints share the public mux")
+	}
+}
+
+func TestSingleListener(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"ADMIN_ADDR": "", "RATE_LIMIT_PER_MINUTE": "1", "SCHEMA_ENDPOINT": "false"}, nil)
+	if mux, adminMux := newMuxes(); mux != adminMux {
+		t.Error("separate admin mux without ADMIN_ADDR")
+	}
+
+	p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("/public: status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	// Only the GraphQL routes are rate limited.
+	for i := 0; i < 3; i++ {
+		if resp, _ := send(t, http.MethodGet, p.URL+"/metrics", "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("/metrics %d: status = %d while /public is throttled", i+1, resp.StatusCode)
+		}
+	}
+	if resp, _ := send(t, http.MethodGet, p.URL+"/schema", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/schema with SCHEMA_ENDPOINT=false: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
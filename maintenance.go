@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var maintenanceMode atomic.Bool
+
+func setMaintenanceMode(enabled bool) {
+	if maintenanceMode.Swap(enabled) != enabled {
+		slog.Info("Maintenance mode changed", "enabled", enabled)
+	}
+}
+
+func writeMaintenanceResponse(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(cfg.MaintenanceRetryAfter.Seconds())))
+	writeError(w, http.StatusServiceUnavailable, "Service is under maintenance, please retry later")
+}
+
+// adminMaintenanceHandler reports the current mode on GET and sets it on POST
+// with ?enabled=true|false.
+func adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+			return
+		}
+		setMaintenanceMode(enabled)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"maintenance": maintenanceMode.Load()})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func useMaintenanceMode(t *testing.T, enabled bool) {
+	prev := maintenanceMode.Load()
+	t.Cleanup(func() { maintenanceMode.Store(prev) })
+	setMaintenanceMode(enabled)
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	body := `{"query":"{ a }"}`
+	p := newTestProxy(t, map[string]string{"MAINTENANCE_RETRY_AFTER": "90s"}, nil)
+
+	useMaintenanceMode(t, true)
+	resp, respBody := p.post(t, "/public", body, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "90" {
+		t.Errorf("Retry-After = %q, want 90", ra)
+	}
+	if msg := errorMessage(t, respBody); msg != "Service is under maintenance, please retry later" {
+		t.Errorf("message = %q", msg)
+	}
+	if n := len(p.backend.received()); n != 0 {
+		t.Errorf("backend received %d requests during maintenance", n)
+	}
+	if rec := serve(healthzHandler, http.MethodGet, "/healthz", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("/healthz during maintenance = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	setMaintenanceMode(false)
+	if resp, _ := p.post(t, "/public", body, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("status after maintenance = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if n := len(p.backend.received()); n != 1 {
+		t.Errorf("backend received %d requests, want 1", n)
+	}
+}
+
+func TestAdminMaintenanceHandler(t *testing.T) {
+	useConfig(t, nil)
+	useMaintenanceMode(t, false)
+
+	rec := serve(adminMaintenanceHandler, http.MethodPost, "/admin/maintenance?enabled=true", "", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"maintenance\":true}\n" {
+		t.Errorf("enable = %d %q", rec.Code, rec.Body)
+	}
+	if !maintenanceMode.Load() {
+		t.Error("maintenance mode not enabled")
+	}
+	if rec := serve(adminMaintenanceHandler, http.MethodPost, "/admin/maintenance?enabled=maybe", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad parameter = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := serve(adminMaintenanceHandler, http.MethodGet, "/admin/maintenance", "", nil); rec.Body.String() != "{\"maintenance\":true}\n" {
+		t.Errorf("GET = %q", rec.Body)
+	}
+	if rec := serve(adminMaintenanceHandler, http.MethodDelete, "/admin/maintenance", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// memorySink keeps the most recent entries in a fixed-size ring buffer. It is
+// the LOG_FALLBACK sink, so entries remain visible via /admin/logs/memory
+// when the configured sink could not be set up, and the sink in TEST_MODE.
+type memorySink struct {
+	mu      sync.Mutex
+	entries []logEntry
+	next    int
+	full    bool
+}
+
+func newMemorySink(size int) *memorySink {
+	return &memorySink{entries: make([]logEntry, max(size, 1))}
+}
+
+func (s *memorySink) Write(entry logEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[s.next] = entry
+	s.next = (s.next + 1) % len(s.entries)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// recent returns the buffered entries, newest first.
+func (s *memorySink) recent() []logEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.next
+	if s.full {
+		n = len(s.entries)
+	}
+	out := make([]logEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, s.entries[(s.next-i+len(s.entries))%len(s.entries)])
+	}
+	return out
+}
+
+func adminMemoryLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sink, ok := logSink.(*memorySink)
+	if !ok {
+		http.Error(w, "In-memory logging is not active", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sink.recent())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func useLogSink(t *testing.T) {
+	prev := logSink
+	t.Cleanup(func() { logSink = prev })
+}
+
+func TestLogFallbackToMemory(t *testing.T) {
+	for _, sink := range []string{"mongo", "kafka", "nope"} {
+		t.Run(sink, func(t *testing.T) {
+			useConfig(t, map[string]string{"LOG_SINK": sink, "KAFKA_BROKERS": "", "LOG_FALLBACK": "memory", "LOG_FALLBACK_SIZE": "2"})
+			prev := mongoConn.Swap(nil)
+			t.Cleanup(func() { mongoConn.Store(prev) })
+			useLogSink(t)
+			logSink = nil
+
+			initLogSink()
+			if _, ok := logSink.(*memorySink); !ok {
+				t.Fatalf("logSink = %T, want the memory fallback", logSink)
+			}
+			for _, op := range []string{"A", "B", "C"} {
+				writeLog(logEntry{OperationName: op})
+			}
+			rec := serve(adminMemoryLogsHandler, http.MethodGet, "/admin/logs/memory", "", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			var entries []logEntry
+			if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 || entries[0].OperationName != "C" || entries[1].OperationName != "B" {
+				t.Errorf("entries = %+v, want the newest two, newest first", entries)
+			}
+		})
+	}
+}
+
+func TestMemoryLogsHandlerWithoutFallback(t *testing.T) {
+	useLogSink(t)
+	logSink = &batchSink[logEntry]{name: "test", queue: make(chan logEntry, 1)}
+	if rec := serve(adminMemoryLogsHandler, http.MethodGet, "/admin/logs/memory", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := serve(adminMemoryLogsHandler, http.MethodPost, "/admin/logs/memory", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
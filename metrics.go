@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var slowQueriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "graphql_slow_queries_total",
+	Help: "Proxied requests that exceeded SLOW_QUERY_THRESHOLD.",
+})
+
+var inflightProxyRequests = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "proxy_inflight_requests",
+	Help: "Requests currently being proxied to a backend.",
+})
+
+var clientCanceledTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_client_canceled_total",
+	Help: "Proxied requests abandoned because the client disconnected.",
+})
+
+var responseTooLargeTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_response_too_large_total",
+	Help: "Backend responses rejected or aborted for exceeding MAX_RESPONSE_BYTES.",
+})
+
+var stageDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "graphql_stage_duration_seconds",
+	Help:    "Time spent in each stage of handling a GraphQL request.",
+	Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+}, []string{"stage"})
+
+var canaryRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_canary_requests_total",
+	Help: "Requests by whether they were sent to CANARY_BACKEND_URL.",
+}, []string{"canary"})
+
+var trackedIPsGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "rate_limit_tracked_ips",
+	Help: "Client IPs currently tracked by the rate limiter.",
+}, func() float64 {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	return float64(len(rateLimitStore))
+})
+
+var logQueueDepthGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "log_queue_depth",
+	Help: "Log entries waiting to be written by the log sink.",
+}, func() float64 {
+	return float64(logQueueLen())
+})
+
+var (
+	cacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_cache_hits_total",
+		Help: "Requests answered from a cache or a shared in-flight response.",
+	}, []string{"cache"})
+	cacheMissesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_cache_misses_total",
+		Help: "Requests that had to go to the backend.",
+	}, []string{"cache"})
+	coalescedRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "graphql_coalesced_requests_total",
+		Help: "Requests that shared another identical request's upstream call.",
+	})
+)
+
+// cacheStats counts hits and misses for one cache and exports the hit ratio.
+type cacheStats struct {
+	name   string
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newCacheStats(name string) *cacheStats {
+	s := &cacheStats{name: name}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "graphql_cache_hit_ratio",
+		Help:        "Fraction of lookups served without a backend call.",
+		ConstLabels: prometheus.Labels{"cache": name},
+	}, s.ratio)
+	return s
+}
+
+func (s *cacheStats) hit() {
+	s.hits.Add(1)
+	cacheHitsTotal.WithLabelValues(s.name).Inc()
+}
+
+func (s *cacheStats) miss() {
+	s.misses.Add(1)
+	cacheMissesTotal.WithLabelValues(s.name).Inc()
+}
+
+func (s *cacheStats) ratio() float64 {
+	hits, misses := s.hits.Load(), s.misses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
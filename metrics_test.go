@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSlowQueryLogging(t *testing.T) {
+	logs := captureLogs(t)
+	p := newTestProxy(t, map[string]string{"SLOW_QUERY_THRESHOLD": "20ms", "LOG_QUERY_SAMPLE_RATE": "0"}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Slow") != "" {
+			time.Sleep(40 * time.Millisecond)
+		}
+		w.Write([]byte(`{"data":{}}`))
+	})
+
+	before := testutil.ToFloat64(slowQueriesTotal)
+	p.post(t, "/public", `{"query":"query Fast { a }"}`, nil)
+	if _, ok := logs.find("Slow query"); ok {
+		t.Fatal("fast query logged as slow")
+	}
+	if got := testutil.ToFloat64(slowQueriesTotal) - before; got != 0 {
+		t.Errorf("slow queries = %v after a fast one", got)
+	}
+
+	p.post(t, "/public", `{"query":"query Slow { a }"}`, map[string]string{"X-Slow": "1"})
+	attrs, ok := logs.find("Slow query")
+	if !ok {
+		t.Fatal("slow query not logged")
+	}
+	if op := attrs["operation"].String(); op != "Slow" {
+		t.Errorf("operation = %q", op)
+	}
+	if d := attrs["duration"].Duration(); d < 20*time.Millisecond {
+		t.Errorf("duration = %v", d)
+	}
+	if attrs["request_id"].String() == "" {
+		t.Error("slow query log has no request_id")
+	}
+	if got := testutil.ToFloat64(slowQueriesTotal) - before; got != 1 {
+		t.Errorf("slow queries = %v, want 1", got)
+	}
+	// Slow queries keep their text even when sampling would drop it.
+	if q := p.lastLog(t).OriginalQuery; q != "query Slow { a }" {
+		t.Errorf("logged query = %q", q)
+	}
+}
+
+func TestOperationalGauges(t *testing.T) {
+	useConfig(t, nil)
+	resetRateLimits()
+	t.Cleanup(resetRateLimits)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		checkRateLimit(ip)
+	}
+	if got := testutil.ToFloat64(trackedIPsGauge); got != 3 {
+		t.Errorf("rate_limit_tracked_ips = %v, want 3", got)
+	}
+
+	release := make(chan struct{})
+	arrived := make(chan struct{})
+	p := newTestProxy(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+	})
+	before := testutil.ToFloat64(inflightProxyRequests)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Post(p.URL+"/public", "application/json", strings.NewReader(`{"query":"{ a }"}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-arrived
+	if got := testutil.ToFloat64(inflightProxyRequests); got != before+1 {
+		t.Errorf("proxy_inflight_requests = %v during a request, want %v", got, before+1)
+	}
+	close(release)
+	<-done
+	if got := testutil.ToFloat64(inflightProxyRequests); got != before {
+		t.Errorf("proxy_inflight_requests = %v after the request, want %v", got, before)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	// newCacheStats would register a second gauge under the same labels on
+	// repeated runs, so the exported ratio is checked on coalesceStats below.
+	s := &cacheStats{name: "test"}
+	if s.ratio() != 0 {
+		t.Errorf("ratio with no lookups = %v, want 0", s.ratio())
+	}
+	s.hit()
+	s.hit()
+	s.hit()
+	s.miss()
+
+	if s.ratio() != 0.75 {
+		t.Errorf("ratio = %v, want 0.75", s.ratio())
+	}
+	hits, misses := testutil.ToFloat64(cacheHitsTotal.WithLabelValues("test")), testutil.ToFloat64(cacheMissesTotal.WithLabelValues("test"))
+	if hits != 3 || misses != 1 {
+		t.Errorf("graphql_cache_hits_total = %v, graphql_cache_misses_total = %v; want 3 and 1", hits, misses)
+	}
+	cacheHitsTotal.DeleteLabelValues("test")
+	cacheMissesTotal.DeleteLabelValues("test")
+
+	coalesceStats.hit()
+	coalesceStats.miss()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ratio float64 = -1
+	for _, f := range families {
+		if f.GetName() != "graphql_cache_hit_ratio" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "cache" && l.GetValue() == "coalesce" {
+					ratio = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	if want := coalesceStats.ratio(); ratio != want {
+		t.Errorf("exported graphql_cache_hit_ratio = %v, want %v", ratio, want)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// mongoWriteSlots caps concurrent inserts at the pool size so a burst of
+// background writes queues here instead of exhausting the connection pool
+// the admin endpoints also rely on.
+var mongoWriteSlots chan struct{}
+
+var (
+	mongoPoolOpenGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_pool_connections_open",
+		Help: "Connections currently open in the MongoDB pool.",
+	})
+	mongoPoolInUseGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_pool_connections_in_use",
+		Help: "MongoDB pool connections currently checked out.",
+	})
+	mongoWritesInflightGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_writes_inflight",
+		Help: "MongoDB inserts currently holding a write slot.",
+	})
+)
+
+func mongoPoolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				mongoPoolOpenGauge.Inc()
+			case event.ConnectionClosed:
+				mongoPoolOpenGauge.Dec()
+			case event.GetSucceeded:
+				mongoPoolInUseGauge.Inc()
+			case event.ConnectionReturned:
+				mongoPoolInUseGauge.Dec()
+			}
+		},
+	}
+}
+
+// withMongoWriteSlot runs write once a write slot is free, giving up if ctx
+// ends first.
+func withMongoWriteSlot(ctx context.Context, write func() error) error {
+	select {
+	case mongoWriteSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	mongoWritesInflightGauge.Inc()
+	defer func() {
+		mongoWritesInflightGauge.Dec()
+		<-mongoWriteSlots
+	}()
+	return write()
+}
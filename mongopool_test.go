@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func useWriteSlots(t *testing.T, n int) {
+	prev := mongoWriteSlots
+	mongoWriteSlots = make(chan struct{}, n)
+	t.Cleanup(func() { mongoWriteSlots = prev })
+}
+
+func TestMongoWritesStayWithinBound(t *testing.T) {
+	const slots = 3
+	useWriteSlots(t, slots)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withMongoWriteSlot(context.Background(), func() error {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > slots {
+		t.Errorf("%d writes ran at once, want at most %d", p, slots)
+	}
+	if v := testutil.ToFloat64(mongoWritesInflightGauge); v != 0 {
+		t.Errorf("mongo_writes_inflight = %v after the burst", v)
+	}
+}
+
+func TestMongoWriteSlotGivesUp(t *testing.T) {
+	useWriteSlots(t, 1)
+	mongoWriteSlots <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	called := false
+	err := withMongoWriteSlot(ctx, func() error { called = true; return nil })
+	if !errors.Is(err, context.DeadlineExceeded) || called {
+		t.Errorf("withMongoWriteSlot with no free slot = %v, write called %v", err, called)
+	}
+}
+
+func TestMongoPoolMonitor(t *testing.T) {
+	open, inUse := testutil.ToFloat64(mongoPoolOpenGauge), testutil.ToFloat64(mongoPoolInUseGauge)
+	monitor := mongoPoolMonitor()
+	for _, typ := range []string{event.ConnectionCreated, event.ConnectionCreated, event.GetSucceeded, event.ConnectionClosed} {
+		monitor.Event(&event.PoolEvent{Type: typ})
+	}
+	if v := testutil.ToFloat64(mongoPoolOpenGauge) - open; v != 1 {
+		t.Errorf("open connections changed by %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(mongoPoolInUseGauge) - inUse; v != 1 {
+		t.Errorf("in-use connections changed by %v, want 1", v)
+	}
+	monitor.Event(&event.PoolEvent{Type: event.ConnectionReturned})
+	if v := testutil.ToFloat64(mongoPoolInUseGauge); v != inUse {
+		t.Errorf("in-use connections = %v after the return, want %v", v, inUse)
+	}
+	monitor.Event(&event.PoolEvent{Type: event.ConnectionClosed})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	mongoPingInterval     = 10 * time.Second
+	mongoFailureThreshold = 3
+	mongoMaxBackoff       = time.Minute
+)
+
+var mongoReconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "mongo_reconnects_total",
+	Help: "Times the MongoDB client was replaced after repeated failures.",
+})
+
+var (
+	mongoFailures        atomic.Int32
+	mongoReconnectNeeded = make(chan struct{}, 1)
+)
+
+// reportMongoResult feeds the outcome of a Mongo operation to the supervisor.
+// Only connection-level failures count; a rejected document says nothing
+// about the connection.
+func reportMongoResult(err error) {
+	if err == nil {
+		mongoFailures.Store(0)
+		return
+	}
+	if !mongo.IsNetworkError(err) && !mongo.IsTimeout(err) {
+		return
+	}
+	if mongoFailures.Add(1) >= mongoFailureThreshold {
+		select {
+		case mongoReconnectNeeded <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// superviseMongo pings the current client periodically and, after
+// mongoFailureThreshold consecutive connection failures from pings or writes,
+// replaces it with a new one. Writes keep using the old handles, and failing,
+// until the new client is up; nothing waits for the reconnect.
+func superviseMongo(uri string) {
+	ticker := time.NewTicker(mongoPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), logWriteTimeout)
+			reportMongoResult(mongoConn.Load().client.Ping(ctx, nil))
+			cancel()
+		case <-mongoReconnectNeeded:
+			reconnectMongo(func(ctx context.Context) (*mongoHandles, error) {
+				return connectMongo(ctx, uri)
+			})
+		}
+	}
+}
+
+// reconnectMongo retries connect with backoff until it succeeds, then swaps
+// the new handles in and disconnects the old client.
+func reconnectMongo(connect func(context.Context) (*mongoHandles, error)) {
+	backoff := time.Second
+	for {
+		slog.Warn("Reconnecting to MongoDB after repeated failures")
+		ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+		handles, err := connect(ctx)
+		cancel()
+		if err == nil {
+			old := mongoConn.Swap(handles)
+			go old.client.Disconnect(context.Background())
+			mongoFailures.Store(0)
+			select {
+			case <-mongoReconnectNeeded:
+			default:
+			}
+			mongoReconnectsTotal.Inc()
+			slog.Info("Reconnected to MongoDB")
+			return
+		}
+		slog.Error("MongoDB reconnect failed", "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, mongoMaxBackoff)
+	}
+}
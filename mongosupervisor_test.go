@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func resetMongoSupervisor(t *testing.T) {
+	reset := func() {
+		mongoFailures.Store(0)
+		select {
+		case <-mongoReconnectNeeded:
+		default:
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func networkErrorResponse() mtest.CommandError {
+	return mtest.CommandError{Code: 6, Message: "connection reset", Labels: []string{"NetworkError"}}
+}
+
+func TestReportMongoResult(t *testing.T) {
+	resetMongoSupervisor(t)
+	netErr := mongo.CommandError{Code: 6, Labels: []string{"NetworkError"}}
+
+	reportMongoResult(errors.New("document rejected"))
+	reportMongoResult(netErr)
+	reportMongoResult(netErr)
+	if len(mongoReconnectNeeded) != 0 {
+		t.Fatal("reconnect requested before the threshold")
+	}
+	reportMongoResult(nil)
+	for i := 0; i < mongoFailureThreshold-1; i++ {
+		reportMongoResult(netErr)
+	}
+	if len(mongoReconnectNeeded) != 0 {
+		t.Fatal("a success did not reset the failure count")
+	}
+	reportMongoResult(netErr)
+	reportMongoResult(netErr)
+	if len(mongoReconnectNeeded) != 1 {
+		t.Error("reconnect not requested after repeated network failures")
+	}
+}
+
+func TestMongoReconnectAfterDroppedConnection(t *testing.T) {
+	mt := newMockMongo(t)
+	mt.Run("writes resume on the new client", func(mt *mtest.T) {
+		useConfig(mt.T, map[string]string{"MONGO_COLLECTION": "recovered"})
+		useMockMongo(mt)
+		resetMongoSupervisor(mt.T)
+
+		// The old client is only disconnected; its writes go to the mock and
+		// fail as a dropped connection would.
+		dropped, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		mongoConn.Store(&mongoHandles{client: dropped, logs: mt.Coll})
+		for i := 0; i < mongoFailureThreshold; i++ {
+			mt.AddMockResponses(mtest.CreateCommandErrorResponse(networkErrorResponse()))
+			if err := writeMongoBatch(context.Background(), []logEntry{{IP: "203.0.113.7"}}); !mongo.IsNetworkError(err) {
+				mt.Fatalf("write %d: %v, want a network error", i+1, err)
+			}
+		}
+		if len(mongoReconnectNeeded) != 1 {
+			mt.Fatal("reconnect not requested")
+		}
+
+		reconnects := testutil.ToFloat64(mongoReconnectsTotal)
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			reconnectMongo(func(context.Context) (*mongoHandles, error) {
+				<-release
+				return newMongoHandles(mt.Client), nil
+			})
+		}()
+
+		// Writes carry on against the old handles while reconnecting.
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(networkErrorResponse()))
+		start := time.Now()
+		if err := writeMongoBatch(context.Background(), []logEntry{{IP: "203.0.113.7"}}); err == nil {
+			mt.Error("write on the dropped connection succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			mt.Errorf("write blocked for %v during the reconnect", elapsed)
+		}
+		close(release)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			mt.Fatal("reconnect did not finish")
+		}
+
+		if name := mongoConn.Load().logs.Name(); name != "recovered" {
+			mt.Errorf("logs collection after reconnect = %q", name)
+		}
+		if v := testutil.ToFloat64(mongoReconnectsTotal) - reconnects; v != 1 {
+			mt.Errorf("mongo_reconnects_total rose by %v, want 1", v)
+		}
+		if n, pending := mongoFailures.Load(), len(mongoReconnectNeeded); n != 0 || pending != 0 {
+			mt.Errorf("after reconnect: %d failures, %d pending reconnects", n, pending)
+		}
+
+		mt.ClearEvents()
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := writeMongoBatch(context.Background(), []logEntry{{IP: "203.0.113.7"}}); err != nil {
+			mt.Fatalf("write after reconnect: %v", err)
+		}
+		if coll := mt.GetStartedEvent().Command.Lookup("insert").StringValue(); coll != "recovered" {
+			mt.Errorf("write after reconnect went to %q", coll)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type openSearchSink struct {
+	url    string
+	client *http.Client
+}
+
+func newOpenSearchSink() (*batchSink[logEntry], error) {
+	if cfg.OpenSearchURL == "" {
+		return nil, errors.New("LOG_SINK=opensearch requires OPENSEARCH_URL")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.OpenSearchInsecure}
+	if cfg.OpenSearchCAFile != "" {
+		pem, err := os.ReadFile(cfg.OpenSearchCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading OPENSEARCH_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in OPENSEARCH_CA_FILE %s", cfg.OpenSearchCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	sink := &openSearchSink{
+		url:    strings.TrimSuffix(cfg.OpenSearchURL, "/") + "/_bulk",
+		client: &http.Client{Transport: transport},
+	}
+	return newBatchSink("opensearch", sink.bulkIndex), nil
+}
+
+// openSearchIndex returns the daily index for an entry, e.g.
+// graphql-logs-2024.01.02.
+func openSearchIndex(entry logEntry) string {
+	return cfg.OpenSearchIndex + "-" + entry.Timestamp.UTC().Format("2006.01.02")
+}
+
+// bulkBody encodes entries as the newline-delimited action/document pairs the
+// _bulk API expects.
+func bulkBody(entries []logEntry) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		action := map[string]map[string]string{"index": {"_index": openSearchIndex(entry)}}
+		if err := enc.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return &buf, nil
+}
+
+func (s *openSearchSink) bulkIndex(ctx context.Context, entries []logEntry) error {
+	body, err := bulkBody(entries)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if cfg.OpenSearchUsername != "" {
+		req.SetBasicAuth(cfg.OpenSearchUsername, cfg.OpenSearchPassword)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bulk request failed: %s: %s", resp.Status, msg)
+	}
+
+	// A 200 can still carry per-item failures.
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decoding bulk response: %w", err)
+	}
+	if result.Errors {
+		return fmt.Errorf("bulk request reported item errors")
+	}
+	return nil
+}
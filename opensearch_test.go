@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkIndexRequest(t *testing.T) {
+	useConfig(t, map[string]string{
+		"OPENSEARCH_INDEX":    "graphql-logs",
+		"OPENSEARCH_USERNAME": "proxy",
+		"OPENSEARCH_PASSWORD": "pw",
+	})
+	var body, contentType, user, pass string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, contentType = string(b), r.Header.Get("Content-Type")
+		user, pass, _ = r.BasicAuth()
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("path = %q, want /_bulk", r.URL.Path)
+		}
+		io.WriteString(w, `{"errors":false}`)
+	}))
+	defer srv.Close()
+
+	sink := &openSearchSink{url: srv.URL + "/_bulk", client: srv.Client()}
+	entries := []logEntry{
+		{IP: "203.0.113.7", Timestamp: time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)},
+		{IP: "198.51.100.1", Timestamp: time.Date(2024, 1, 3, 1, 0, 0, 0, time.UTC)},
+	}
+	if err := sink.bulkIndex(context.Background(), entries); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	if user != "proxy" || pass != "pw" {
+		t.Errorf("basic auth = %q:%q", user, pass)
+	}
+
+	var lines []string
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if len(lines) != 4 || !strings.HasSuffix(body, "\n") {
+		t.Fatalf("bulk body = %q, want 4 newline-terminated lines", body)
+	}
+	for i, wantIndex := range []string{"graphql-logs-2024.01.02", "graphql-logs-2024.01.03"} {
+		var action map[string]map[string]string
+		if err := json.Unmarshal([]byte(lines[2*i]), &action); err != nil {
+			t.Fatal(err)
+		}
+		if got := action["index"]["_index"]; got != wantIndex {
+			t.Errorf("entry %d index = %q, want %q", i, got, wantIndex)
+		}
+		var doc logEntry
+		if err := json.Unmarshal([]byte(lines[2*i+1]), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.IP != entries[i].IP {
+			t.Errorf("entry %d document ip = %q, want %q", i, doc.IP, entries[i].IP)
+		}
+	}
+}
+
+func TestBulkIndexFailures(t *testing.T) {
+	useConfig(t, nil)
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"http error", http.StatusServiceUnavailable, "unavailable"},
+		{"item errors", http.StatusOK, `{"errors":true}`},
+		{"undecodable response", http.StatusOK, "not json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+			sink := &openSearchSink{url: srv.URL + "/_bulk", client: srv.Client()}
+			if err := sink.bulkIndex(context.Background(), []logEntry{{IP: "203.0.113.7"}}); err == nil {
+				t.Error("bulkIndex succeeded")
+			}
+		})
+	}
+}
+
+func TestNewOpenSearchSinkRequiresURL(t *testing.T) {
+	useConfig(t, map[string]string{"OPENSEARCH_URL": ""})
+	if _, err := newOpenSearchSink(); err == nil {
+		t.Error("newOpenSearchSink without OPENSEARCH_URL succeeded")
+	}
+}
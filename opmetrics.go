@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	operationRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_operation_requests_total",
+		Help: "Proxied requests by operation name, capped at METRICS_MAX_OPERATIONS names.",
+	}, []string{"operation"})
+	operationDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_operation_duration_seconds",
+		Help:    "Time to proxy a request by operation name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	operationSLOViolationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_operation_slo_violations_total",
+		Help: "Proxied requests slower than their OPERATION_SLOS target, by operation name.",
+	}, []string{"operation"})
+)
+
+const (
+	otherOperationLabel     = "other"
+	anonymousOperationLabel = "anonymous"
+)
+
+// operationLabels bounds the operation names used as metric labels, since
+// clients choose them freely. Up to METRICS_MAX_OPERATIONS names are tracked,
+// most recently seen first; once full, new names are counted as "other"
+// until a tracked name has been idle for METRICS_OPERATION_IDLE and is
+// evicted along with its series.
+var operationLabels = struct {
+	sync.Mutex
+	byName map[string]*list.Element
+	lru    *list.List // of *trackedOperation
+}{byName: make(map[string]*list.Element), lru: list.New()}
+
+type trackedOperation struct {
+	name     string
+	lastSeen time.Time
+}
+
+func operationLabel(name string) string {
+	if name == "" {
+		return anonymousOperationLabel
+	}
+	ops := &operationLabels
+	ops.Lock()
+	defer ops.Unlock()
+
+	now := time.Now()
+	if elem, ok := ops.byName[name]; ok {
+		elem.Value.(*trackedOperation).lastSeen = now
+		ops.lru.MoveToFront(elem)
+		return name
+	}
+	if ops.lru.Len() >= cfg.MetricsMaxOperations {
+		oldest := ops.lru.Back()
+		if oldest == nil || now.Sub(oldest.Value.(*trackedOperation).lastSeen) < cfg.MetricsOperationIdle {
+			return otherOperationLabel
+		}
+		evicted := ops.lru.Remove(oldest).(*trackedOperation).name
+		delete(ops.byName, evicted)
+		operationRequestsTotal.DeleteLabelValues(evicted)
+		operationDurationSeconds.DeleteLabelValues(evicted)
+		operationSLOViolationsTotal.DeleteLabelValues(evicted)
+	}
+	ops.byName[name] = ops.lru.PushFront(&trackedOperation{name: name, lastSeen: now})
+	return name
+}
+
+func observeOperation(name string, elapsed time.Duration) {
+	label := operationLabel(name)
+	operationRequestsTotal.WithLabelValues(label).Inc()
+	operationDurationSeconds.WithLabelValues(label).Observe(elapsed.Seconds())
+	if target, ok := cfg.OperationSLOs[name]; ok && elapsed > target {
+		operationSLOViolationsTotal.WithLabelValues(label).Inc()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func resetOperationLabels(t *testing.T) {
+	reset := func() {
+		operationLabels.Lock()
+		operationLabels.byName = make(map[string]*list.Element)
+		operationLabels.lru = list.New()
+		operationLabels.Unlock()
+		operationRequestsTotal.Reset()
+		operationDurationSeconds.Reset()
+		operationSLOViolationsTotal.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestOperationLabelsAreCapped(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"METRICS_MAX_OPERATIONS": "2", "METRICS_OPERATION_IDLE": "1h"}, nil)
+	resetOperationLabels(t)
+	for _, op := range []string{"A", "B", "C", "D", "A"} {
+		p.post(t, "/public", `{"query":"query `+op+` { a }"}`, nil)
+	}
+	p.post(t, "/public", `{"query":"{ a }"}`, nil)
+
+	if n := testutil.CollectAndCount(operationRequestsTotal); n != 4 {
+		t.Errorf("%d operation series, want A, B, other and anonymous", n)
+	}
+	for label, want := range map[string]float64{"A": 2, "B": 1, otherOperationLabel: 2, anonymousOperationLabel: 1} {
+		if v := testutil.ToFloat64(operationRequestsTotal.WithLabelValues(label)); v != want {
+			t.Errorf("graphql_operation_requests_total{operation=%q} = %v, want %v", label, v, want)
+		}
+	}
+}
+
+func TestIdleOperationLabelIsEvicted(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"METRICS_MAX_OPERATIONS": "2", "METRICS_OPERATION_IDLE": "1m"}, nil)
+	resetOperationLabels(t)
+	for _, op := range []string{"A", "B"} {
+		p.post(t, "/public", `{"query":"query `+op+` { a }"}`, nil)
+	}
+	operationLabels.Lock()
+	operationLabels.byName["A"].Value.(*trackedOperation).lastSeen = time.Now().Add(-2 * time.Minute)
+	operationLabels.Unlock()
+
+	p.post(t, "/public", `{"query":"query C { a }"}`, nil)
+	if got := operationLabel("C"); got != "C" {
+		t.Errorf("new name after an idle eviction counted as %q", got)
+	}
+	if got := operationLabel("A"); got != otherOperationLabel {
+		t.Errorf("evicted name counted as %q, want %q while the set is full", got, otherOperationLabel)
+	}
+	if n := testutil.CollectAndCount(operationRequestsTotal); n != 2 {
+		t.Errorf("%d operation series, want the idle name's series deleted", n)
+	}
+}
+
+func TestOperationSLOViolations(t *testing.T) {
+	useConfig(t, map[string]string{"METRICS_MAX_OPERATIONS": "10", "OPERATION_SLOS": "Slow=10ms"})
+	resetOperationLabels(t)
+	observeOperation("Slow", 5*time.Millisecond)
+	observeOperation("Slow", 50*time.Millisecond)
+	observeOperation("Other", time.Second)
+	if v := testutil.ToFloat64(operationSLOViolationsTotal.WithLabelValues("Slow")); v != 1 {
+		t.Errorf("violations for Slow = %v, want 1", v)
+	}
+	if n := testutil.CollectAndCount(operationSLOViolationsTotal); n != 1 {
+		t.Errorf("%d violation series, want only operations with an SLO", n)
+	}
+}
+
+func TestOperationSLOViolationsWithSlowBackend(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"METRICS_MAX_OPERATIONS": "10", "OPERATION_SLOS": "Checkout=20ms,Browse=1s"}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Slow") != "" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte(`{"data":{}}`))
+	})
+	resetOperationLabels(t)
+
+	p.post(t, "/public", `{"query":"query Checkout { a }"}`, nil)
+	if v := testutil.ToFloat64(operationSLOViolationsTotal.WithLabelValues("Checkout")); v != 0 {
+		t.Errorf("violations for a fast Checkout = %v, want 0", v)
+	}
+	for i := 0; i < 2; i++ {
+		p.post(t, "/public", `{"query":"query Checkout { a }"}`, map[string]string{"X-Slow": "1"})
+	}
+	p.post(t, "/public", `{"query":"query Browse { a }"}`, map[string]string{"X-Slow": "1"})
+	p.post(t, "/public", `{"query":"query Untracked { a }"}`, map[string]string{"X-Slow": "1"})
+
+	if v := testutil.ToFloat64(operationSLOViolationsTotal.WithLabelValues("Checkout")); v != 2 {
+		t.Errorf("violations for slow Checkouts = %v, want 2", v)
+	}
+	if n := testutil.CollectAndCount(operationSLOViolationsTotal); n != 1 {
+		t.Errorf("%d violation series, want only Checkout", n)
+	}
+	if v := testutil.ToFloat64(operationRequestsTotal.WithLabelValues("Checkout")); v != 3 {
+		t.Errorf("Checkout requests = %v, want 3", v)
+	}
+}
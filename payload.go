@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var errJSONTooDeep = errors.New("JSON nesting too deep")
+
+// checkJSONDepth walks the document token by token so an over-deep payload is
+// rejected without ever being materialized. Malformed JSON is not reported
+// here; the regular decode handles that.
+func checkJSONDepth(data []byte, maxDepth int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// io.EOF or a syntax error; either way depth was within bounds.
+			return nil
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxDepth {
+				return fmt.Errorf("%w: exceeds %d levels", errJSONTooDeep, maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// checkVariableLimits enforces MAX_VARIABLES on the top-level variable count,
+// MAX_VARIABLE_KEY_LENGTH on every key, including nested input objects, and
+// the array length limits.
+func checkVariableLimits(variables map[string]interface{}) error {
+	if cfg.MaxVariables > 0 && len(variables) > cfg.MaxVariables {
+		return fmt.Errorf("too many variables: %d exceeds limit of %d", len(variables), cfg.MaxVariables)
+	}
+	if cfg.MaxVariableKeyLength > 0 {
+		if err := checkKeyLengths(variables, cfg.MaxVariableKeyLength); err != nil {
+			return err
+		}
+	}
+	return checkArrayLengths(variables)
+}
+
+// checkArrayLengths limits each array in a variable, at any depth, to
+// VARIABLE_ARRAY_LIMITS for that variable or else MAX_VARIABLE_ARRAY_LENGTH,
+// and the elements of all arrays together to MAX_VARIABLE_ARRAY_TOTAL.
+func checkArrayLengths(variables map[string]interface{}) error {
+	if cfg.MaxVariableArrayLength <= 0 && cfg.MaxVariableArrayTotal <= 0 && len(cfg.VariableArrayLimits) == 0 {
+		return nil
+	}
+	total := 0
+	var walk func(name string, node interface{}, limit int) error
+	walk = func(name string, node interface{}, limit int) error {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			for _, child := range v {
+				if err := walk(name, child, limit); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			if limit > 0 && len(v) > limit {
+				return fmt.Errorf("array in variable %q too long: %d items exceeds limit of %d", name, len(v), limit)
+			}
+			total += len(v)
+			if cfg.MaxVariableArrayTotal > 0 && total > cfg.MaxVariableArrayTotal {
+				return fmt.Errorf("too many array items in variables: exceeds limit of %d", cfg.MaxVariableArrayTotal)
+			}
+			for _, item := range v {
+				if err := walk(name, item, limit); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for name, value := range variables {
+		limit, ok := cfg.VariableArrayLimits[name]
+		if !ok {
+			limit = cfg.MaxVariableArrayLength
+		}
+		if err := walk(name, value, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkKeyLengths(node interface{}, maxLen int) error {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if len(key) > maxLen {
+				return fmt.Errorf("variable key too long: %d characters exceeds limit of %d", len(key), maxLen)
+			}
+			if err := checkKeyLengths(child, maxLen); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := checkKeyLengths(item, maxLen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasPersistedQuery reports whether the payload names a persisted query in
+// extensions.persistedQuery.
+func hasPersistedQuery(payload map[string]interface{}) bool {
+	extensions, _ := payload["extensions"].(map[string]interface{})
+	_, ok := extensions["persistedQuery"].(map[string]interface{})
+	return ok
+}
+
+// rawGraphQLPayload wraps an application/graphql body into the JSON request
+// shape. operationName, variables and extensions may be supplied as URL
+// parameters since the body carries nothing but the query text; extensions is
+// how a GET persisted query sends its hash. Those parameters are held to
+// MAX_JSON_DEPTH like a JSON body.
+func rawGraphQLPayload(body []byte, params url.Values) (map[string]interface{}, error) {
+	payload := map[string]interface{}{"query": string(body)}
+	if name := params.Get("operationName"); name != "" {
+		payload["operationName"] = name
+	}
+	for _, key := range []string{"variables", "extensions"} {
+		raw := params.Get(key)
+		if raw == "" {
+			continue
+		}
+		if cfg.MaxJSONDepth > 0 {
+			if err := checkJSONDepth([]byte(raw), cfg.MaxJSONDepth); err != nil {
+				return nil, err
+			}
+		}
+		var value map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &value); err == nil {
+			payload[key] = value
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRawGraphQLPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		params url.Values
+		want   map[string]interface{}
+	}{
+		{"query only", nil, map[string]interface{}{"query": "{ a }"}},
+		{
+			"operationName and variables from parameters",
+			url.Values{"operationName": {"Q"}, "variables": {`{"id":"7"}`}},
+			map[string]interface{}{"query": "{ a }", "operationName": "Q", "variables": map[string]interface{}{"id": "7"}},
+		},
+		{
+			"extensions from parameters",
+			url.Values{"extensions": {`{"persistedQuery":{"version":1}}`}},
+			map[string]interface{}{"query": "{ a }", "extensions": map[string]interface{}{"persistedQuery": map[string]interface{}{"version": float64(1)}}},
+		},
+		{
+			"malformed variables are dropped",
+			url.Values{"variables": {`{"id":`}},
+			map[string]interface{}{"query": "{ a }"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rawGraphQLPayload([]byte("{ a }"), tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rawGraphQLPayload = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckJSONDepth(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		depth int
+		ok    bool
+	}{
+		{"flat", `{"query":"{ a }"}`, 1, true},
+		{"at the limit", `{"variables":{"a":[1]}}`, 3, true},
+		{"over the limit", `{"variables":{"a":[1]}}`, 2, false},
+		{"arrays count", `[[[[]]]]`, 3, false},
+		{"siblings do not add up", `{"a":{"b":1},"c":{"d":1},"e":[1,2]}`, 2, true},
+		{"brackets in strings are ignored", `{"query":"{{{{[[[["}`, 1, true},
+		{"malformed is left to the decoder", `{"a":{"b":`, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSONDepth([]byte(tt.json), tt.depth)
+			if (err == nil) != tt.ok {
+				t.Errorf("checkJSONDepth = %v, want ok = %v", err, tt.ok)
+			}
+			if err != nil && !errors.Is(err, errJSONTooDeep) {
+				t.Errorf("error %v is not errJSONTooDeep", err)
+			}
+		})
+	}
+}
+
+func TestCheckVariableLimits(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_VARIABLES": "2", "MAX_VARIABLE_KEY_LENGTH": "5"})
+	tests := []struct {
+		name      string
+		variables map[string]interface{}
+		ok        bool
+	}{
+		{"within limits", map[string]interface{}{"a": 1, "bb": "x"}, true},
+		{"no variables", nil, true},
+		{"too many keys", map[string]interface{}{"a": 1, "b": 2, "c": 3}, false},
+		{"long top-level key", map[string]interface{}{"toolong": 1}, false},
+		{"long nested key", map[string]interface{}{"in": map[string]interface{}{"toolong": 1}}, false},
+		{"long key in a list", map[string]interface{}{"in": []interface{}{map[string]interface{}{"toolong": 1}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkVariableLimits(tt.variables); (err == nil) != tt.ok {
+				t.Errorf("checkVariableLimits = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckArrayLengths(t *testing.T) {
+	useConfig(t, map[string]string{"MAX_VARIABLE_ARRAY_LENGTH": "3", "MAX_VARIABLE_ARRAY_TOTAL": "6", "VARIABLE_ARRAY_LIMITS": "ids=5"})
+	list := func(n int) []interface{} { return make([]interface{}, n) }
+	tests := []struct {
+		name      string
+		variables map[string]interface{}
+		ok        bool
+	}{
+		{"short arrays", map[string]interface{}{"tags": list(3), "ids": list(2)}, true},
+		{"per-key limit raises the default", map[string]interface{}{"ids": list(5)}, true},
+		{"over the per-key limit", map[string]interface{}{"ids": list(6)}, false},
+		{"over the default limit", map[string]interface{}{"tags": list(4)}, false},
+		{"nested array over the limit", map[string]interface{}{"filter": map[string]interface{}{"tags": list(4)}}, false},
+		{"array in an array over the limit", map[string]interface{}{"tags": []interface{}{list(4)}}, false},
+		{"total over the limit", map[string]interface{}{"a": list(3), "b": list(3), "c": list(1)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkVariableLimits(tt.variables); (err == nil) != tt.ok {
+				t.Errorf("checkVariableLimits = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitWindow = time.Minute
+
+const loadTestHeader = "X-Load-Test"
+
+// startedAt anchors RATE_LIMIT_WARMUP.
+var startedAt = time.Now()
+
+// perMinuteLimit is RATE_LIMIT_PER_MINUTE, raised during the warm-up after
+// startup so clients retrying after a deploy aren't throttled all at once.
+// The limit starts at RATE_LIMIT_WARMUP_MULTIPLIER times the normal one and
+// eases back linearly over RATE_LIMIT_WARMUP.
+func perMinuteLimit(now time.Time) int {
+	since := now.Sub(startedAt)
+	if cfg.RateLimitWarmup <= 0 || since >= cfg.RateLimitWarmup || cfg.RateLimitWarmupMultiplier <= 1 {
+		return cfg.RateLimitPerMinute
+	}
+	remaining := 1 - float64(since)/float64(cfg.RateLimitWarmup)
+	boost := 1 + (cfg.RateLimitWarmupMultiplier-1)*remaining
+	return int(math.Round(float64(cfg.RateLimitPerMinute) * boost))
+}
+
+// rateLimitEntry tracks an IP's requests in the minute window and, separately,
+// its count for the current UTC day, which isn't affected by window pruning.
+// opRequests holds the windows for operations with their own limit. offenses
+// counts violations for RATE_LIMIT_PENALTY since the IP was last quiet.
+type rateLimitEntry struct {
+	ip           string
+	requests     []time.Time
+	day          time.Time
+	dayCount     int
+	opRequests   map[string][]time.Time
+	offenses     int
+	lastOffense  time.Time
+	blockedUntil time.Time
+}
+
+// rateLimitStore indexes into rateLimitLRU, which is ordered from most to
+// least recently seen so the oldest IPs can be evicted once the cap is hit.
+var (
+	rateLimitMu    sync.Mutex
+	rateLimitStore = make(map[string]*list.Element)
+	rateLimitLRU   = list.New()
+)
+
+type rateLimitResult struct {
+	limited       bool
+	quotaExceeded bool
+	penalized     bool
+	limit         int
+	remaining     int
+	reset         time.Time
+}
+
+// checkRateLimit records a request for ip unless it is over the limit, and
+// reports the remaining quota and when the oldest request leaves the window.
+func checkRateLimit(ip string) rateLimitResult {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	now := time.Now()
+	entry := touchRateLimitEntry(ip)
+
+	if cfg.RateLimitPenalty > 0 {
+		if entry.offenses > 0 && now.Sub(entry.lastOffense) > cfg.RateLimitPenaltyReset {
+			entry.offenses = 0
+		}
+		if now.Before(entry.blockedUntil) {
+			return penalize(entry, now)
+		}
+	}
+
+	// Remove timestamps outside the current window
+	var recentRequests []time.Time
+	for _, t := range entry.requests {
+		if now.Sub(t) <= rateLimitWindow {
+			recentRequests = append(recentRequests, t)
+		}
+	}
+
+	// Update the entry with only recent requests
+	entry.requests = recentRequests
+
+	// Check if the IP exceeded the limit
+	limit := perMinuteLimit(now)
+	if len(recentRequests) >= limit {
+		if cfg.RateLimitPenalty > 0 {
+			return penalize(entry, now)
+		}
+		return rateLimitResult{limited: true, limit: limit, reset: recentRequests[0].Add(rateLimitWindow)}
+	}
+
+	if cfg.DailyQuota > 0 {
+		today := now.UTC().Truncate(24 * time.Hour)
+		if !entry.day.Equal(today) {
+			entry.day = today
+			entry.dayCount = 0
+		}
+		if entry.dayCount >= cfg.DailyQuota {
+			return rateLimitResult{limited: true, quotaExceeded: true, limit: limit, reset: today.Add(24 * time.Hour)}
+		}
+		entry.dayCount++
+	}
+
+	// Add this request timestamp
+	entry.requests = append(entry.requests, now)
+	return rateLimitResult{
+		limit:     limit,
+		remaining: limit - len(entry.requests),
+		reset:     entry.requests[0].Add(rateLimitWindow),
+	}
+}
+
+// penalize records an offense and blocks the IP for RATE_LIMIT_PENALTY,
+// doubled for each earlier offense and capped at RATE_LIMIT_PENALTY_MAX.
+// Requests made while blocked are offenses too, so a client that keeps
+// hammering stays blocked for longer and longer. rateLimitMu must be held.
+func penalize(entry *rateLimitEntry, now time.Time) rateLimitResult {
+	entry.offenses++
+	entry.lastOffense = now
+	block := cfg.RateLimitPenaltyMax
+	if entry.offenses <= 32 {
+		block = min(cfg.RateLimitPenalty<<(entry.offenses-1), cfg.RateLimitPenaltyMax)
+	}
+	// A shift that overflows goes negative.
+	if block <= 0 {
+		block = cfg.RateLimitPenaltyMax
+	}
+	entry.blockedUntil = now.Add(block)
+	return rateLimitResult{limited: true, penalized: true, limit: perMinuteLimit(now), reset: entry.blockedUntil}
+}
+
+// checkOperationRateLimit applies an operation's own per-minute limit for ip,
+// on top of the global limit already checked by checkRateLimit.
+func checkOperationRateLimit(ip, operationName string, limit int) rateLimitResult {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	now := time.Now()
+	entry := touchRateLimitEntry(ip)
+	if entry.opRequests == nil {
+		entry.opRequests = make(map[string][]time.Time)
+	}
+
+	var recent []time.Time
+	for _, t := range entry.opRequests[operationName] {
+		if now.Sub(t) <= rateLimitWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= limit {
+		entry.opRequests[operationName] = recent
+		return rateLimitResult{limited: true, limit: limit, reset: recent[0].Add(rateLimitWindow)}
+	}
+	recent = append(recent, now)
+	entry.opRequests[operationName] = recent
+	return rateLimitResult{limit: limit, remaining: limit - len(recent), reset: recent[0].Add(rateLimitWindow)}
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, result rateLimitResult) {
+	resetSeconds := int(math.Ceil(time.Until(result.reset).Seconds()))
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(max(resetSeconds, 0)))
+}
+
+// touchRateLimitEntry returns the entry for ip, marking it most recently seen
+// and evicting the least recently seen IPs beyond cfg.MaxTrackedIPs.
+// rateLimitMu must be held.
+func touchRateLimitEntry(ip string) *rateLimitEntry {
+	if elem, ok := rateLimitStore[ip]; ok {
+		rateLimitLRU.MoveToFront(elem)
+		return elem.Value.(*rateLimitEntry)
+	}
+
+	entry := &rateLimitEntry{ip: ip}
+	rateLimitStore[ip] = rateLimitLRU.PushFront(entry)
+
+	for cfg.MaxTrackedIPs > 0 && rateLimitLRU.Len() > cfg.MaxTrackedIPs {
+		oldest := rateLimitLRU.Back()
+		rateLimitLRU.Remove(oldest)
+		delete(rateLimitStore, oldest.Value.(*rateLimitEntry).ip)
+	}
+	return entry
+}
+
+// rateLimitExempt reports whether path is in RATE_LIMIT_EXEMPT_PATHS, a list
+// of GraphQL routes exempt from both the global and the per-operation limits.
+// Only the GraphQL routes are rate limited at all, so /metrics, the probes and
+// the admin endpoints never are and need no entry.
+func rateLimitExempt(path string) bool {
+	return slices.Contains(cfg.RateLimitExemptPaths, path)
+}
+
+// isLoadTestRequest reports whether the request carries the configured
+// load-test token and should skip rate limiting.
+func isLoadTestRequest(r *http.Request) bool {
+	if cfg.LoadTestToken == "" {
+		return false
+	}
+	token := r.Header.Get(loadTestHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.LoadTestToken)) == 1
+}
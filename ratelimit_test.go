@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitEvictsLeastRecentlySeenIPs(t *testing.T) {
+	useConfig(t, map[string]string{"RATE_LIMIT_MAX_IPS": "3", "RATE_LIMIT_PER_MINUTE": "2"})
+	resetRateLimits()
+	t.Cleanup(resetRateLimits)
+
+	for i := 1; i <= 3; i++ {
+		checkRateLimit(fmt.Sprintf("10.0.0.%d", i))
+	}
+	// 10.0.0.1 is used up and touched again, so 10.0.0.2 is now the oldest.
+	checkRateLimit("10.0.0.1")
+	checkRateLimit("10.0.0.4")
+
+	rateLimitMu.Lock()
+	tracked := len(rateLimitStore)
+	_, kept := rateLimitStore["10.0.0.1"]
+	_, stale := rateLimitStore["10.0.0.2"]
+	rateLimitMu.Unlock()
+	if tracked != 3 {
+		t.Errorf("tracked IPs = %d, want 3", tracked)
+	}
+	if !kept || stale {
+		t.Errorf("10.0.0.1 tracked = %v, 10.0.0.2 tracked = %v; want only the least recently seen evicted", kept, stale)
+	}
+	if !checkRateLimit("10.0.0.1").limited {
+		t.Error("a recently seen IP lost its request history")
+	}
+	if checkRateLimit("10.0.0.2").limited {
+		t.Error("an evicted IP should start with a fresh window")
+	}
+}
+
+func TestRateLimitUnboundedWhenCapIsZero(t *testing.T) {
+	useConfig(t, map[string]string{"RATE_LIMIT_MAX_IPS": "0"})
+	resetRateLimits()
+	t.Cleanup(resetRateLimits)
+
+	for i := 0; i < 50; i++ {
+		checkRateLimit(fmt.Sprintf("10.0.1.%d", i))
+	}
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	if len(rateLimitStore) != 50 || rateLimitLRU.Len() != 50 {
+		t.Errorf("tracked = %d, lru = %d; want 50", len(rateLimitStore), rateLimitLRU.Len())
+	}
+}
+
+func TestLoadTestTokenBypassesRateLimit(t *testing.T) {
+	body := `{"query":"{ a }"}`
+	t.Run("valid token", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "1", "LOAD_TEST_TOKEN": "tok"}, nil)
+		for i := 0; i < 3; i++ {
+			if resp, _ := p.post(t, "/public", body, map[string]string{loadTestHeader: "tok"}); resp.StatusCode != http.StatusOK {
+				t.Fatalf("request %d: status = %d", i, resp.StatusCode)
+			}
+		}
+		if h := p.backend.last(t).Header.Get(loadTestHeader); h != "" {
+			t.Errorf("token forwarded upstream: %q", h)
+		}
+		if !p.lastLog(t).LoadTest {
+			t.Error("entry not marked as load test")
+		}
+		// Load-test traffic does not use up the client's budget.
+		if resp, _ := p.post(t, "/public", body, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("ordinary request after load test: status = %d", resp.StatusCode)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		sent  string
+	}{
+		{"wrong token", "tok", "nope"},
+		{"no token configured", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "1", "LOAD_TEST_TOKEN": tt.token}, nil)
+			p.post(t, "/public", body, map[string]string{loadTestHeader: tt.sent})
+			resp, _ := p.post(t, "/public", body, map[string]string{loadTestHeader: tt.sent})
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+			}
+			if h := p.backend.last(t).Header.Get(loadTestHeader); h != "" {
+				t.Errorf("header forwarded upstream: %q", h)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	body := `{"query":"{ a }"}`
+	p := newTestProxy(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "3", "RATE_LIMIT_HEADERS": "true"}, nil)
+	for i, want := range []string{"2", "1", "0"} {
+		resp, _ := p.post(t, "/public", body, nil)
+		if got := resp.Header.Get("X-RateLimit-Remaining"); got != want {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i+1, got, want)
+		}
+		if got := resp.Header.Get("X-RateLimit-Limit"); got != "3" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q, want 3", i+1, got)
+		}
+		if reset, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Reset")); err != nil || reset < 59 || reset > 60 {
+			t.Errorf("request %d: X-RateLimit-Reset = %q, want about 60", i+1, resp.Header.Get("X-RateLimit-Reset"))
+		}
+	}
+	resp, _ := p.post(t, "/public", body, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("over the limit: status = %d, remaining = %q", resp.StatusCode, resp.Header.Get("X-RateLimit-Remaining"))
+	}
+
+	// Age the recorded requests out of the window.
+	rateLimitMu.Lock()
+	for _, elem := range rateLimitStore {
+		entry := elem.Value.(*rateLimitEntry)
+		for i := range entry.requests {
+			entry.requests[i] = entry.requests[i].Add(-2 * rateLimitWindow)
+		}
+	}
+	rateLimitMu.Unlock()
+	resp, _ = p.post(t, "/public", body, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("after the window: status = %d, remaining = %q", resp.StatusCode, resp.Header.Get("X-RateLimit-Remaining"))
+	}
+}
+
+func TestRateLimitHeadersDisabled(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"RATE_LIMIT_HEADERS": "false"}, nil)
+	resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	for _, h := range []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+		if v := resp.Header.Get(h); v != "" {
+			t.Errorf("%s = %q with RATE_LIMIT_HEADERS=false", h, v)
+		}
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	useConfig(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "2", "RATE_LIMIT_DAILY_QUOTA": "3"})
+	resetRateLimits()
+	t.Cleanup(resetRateLimits)
+
+	// ageWindow moves the IP's minute window into the past so only the
+	// daily count carries over, as if the client paced itself.
+	ageWindow := func() {
+		rateLimitMu.Lock()
+		defer rateLimitMu.Unlock()
+		entry := rateLimitStore["10.0.0.1"].Value.(*rateLimitEntry)
+		for i := range entry.requests {
+			entry.requests[i] = entry.requests[i].Add(-2 * rateLimitWindow)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if res := checkRateLimit("10.0.0.1"); res.limited {
+			t.Fatalf("request %d limited: %+v", i+1, res)
+		}
+		ageWindow()
+	}
+	res := checkRateLimit("10.0.0.1")
+	if !res.limited || !res.quotaExceeded {
+		t.Fatalf("over the daily quota: %+v", res)
+	}
+	if want := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour); !res.reset.Equal(want) {
+		t.Errorf("reset = %s, want the next UTC midnight %s", res.reset, want)
+	}
+	if checkRateLimit("10.0.0.2").limited {
+		t.Error("the quota is per IP")
+	}
+
+	// A new day starts a fresh count.
+	rateLimitMu.Lock()
+	rateLimitStore["10.0.0.1"].Value.(*rateLimitEntry).day = time.Time{}
+	rateLimitMu.Unlock()
+	if checkRateLimit("10.0.0.1").limited {
+		t.Error("quota not reset on a new day")
+	}
+}
+
+func TestDailyQuotaResponse(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "10", "RATE_LIMIT_DAILY_QUOTA": "1"}, nil)
+	body := `{"query":"{ a }"}`
+	p.post(t, "/public", body, nil)
+	resp, respBody := p.post(t, "/public", body, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if msg := errorMessage(t, respBody); msg != "Daily quota exceeded" {
+		t.Errorf("message = %q", msg)
+	}
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry <= 0 || retry > 86400 {
+		t.Errorf("Retry-After = %q, want seconds until midnight UTC", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestOperationRateLimits(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "10", "OPERATION_RATE_LIMITS": "Search=2,Bad=x"}, nil)
+	if _, ok := cfg.OperationRateLimits["Bad"]; ok {
+		t.Error("an invalid limit was kept")
+	}
+	search := `{"query":"query Search { items }"}`
+	for i := 0; i < 2; i++ {
+		if resp, _ := p.post(t, "/public", search, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Search %d: status = %d", i+1, resp.StatusCode)
+		}
+	}
+	resp, body := p.post(t, "/public", search, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third Search: status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if msg := errorMessage(t, body); msg != "Rate limit exceeded for operation Search" {
+		t.Errorf("message = %q", msg)
+	}
+	if entry := p.lastLog(t); entry.Status != http.StatusTooManyRequests || entry.OperationName != "Search" {
+		t.Errorf("logged %q with status %d", entry.OperationName, entry.Status)
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp, _ := p.post(t, "/public", `{"query":"query Browse { items }"}`, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("Browse %d: status = %d, want other operations unaffected", i+1, resp.StatusCode)
+		}
+	}
+	if !checkOperationRateLimit("127.0.0.1", "Search", 2).limited {
+		t.Error("Search budget was reset by other operations")
+	}
+	if checkOperationRateLimit("127.0.0.2", "Search", 2).limited {
+		t.Error("another IP shares the Search budget")
+	}
+}
+
+func TestRateLimitPenaltyEscalates(t *testing.T) {
+	useConfig(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "1", "RATE_LIMIT_PENALTY": "10s", "RATE_LIMIT_PENALTY_MAX": "50s", "RATE_LIMIT_PENALTY_RESET": "10m"})
+	resetRateLimits()
+	t.Cleanup(resetRateLimits)
+
+	const ip = "10.0.2.1"
+	if checkRateLimit(ip).limited {
+		t.Fatal("first request limited")
+	}
+	// blockFor reports how long the next request blocks ip for.
+	blockFor := func() time.Duration {
+		t.Helper()
+		result := checkRateLimit(ip)
+		if !result.limited || !result.penalized {
+			t.Fatalf("result = %+v, want a penalty", result)
+		}
+		return time.Until(result.reset).Round(time.Second)
+	}
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 50 * time.Second, 50 * time.Second} {
+		if got := blockFor(); got != want {
+			t.Errorf("offense %d: blocked for %v, want %v", i+1, got, want)
+		}
+	}
+
+	// After a quiet period longer than RATE_LIMIT_PENALTY_RESET the offenses
+	// are forgotten, and the next one starts again from RATE_LIMIT_PENALTY.
+	rateLimitMu.Lock()
+	entry := rateLimitStore[ip].Value.(*rateLimitEntry)
+	quiet := time.Now().Add(-11 * time.Minute)
+	entry.lastOffense, entry.blockedUntil, entry.requests = quiet, quiet, nil
+	rateLimitMu.Unlock()
+	if checkRateLimit(ip).limited {
+		t.Fatal("request after the quiet period limited")
+	}
+	if got := blockFor(); got != 10*time.Second {
+		t.Errorf("first offense after the quiet period: blocked for %v, want 10s", got)
+	}
+}
+
+func TestRateLimitPenaltyCapsLargeOffenseCounts(t *testing.T) {
+	useConfig(t, map[string]string{"RATE_LIMIT_PENALTY": "1s", "RATE_LIMIT_PENALTY_MAX": "1h"})
+	now := time.Now()
+	for _, offenses := range []int{31, 40, 62, 100} {
+		result := penalize(&rateLimitEntry{offenses: offenses}, now)
+		if got := result.reset.Sub(now); got != time.Hour {
+			t.Errorf("offense %d: blocked for %v, want the 1h cap", offenses+1, got)
+		}
+	}
+}
+
+func TestRateLimitPenaltyRetryAfter(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"RATE_LIMIT_PER_MINUTE": "1", "RATE_LIMIT_PENALTY": "30s"}, nil)
+	p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	for _, want := range []string{"30", "60"} {
+		resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil)
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != want {
+			t.Errorf("status = %d, Retry-After = %q; want 429 after %s", resp.StatusCode, resp.Header.Get("Retry-After"), want)
+		}
+	}
+}
+
+// startedSince moves startedAt back by ago until the test ends.
+func startedSince(t *testing.T, ago time.Duration) {
+	prev := startedAt
+	startedAt = time.Now().Add(-ago)
+	t.Cleanup(func() { startedAt = prev })
+}
+
+func TestPerMinuteLimitWarmup(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := startedAt
+	startedAt = start
+	t.Cleanup(func() { startedAt = prev })
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		since time.Duration
+		want  int
+	}{
+		{"no warm-up", map[string]string{"RATE_LIMIT_WARMUP": "0"}, 0, 100},
+		{"at startup", nil, 0, 300},
+		{"halfway", nil, 5 * time.Minute, 200},
+		{"after the warm-up", nil, 10 * time.Minute, 100},
+		{"multiplier of one", map[string]string{"RATE_LIMIT_WARMUP_MULTIPLIER": "1"}, 0, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"RATE_LIMIT_PER_MINUTE": "100", "RATE_LIMIT_WARMUP": "10m", "RATE_LIMIT_WARMUP_MULTIPLIER": "3"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			useConfig(t, env)
+			if got := perMinuteLimit(start.Add(tt.since)); got != tt.want {
+				t.Errorf("perMinuteLimit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitWarmup(t *testing.T) {
+	env := map[string]string{"RATE_LIMIT_PER_MINUTE": "2", "RATE_LIMIT_WARMUP": "1h", "RATE_LIMIT_WARMUP_MULTIPLIER": "2", "RATE_LIMIT_HEADERS": "true"}
+	allowed := func(p *testProxy) int {
+		for n := 0; ; n++ {
+			if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode == http.StatusTooManyRequests {
+				return n
+			}
+		}
+	}
+
+	startedSince(t, 0)
+	p := newTestProxy(t, env, nil)
+	if n := allowed(p); n != 4 {
+		t.Errorf("during the warm-up %d requests were allowed, want 4", n)
+	}
+
+	startedSince(t, 2*time.Hour)
+	p = newTestProxy(t, env, nil)
+	if n := allowed(p); n != 2 {
+		t.Errorf("after the warm-up %d requests were allowed, want 2", n)
+	}
+	resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if got := resp.Header.Get("X-RateLimit-Limit"); got != "2" {
+		t.Errorf("X-RateLimit-Limit = %q after the warm-up, want 2", got)
+	}
+}
+
+func TestRateLimitExemptPaths(t *testing.T) {
+	useConfig(t, map[string]string{"RATE_LIMIT_EXEMPT_PATHS": ""})
+	if len(cfg.RateLimitExemptPaths) != 0 {
+		t.Errorf("RateLimitExemptPaths = %v by default, want none", cfg.RateLimitExemptPaths)
+	}
+
+	p := newTestProxy(t, map[string]string{
+		"GRAPHQL_ROUTES":          "/public,/internal",
+		"RATE_LIMIT_EXEMPT_PATHS": "/internal",
+		"RATE_LIMIT_PER_MINUTE":   "2",
+		"OPERATION_RATE_LIMITS":   "Search=1",
+	}, nil)
+	search := `{"query":"query Search { items }"}`
+	for i := 0; i < 5; i++ {
+		if resp, _ := p.post(t, "/internal", search, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("exempt route, request %d: status = %d", i+1, resp.StatusCode)
+		}
+	}
+	if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request to /public: status = %d, want the exempt traffic not counted", resp.StatusCode)
+	}
+	p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("third request to /public: status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if resp, _ := p.post(t, "/internal", search, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("exempt route after /public was throttled: status = %d", resp.StatusCode)
+	}
+}
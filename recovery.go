@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var panicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "http_handler_panics_total",
+	Help: "Handler panics recovered by the server.",
+})
+
+// recoveryWriter notes whether the response has started, after which a
+// panic can no longer be answered with an error envelope.
+type recoveryWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoveryWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoveryWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoveryWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withRecovery turns a handler panic into a 500 with the standard error
+// envelope, logging the stack under the request ID, instead of net/http
+// dropping the connection. http.ErrAbortHandler is re-panicked since it is
+// how a handler deliberately aborts a response. If the response had already
+// started the connection is aborted too, so the client can't mistake a
+// truncated body for a complete one.
+func withRecovery(next http.Handler) http.Handler {
+	if !cfg.PanicRecovery {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			panicsTotal.Inc()
+			slog.ErrorContext(r.Context(), "Recovered from handler panic",
+				"request_id", w.Header().Get(cfg.RequestIDHeader),
+				"method", r.Method, "path", r.URL.Path,
+				"panic", err, "stack", string(debug.Stack()))
+			if rec.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
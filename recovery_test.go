@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// panickingServer serves withRecovery around a handler that panics on
+// /panic, panics after starting the response on /partial, aborts on /abort
+// and answers anything else.
+func panickingServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(cfg.RequestIDHeader, "req-panic")
+		var m map[string]int
+		m["boom"]++
+	})
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		http.NewResponseController(w).Flush()
+		panic("after the response started")
+	})
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	srv := httptest.NewUnstartedServer(withRecovery(mux))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPanicRecovery(t *testing.T) {
+	useConfig(t, map[string]string{"PANIC_RECOVERY": "true"})
+	logs := captureLogs(t)
+	srv := panickingServer(t)
+	before := testutil.ToFloat64(panicsTotal)
+
+	resp, body := send(t, http.MethodGet, srv.URL+"/panic", "", nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if msg := errorMessage(t, body); msg != "Internal Server Error" {
+		t.Errorf("message = %q", msg)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	if got := testutil.ToFloat64(panicsTotal) - before; got != 1 {
+		t.Errorf("panics counted = %v, want 1", got)
+	}
+	attrs, ok := logs.find("Recovered from handler panic")
+	if !ok {
+		t.Fatal("panic not logged")
+	}
+	if attrs["request_id"].String() != "req-panic" || attrs["path"].String() != "/panic" {
+		t.Errorf("logged request_id = %q, path = %q", attrs["request_id"], attrs["path"])
+	}
+	if stack := attrs["stack"].String(); !strings.Contains(stack, "recovery_test.go") {
+		t.Errorf("logged stack doesn't reach the handler:\n%s", stack)
+	}
+
+	// The server keeps serving.
+	for i := 0; i < 3; i++ {
+		if resp, body := send(t, http.MethodGet, srv.URL+"/", "", nil); resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Errorf("request %d after the panic: %d %q", i+1, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestPanicAfterResponseStarted(t *testing.T) {
+	useConfig(t, map[string]string{"PANIC_RECOVERY": "true"})
+	srv := panickingServer(t)
+	before := testutil.ToFloat64(panicsTotal)
+
+	resp, err := http.Get(srv.URL + "/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want the status already sent", resp.StatusCode)
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("truncated body read without an error, want the connection aborted")
+	}
+	resp.Body.Close()
+	if got := testutil.ToFloat64(panicsTotal) - before; got != 1 {
+		t.Errorf("panics counted = %v, want 1", got)
+	}
+
+	if _, err := http.Get(srv.URL + "/abort"); err == nil {
+		t.Error("ErrAbortHandler answered, want the connection aborted")
+	}
+	if got := testutil.ToFloat64(panicsTotal) - before; got != 1 {
+		t.Errorf("panics counted = %v, want ErrAbortHandler not counted", got)
+	}
+	if resp, body := send(t, http.MethodGet, srv.URL+"/", "", nil); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("request after the aborts: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestPanicRecoveryDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"PANIC_RECOVERY": "false"})
+	srv := panickingServer(t)
+	if _, err := http.Get(srv.URL + "/panic"); err == nil {
+		t.Error("panic answered with PANIC_RECOVERY=false, want net/http to drop the connection")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestContext carries the values derived while handling a GraphQL request
+// so the limiter, logging and metrics all read them from one place.
+type RequestContext struct {
+	RequestID      string
+	TraceID        string
+	ClientIP       string
+	Route          string
+	UserAgent      string
+	Referer        string
+	OperationName  string
+	OperationType  string
+	OriginalQuery  string
+	SanitizedQuery string
+	Variables      map[string]interface{}
+	LoadTest       bool
+	Start          time.Time
+	// StageTimings holds the time spent in each handler stage, by name.
+	StageTimings map[string]time.Duration
+}
+
+// recordStage adds the time spent in a stage to the request and to the
+// graphql_stage_duration_seconds histogram.
+func (rc *RequestContext) recordStage(name string, elapsed time.Duration) {
+	if rc.StageTimings == nil {
+		rc.StageTimings = make(map[string]time.Duration)
+	}
+	rc.StageTimings[name] += elapsed
+	stageDurationSeconds.WithLabelValues(name).Observe(elapsed.Seconds())
+}
+
+type requestContextKey struct{}
+
+func withRequestContext(r *http.Request, rc *RequestContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+}
+
+// requestContextFrom returns the request's RequestContext, or nil outside the
+// GraphQL handler.
+func requestContextFrom(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(requestContextKey{}).(*RequestContext)
+	return rc
+}
+
+func (rc *RequestContext) logEntry() logEntry {
+	var stageTimings map[string]int64
+	if cfg.LogStageTimings && len(rc.StageTimings) > 0 {
+		stageTimings = make(map[string]int64, len(rc.StageTimings))
+		for name, elapsed := range rc.StageTimings {
+			stageTimings[name] = elapsed.Microseconds()
+		}
+	}
+	// With LOG_VARIABLES=false variables are still forwarded upstream but
+	// never stored, since they often carry personal data.
+	var variables map[string]interface{}
+	if cfg.LogVariables {
+		variables = rc.Variables
+	}
+	return logEntry{
+		RequestID:      rc.RequestID,
+		TraceID:        rc.TraceID,
+		IP:             rc.ClientIP,
+		Route:          rc.Route,
+		UserAgent:      rc.UserAgent,
+		Referer:        rc.Referer,
+		OperationName:  rc.OperationName,
+		OriginalQuery:  rc.OriginalQuery,
+		SanitizedQuery: rc.SanitizedQuery,
+		Variables:      variables,
+		LoadTest:       rc.LoadTest,
+		StageTimingsUs: stageTimings,
+		Timestamp:      rc.Start,
+	}
+}
+
+// truncateHeader caps a client-supplied header value kept for logging at
+// LOG_HEADER_MAX_LENGTH bytes, without splitting a UTF-8 sequence.
+func truncateHeader(value string) string {
+	if len(value) <= cfg.LogHeaderMaxLength {
+		return value
+	}
+	return strings.ToValidUTF8(value[:cfg.LogHeaderMaxLength], "")
+}
+
+// maxIncomingRequestIDLength bounds a client-supplied request ID, which ends up
+// in logs and upstream headers.
+const maxIncomingRequestIDLength = 128
+
+// requestIDFrom honors a request ID sent under REQUEST_ID_HEADER by an
+// upstream hop, generating a new one if it is missing or not plain printable
+// ASCII.
+func requestIDFrom(r *http.Request) string {
+	id := r.Header.Get(cfg.RequestIDHeader)
+	if id == "" || len(id) > maxIncomingRequestIDLength {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRequestContextReachesLogEntry(t *testing.T) {
+	p := newTestProxy(t, map[string]string{
+		"LOG_QUERY_SAMPLE_RATE": "1",
+		"UPSTREAM_HEADERS":      "X-Client={client_ip},X-Trace={request_id}",
+	}, nil)
+	resp, _ := p.post(t, "/public", `{"query":"query Items($n: Int) { items(first: $n) }","operationName":"Items","variables":{"n":3}}`, map[string]string{
+		"X-Request-Id": "req-123",
+		"User-Agent":   "shop-app/1.0",
+		"Referer":      "https://shop.example/cart",
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if id := resp.Header.Get("X-Request-Id"); id != "req-123" {
+		t.Errorf("response request ID = %q", id)
+	}
+
+	entry := p.lastLog(t)
+	if entry.RequestID != "req-123" || entry.IP != "127.0.0.1" || entry.Route != "/public" || entry.OperationName != "Items" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if entry.UserAgent != "shop-app/1.0" || entry.Referer != "https://shop.example/cart" {
+		t.Errorf("entry headers = %q, %q", entry.UserAgent, entry.Referer)
+	}
+	if entry.Variables["n"] != float64(3) || !strings.Contains(entry.OriginalQuery, "items(first: $n)") {
+		t.Errorf("entry query = %q, variables = %v", entry.OriginalQuery, entry.Variables)
+	}
+	if entry.Timestamp.IsZero() {
+		t.Error("entry has no timestamp")
+	}
+
+	upstream := p.backend.last(t).Header
+	if upstream.Get("X-Client") != "127.0.0.1" || upstream.Get("X-Trace") != "req-123" {
+		t.Errorf("upstream headers = %q, %q", upstream.Get("X-Client"), upstream.Get("X-Trace"))
+	}
+}
+
+func TestRequestIDFrom(t *testing.T) {
+	useConfig(t, nil)
+	tests := []struct {
+		name    string
+		id      string
+		keepsID bool
+	}{
+		{"valid", "abc-123", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", maxIncomingRequestIDLength+1), false},
+		{"control character", "abc\x01", false},
+		{"space", "abc def", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/public", nil)
+			r.Header.Set("X-Request-Id", tt.id)
+			got := requestIDFrom(r)
+			if tt.keepsID && got != tt.id {
+				t.Errorf("requestIDFrom = %q, want %q", got, tt.id)
+			}
+			if !tt.keepsID && (got == tt.id || len(got) != 32) {
+				t.Errorf("requestIDFrom = %q, want a generated ID", got)
+			}
+		})
+	}
+}
+
+func TestRequestContextFromOutsideHandler(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	if rc := requestContextFrom(r.Context()); rc != nil {
+		t.Errorf("requestContextFrom = %+v, want nil", rc)
+	}
+	rc := &RequestContext{ClientIP: "192.0.2.1"}
+	if got := requestContextFrom(withRequestContext(r, rc).Context()); got != rc {
+		t.Errorf("requestContextFrom = %+v, want the stored context", got)
+	}
+}
+
+func TestCustomRequestIDHeader(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"REQUEST_ID_HEADER": "X-Correlation-Id"}, nil)
+
+	resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"X-Correlation-Id": "corr-42"})
+	if id := resp.Header.Get("X-Correlation-Id"); id != "corr-42" {
+		t.Errorf("response X-Correlation-Id = %q, want the incoming value", id)
+	}
+	if id := p.backend.last(t).Header.Get("X-Correlation-Id"); id != "corr-42" {
+		t.Errorf("upstream X-Correlation-Id = %q, want the incoming value", id)
+	}
+	if id := p.lastLog(t).RequestID; id != "corr-42" {
+		t.Errorf("logged request ID = %q", id)
+	}
+	if resp.Header.Get("X-Request-Id") != "" {
+		t.Error("the default header is still set")
+	}
+
+	resp, _ = p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"X-Request-Id": "ignored"})
+	generated := resp.Header.Get("X-Correlation-Id")
+	if generated == "" || generated == "ignored" {
+		t.Errorf("X-Correlation-Id = %q, want a generated ID", generated)
+	}
+	if id := p.backend.last(t).Header.Get("X-Correlation-Id"); id != generated {
+		t.Errorf("upstream X-Correlation-Id = %q, want %q", id, generated)
+	}
+}
+
+// stageSamples returns how many durations graphql_stage_duration_seconds has
+// observed for stage.
+func stageSamples(t *testing.T, stage string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "graphql_stage_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "stage" && l.GetValue() == stage {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestStageTimings(t *testing.T) {
+	stages := []string{"shed", "required_headers", "read_body", "authenticate", "rate_limit", "parse", "operation_rate_limit", "validate", "admit", "proxy"}
+
+	t.Run("logged with LOG_STAGE_TIMINGS", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"LOG_STAGE_TIMINGS": "true"}, nil)
+		before := make(map[string]uint64)
+		for _, stage := range stages {
+			before[stage] = stageSamples(t, stage)
+		}
+		if resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d", resp.StatusCode)
+		}
+		timings := p.lastLog(t).StageTimingsUs
+		for _, stage := range stages {
+			if _, ok := timings[stage]; !ok {
+				t.Errorf("stage %q missing from logged timings %v", stage, timings)
+			}
+			if got := stageSamples(t, stage) - before[stage]; got != 1 {
+				t.Errorf("stage %q observed %d times, want 1", stage, got)
+			}
+		}
+	})
+
+	t.Run("stops at the rejecting stage", func(t *testing.T) {
+		p := newTestProxy(t, map[string]string{"LOG_STAGE_TIMINGS": "true"}, nil)
+		if resp, _ := p.post(t, "/public", `{"query":`, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+		timings := p.lastLog(t).StageTimingsUs
+		if _, ok := timings["parse"]; !ok {
+			t.Errorf("rejecting stage missing from logged timings %v", timings)
+		}
+		for _, stage := range []string{"validate", "admit", "proxy"} {
+			if _, ok := timings[stage]; ok {
+				t.Errorf("stage %q after the rejection was timed", stage)
+			}
+		}
+	})
+
+	t.Run("not logged by default", func(t *testing.T) {
+		p := newTestProxy(t, nil, nil)
+		before := stageSamples(t, "proxy")
+		p.post(t, "/public", `{"query":"{ a }"}`, nil)
+		if timings := p.lastLog(t).StageTimingsUs; timings != nil {
+			t.Errorf("logged timings = %v with LOG_STAGE_TIMINGS unset", timings)
+		}
+		if got := stageSamples(t, "proxy") - before; got != 1 {
+			t.Errorf("proxy stage observed %d times, want the histogram kept regardless", got)
+		}
+	})
+}
+
+func TestLoggedClientHeadersAreCapped(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"LOG_HEADER_MAX_LENGTH": "16"}, nil)
+	p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{
+		"User-Agent": strings.Repeat("u", 100),
+		"Referer":    "https://shop.example/" + strings.Repeat("r", 100),
+	})
+	entry := p.lastLog(t)
+	if entry.UserAgent != strings.Repeat("u", 16) || entry.Referer != "https://shop.exa" {
+		t.Errorf("entry headers = %q, %q; want them cut to 16 bytes", entry.UserAgent, entry.Referer)
+	}
+	if ua := p.backend.last(t).Header.Get("User-Agent"); ua != strings.Repeat("u", 100) {
+		t.Errorf("upstream User-Agent = %q, want it forwarded in full", ua)
+	}
+
+	p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"User-Agent": ""})
+	if entry := p.lastLog(t); entry.Referer != "" {
+		t.Errorf("referer = %q for a request without one", entry.Referer)
+	}
+}
+
+func TestTruncateHeader(t *testing.T) {
+	useConfig(t, map[string]string{"LOG_HEADER_MAX_LENGTH": "5"})
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"short", "short"},
+		{"longer value", "longe"},
+		{"abcdé", "abcd"}, // é would be split
+		{"abc€", "abc"},
+	}
+	for _, tt := range tests {
+		if got := truncateHeader(tt.in); got != tt.want {
+			t.Errorf("truncateHeader(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateHeaderNegativeLength(t *testing.T) {
+	// A negative length is clamped to 0 rather than panicking on the slice.
+	useConfig(t, map[string]string{"LOG_HEADER_MAX_LENGTH": "-1"})
+	if got := truncateHeader("value"); got != "" {
+		t.Errorf("truncateHeader = %q, want it cut to nothing", got)
+	}
+}
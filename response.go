@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+type graphqlErrorBody struct {
+	Errors []struct {
+		Extensions struct {
+			Code string `json:"code"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// isBufferableJSON reports whether a backend response is an uncompressed JSON
+// body that can safely be read and rewritten in ModifyResponse.
+func isBufferableJSON(resp *http.Response) bool {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "application/json" || mediaType == "application/graphql-response+json"
+}
+
+// mapErrorStatus rewrites a 200 response carrying GraphQL errors to the HTTP
+// status configured for the first error code that has a mapping.
+func mapErrorStatus(resp *http.Response, statuses map[string]int) error {
+	if len(statuses) == 0 || resp.StatusCode != http.StatusOK || !isBufferableJSON(resp) {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var parsed graphqlErrorBody
+	if json.Unmarshal(body, &parsed) != nil {
+		return nil
+	}
+	for _, e := range parsed.Errors {
+		if status, ok := statuses[e.Extensions.Code]; ok {
+			resp.StatusCode = status
+			resp.Status = http.StatusText(status)
+			return nil
+		}
+	}
+	return nil
+}
+
+// statusRecorder captures the status code written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// stripResponseFields removes the configured dotted paths, relative to the
+// response's data object, descending through lists along the way.
+func stripResponseFields(resp *http.Response, paths [][]string) error {
+	if len(paths) == 0 || !isBufferableJSON(resp) {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var parsed map[string]interface{}
+	if dec.Decode(&parsed) != nil {
+		return nil
+	}
+	data, ok := parsed["data"]
+	if !ok {
+		return nil
+	}
+	for _, path := range paths {
+		removePath(data, path)
+	}
+
+	rewritten, err := json.Marshal(parsed)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	return nil
+}
+
+func removePath(node interface{}, path []string) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		if child, ok := v[path[0]]; ok {
+			removePath(child, path[1:])
+		}
+	case []interface{}:
+		for _, item := range v {
+			removePath(item, path)
+		}
+	}
+}
+
+var errResponseTooLarge = errors.New("backend response exceeds MAX_RESPONSE_BYTES")
+
+// limitResponseSize enforces MAX_RESPONSE_BYTES. A declared Content-Length
+// over the limit fails before anything is sent to the client; otherwise the
+// body is counted as it streams and the read fails once the limit is passed,
+// which aborts the response mid-way.
+func limitResponseSize(resp *http.Response, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+	if resp.ContentLength > limit {
+		responseTooLarge(resp.Request, resp.ContentLength)
+		return errResponseTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, req: resp.Request, remaining: limit, limit: limit}
+	return nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	req       *http.Request
+	remaining int64
+	limit     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte past the limit so a body of exactly the limit passes.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		responseTooLarge(b.req, b.limit-b.remaining)
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
+
+func responseTooLarge(r *http.Request, size int64) {
+	responseTooLargeTotal.Inc()
+	slog.ErrorContext(r.Context(), "Backend response too large", "bytes", size, "limit", cfg.MaxResponseBytes)
+}
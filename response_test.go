@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func backendResponse(status int, contentType, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestMapErrorStatus(t *testing.T) {
+	statuses := map[string]int{"UNAUTHENTICATED": http.StatusUnauthorized, "FORBIDDEN": http.StatusForbidden}
+	unauthenticated := `{"errors":[{"message":"no","extensions":{"code":"UNAUTHENTICATED"}}]}`
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		encoding    string
+		body        string
+		want        int
+	}{
+		{"mapped code", http.StatusOK, "application/json", "", unauthenticated, http.StatusUnauthorized},
+		{"graphql-response media type", http.StatusOK, "application/graphql-response+json; charset=utf-8", "", unauthenticated, http.StatusUnauthorized},
+		{"first mapped code wins", http.StatusOK, "application/json", "",
+			`{"errors":[{"extensions":{"code":"OTHER"}},{"extensions":{"code":"FORBIDDEN"}},{"extensions":{"code":"UNAUTHENTICATED"}}]}`, http.StatusForbidden},
+		{"unmapped code", http.StatusOK, "application/json", "", `{"errors":[{"extensions":{"code":"BAD_USER_INPUT"}}]}`, http.StatusOK},
+		{"no errors", http.StatusOK, "application/json", "", `{"data":{"a":1}}`, http.StatusOK},
+		{"non-200 left alone", http.StatusInternalServerError, "application/json", "", unauthenticated, http.StatusInternalServerError},
+		{"not JSON", http.StatusOK, "text/plain", "", unauthenticated, http.StatusOK},
+		{"compressed", http.StatusOK, "application/json", "gzip", unauthenticated, http.StatusOK},
+		{"malformed JSON", http.StatusOK, "application/json", "", `{"errors":`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := backendResponse(tt.status, tt.contentType, tt.body)
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if err := mapErrorStatus(resp, statuses); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if body, _ := io.ReadAll(resp.Body); string(body) != tt.body {
+				t.Errorf("body = %q, want it unchanged", body)
+			}
+		})
+	}
+}
+
+func TestProxyMapsGraphQLErrorStatus(t *testing.T) {
+	backendBody := `{"errors":[{"message":"login required","extensions":{"code":"UNAUTHENTICATED"}}]}`
+	p := newTestProxy(t, map[string]string{"GRAPHQL_ERROR_STATUS": "UNAUTHENTICATED=401"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, backendBody)
+	})
+	resp, body := p.post(t, "/public", `{"query":"{ me { id } }"}`, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if body != backendBody {
+		t.Errorf("body = %s, want the backend's", body)
+	}
+	if status := p.lastLog(t).Status; status != http.StatusUnauthorized {
+		t.Errorf("logged status = %d", status)
+	}
+}
+
+func TestEnvStatusMap(t *testing.T) {
+	t.Setenv("GRAPHQL_ERROR_STATUS", "UNAUTHENTICATED=401, FORBIDDEN=403, BAD=abc, WEIRD=999, NOEQUALS")
+	got := envStatusMap("GRAPHQL_ERROR_STATUS")
+	if len(got) != 2 || got["UNAUTHENTICATED"] != 401 || got["FORBIDDEN"] != 403 {
+		t.Errorf("envStatusMap = %v", got)
+	}
+}
+
+func TestStripResponseFields(t *testing.T) {
+	body := `{"data":{"__debug":{"sql":"select"},"user":{"name":"a","internal":{"id":1},"orders":[{"id":1,"cost":2},{"id":2,"cost":3}]}},"extensions":{"__debug":1}}`
+	resp := backendResponse(http.StatusOK, "application/json", body)
+	paths := [][]string{{"__debug"}, {"user", "internal"}, {"user", "orders", "cost"}, {"missing", "field"}}
+	if err := stripResponseFields(resp, paths); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	want := `{"data":{"user":{"name":"a","orders":[{"id":1},{"id":2}]}},"extensions":{"__debug":1}}`
+	if string(got) != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+	if resp.ContentLength != int64(len(want)) || resp.Header.Get("Content-Length") != strconv.Itoa(len(want)) {
+		t.Errorf("Content-Length = %d / %q, want %d", resp.ContentLength, resp.Header.Get("Content-Length"), len(want))
+	}
+}
+
+func TestStripResponseFieldsLeavesOtherResponses(t *testing.T) {
+	paths := [][]string{{"__debug"}}
+	for _, tt := range []struct{ contentType, body string }{
+		{"application/json", "not json"},
+		{"application/json", `{"errors":[{"message":"no"}]}`},
+		{"text/plain", `{"data":{"__debug":1}}`},
+	} {
+		resp := backendResponse(http.StatusOK, tt.contentType, tt.body)
+		if err := stripResponseFields(resp, paths); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(resp.Body); string(got) != tt.body {
+			t.Errorf("%s %q rewritten to %q", tt.contentType, tt.body, got)
+		}
+	}
+}
+
+func TestProxyStripsResponseFields(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"RESPONSE_STRIP_FIELDS": "item.__debug"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"data":{"item":{"id":"1","__debug":"trace"}}}`)
+	})
+	resp, body := p.post(t, "/public", `{"query":"{ item { id } }"}`, nil)
+	if body != `{"data":{"item":{"id":"1"}}}` {
+		t.Errorf("body = %s", body)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("Content-Length = %d, want %d", resp.ContentLength, len(body))
+	}
+}
+
+func TestStreamsIncrementalDelivery(t *testing.T) {
+	const boundary = "-"
+	part1 := "\r\n---\r\nContent-Type: application/json; charset=utf-8\r\n\r\n{\"data\":{\"a\":1},\"hasNext\":true}\r\n---"
+	part2 := "\r\nContent-Type: application/json; charset=utf-8\r\n\r\n{\"incremental\":[{\"data\":{\"b\":2},\"path\":[]}],\"hasNext\":false}\r\n-----\r\n"
+	next := make(chan struct{})
+	p := newTestProxy(t, map[string]string{
+		"COALESCE_QUERIES":      "true",
+		"RESPONSE_STRIP_FIELDS": "a",
+		"GRAPHQL_ERROR_STATUS":  "UNAUTHENTICATED=401",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `multipart/mixed; boundary="`+boundary+`"; deferSpec=20220824`)
+		io.WriteString(w, part1)
+		w.(http.Flusher).Flush()
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, part2)
+	})
+
+	resp, err := http.Post(p.URL+"/public", "application/json", strings.NewReader(`{"query":"{ a ... @defer { b } }"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/mixed") || !strings.Contains(ct, `boundary="-"`) {
+		t.Errorf("Content-Type = %q, want the backend's multipart/mixed boundary", ct)
+	}
+
+	// The first part must arrive while the backend is still holding the
+	// second one back.
+	buf := make([]byte, len(part1))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("reading the first part: %v", err)
+	}
+	if string(buf) != part1 {
+		t.Errorf("first part = %q, want it unmodified", buf)
+	}
+	close(next)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != part2 {
+		t.Errorf("second part = %q", rest)
+	}
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	const limit = 64
+	small := `{"data":{"items":["a","b"]}}`
+	exact := `{"data":{"s":"` + strings.Repeat("x", limit-len(`{"data":{"s":""}}`)) + `"}}`
+	large := `{"data":{"s":"` + strings.Repeat("x", 4*limit) + `"}}`
+	var chunked atomic.Bool
+	p := newTestProxy(t, map[string]string{"MAX_RESPONSE_BYTES": strconv.Itoa(limit)}, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var out string
+		switch {
+		case strings.Contains(string(body), "small"):
+			out = small
+		case strings.Contains(string(body), "exact"):
+			out = exact
+		default:
+			out = large
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !chunked.Load() {
+			w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+			io.WriteString(w, out)
+			return
+		}
+		// Without a Content-Length the size is only known as it streams.
+		for i := 0; i < len(out); i += 16 {
+			io.WriteString(w, out[i:min(i+16, len(out))])
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	for _, mode := range []string{"content-length", "streamed"} {
+		chunked.Store(mode == "streamed")
+		for name, want := range map[string]string{"small": small, "exact": exact} {
+			resp, body := p.post(t, "/public", `{"query":"{ `+name+` }"}`, nil)
+			if resp.StatusCode != http.StatusOK || body != want {
+				t.Errorf("%s %s response: %d %q", mode, name, resp.StatusCode, body)
+			}
+		}
+	}
+
+	tooLarge := testutil.ToFloat64(responseTooLargeTotal)
+	chunked.Store(false)
+	resp, body := p.post(t, "/public", `{"query":"{ large }"}`, nil)
+	if resp.StatusCode != http.StatusBadGateway || errorMessage(t, body) != "Backend response too large" {
+		t.Errorf("declared over-size response: %d %s", resp.StatusCode, body)
+	}
+
+	chunked.Store(true)
+	req, _ := http.NewRequest(http.MethodPost, p.URL+"/public", strings.NewReader(`{"query":"{ large }"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		relayed, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			t.Errorf("streamed over-size response completed: %d bytes", len(relayed))
+		}
+		if len(relayed) > limit {
+			t.Errorf("relayed %d bytes, more than the %d byte limit", len(relayed), limit)
+		}
+	}
+	if v := testutil.ToFloat64(responseTooLargeTotal) - tooLarge; v != 2 {
+		t.Errorf("backend_response_too_large_total rose by %v, want 2", v)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// route is a path serving the GraphQL proxy with its own settings.
+type route struct {
+	path    string
+	timeout time.Duration
+	methods []string
+}
+
+func (rt route) allows(method string) bool {
+	return slices.Contains(rt.methods, method)
+}
+
+// allowHeader lists the route's methods plus OPTIONS, which is answered for
+// CORS preflights unless CORS handling is disabled.
+func (rt route) allowHeader() string {
+	if !cfg.CORSEnabled {
+		return strings.Join(rt.methods, ", ")
+	}
+	return strings.Join(append(slices.Clone(rt.methods), http.MethodOptions), ", ")
+}
+
+// loadRoutes builds the routes from GRAPHQL_ROUTES. A ROUTE_TIMEOUTS entry
+// overrides REQUEST_TIMEOUT for its path, and a ROUTE_METHODS entry such as
+// /public=POST|GET replaces the default of POST only.
+func loadRoutes() []route {
+	var routes []route
+	for _, path := range cfg.Routes {
+		rt := route{path: path, timeout: cfg.RequestTimeout, methods: []string{http.MethodPost}}
+		if raw, ok := cfg.RouteMethods[path]; ok {
+			rt.methods = strings.Split(strings.ToUpper(raw), "|")
+		}
+		if raw, ok := cfg.RouteTimeouts[path]; ok {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				slog.Warn("Invalid ROUTE_TIMEOUTS value, using REQUEST_TIMEOUT", "path", path, "value", raw)
+			} else {
+				rt.timeout = d
+			}
+		}
+		routes = append(routes, rt)
+	}
+	return routes
+}
+
+type appliedTimeoutKey struct{}
+
+// appliedTimeout records which timeout bounds a request so a 504 can say
+// which one fired.
+type appliedTimeout struct {
+	route    string
+	duration time.Duration
+	override bool
+}
+
+func (t appliedTimeout) String() string {
+	if t.override {
+		return fmt.Sprintf("route %s timeout of %s", t.route, t.duration)
+	}
+	return fmt.Sprintf("global request timeout of %s", t.duration)
+}
+
+// withRouteTimeout bounds the request context by the route's timeout, if any.
+func withRouteTimeout(r *http.Request, rt route) (*http.Request, context.CancelFunc) {
+	if rt.timeout <= 0 {
+		return r, func() {}
+	}
+	applied := appliedTimeout{route: rt.path, duration: rt.timeout, override: rt.timeout != cfg.RequestTimeout}
+	ctx := context.WithValue(r.Context(), appliedTimeoutKey{}, applied)
+	ctx, cancel := context.WithTimeout(ctx, rt.timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// statusClientClosedRequest is nginx's non-standard status for a client that
+// disconnected before the response was ready.
+const statusClientClosedRequest = 499
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	// The transport aborts the upstream call when the request context is
+	// canceled; that is the client going away, not a backend failure.
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		clientCanceledTotal.Inc()
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		writeError(w, http.StatusBadGateway, "Backend response too large")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		if applied, ok := r.Context().Value(appliedTimeoutKey{}).(appliedTimeout); ok {
+			slog.WarnContext(r.Context(), "Upstream timeout", "timeout", applied.String(), "path", r.URL.Path)
+			writeError(w, http.StatusGatewayTimeout, "Gateway Timeout: "+applied.String()+" exceeded")
+			return
+		}
+	}
+	slog.ErrorContext(r.Context(), "Proxy error", "err", err)
+	writeError(w, http.StatusBadGateway, "Backend unavailable")
+}
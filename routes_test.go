@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	useConfig(t, map[string]string{
+		"GRAPHQL_ROUTES":  "/public,/internal",
+		"REQUEST_TIMEOUT": "5s",
+		"ROUTE_TIMEOUTS":  "/internal=30s,/public=nope",
+		"ROUTE_METHODS":   "/public=post|get",
+	})
+	routes := loadRoutes()
+	if len(routes) != 2 {
+		t.Fatalf("routes = %+v", routes)
+	}
+	pub, internal := routes[0], routes[1]
+	if pub.timeout != 5*time.Second {
+		t.Errorf("/public timeout = %s, want the global 5s after an invalid override", pub.timeout)
+	}
+	if !slices.Equal(pub.methods, []string{"POST", "GET"}) {
+		t.Errorf("/public methods = %v", pub.methods)
+	}
+	if internal.timeout != 30*time.Second || !slices.Equal(internal.methods, []string{"POST"}) {
+		t.Errorf("/internal = %+v", internal)
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	p := newTestProxy(t, map[string]string{
+		"GRAPHQL_ROUTES":  "/fast,/slow",
+		"REQUEST_TIMEOUT": "2s",
+		"ROUTE_TIMEOUTS":  "/fast=50ms",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(`{"data":{}}`))
+	})
+	body := `{"query":"{ a }"}`
+
+	resp, respBody := p.post(t, "/fast", body, nil)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("/fast status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if msg := errorMessage(t, respBody); !strings.Contains(msg, "route /fast timeout of 50ms") {
+		t.Errorf("/fast message = %q, want it to name the route timeout", msg)
+	}
+
+	if resp, _ := p.post(t, "/slow", body, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("/slow status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestGlobalTimeoutMessage(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"REQUEST_TIMEOUT": "50ms"}, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	resp, body := p.post(t, "/public", `{"query":"{ a }"}`, nil)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if msg := errorMessage(t, body); !strings.Contains(msg, "global request timeout of 50ms") {
+		t.Errorf("message = %q, want it to name the global timeout", msg)
+	}
+}
+
+func TestClientCancelAbortsUpstream(t *testing.T) {
+	arrived := make(chan struct{})
+	aborted := make(chan struct{})
+	p := newTestProxy(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	before := testutil.ToFloat64(clientCanceledTotal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, p.URL+"/public", strings.NewReader(`{"query":"{ slow }"}`))
+	req.Header.Set("Content-Type", "application/json")
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("request succeeded after being canceled")
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream call was not aborted")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(p.logs.recent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(clientCanceledTotal); got != before+1 {
+		t.Errorf("proxy_client_canceled_total = %v, want %v", got, before+1)
+	}
+	if status := p.lastLog(t).Status; status != statusClientClosedRequest {
+		t.Errorf("logged status = %d, want %d", status, statusClientClosedRequest)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// sanitizeStringLiterals strips dangerousChars only inside string literals,
+// leaving the rest of the document, including comments, untouched. Escape
+// sequences are copied as-is so removing a character can never end a string
+// early.
+func sanitizeStringLiterals(query string) (string, int) {
+	var out strings.Builder
+	out.Grow(len(query))
+	removed := 0
+	// clean filters a run of literal text inside a string.
+	clean := func(s string) {
+		removed += len(dangerousChars.FindAllStringIndex(s, -1))
+		out.WriteString(dangerousChars.ReplaceAllString(s, ""))
+	}
+
+	for i := 0; i < len(query); {
+		switch {
+		case query[i] == '#':
+			end := strings.IndexAny(query[i:], "\r\n")
+			if end < 0 {
+				end = len(query) - i
+			}
+			out.WriteString(query[i : i+end])
+			i += end
+
+		case strings.HasPrefix(query[i:], `"""`):
+			out.WriteString(`"""`)
+			i += 3
+			start := i
+			for i < len(query) && !strings.HasPrefix(query[i:], `"""`) {
+				if strings.HasPrefix(query[i:], `\"""`) {
+					clean(query[start:i])
+					out.WriteString(`\"""`)
+					i += 4
+					start = i
+					continue
+				}
+				i++
+			}
+			clean(query[start:i])
+			if i < len(query) {
+				out.WriteString(`"""`)
+				i += 3
+			}
+
+		case query[i] == '"':
+			out.WriteByte('"')
+			i++
+			start := i
+			for i < len(query) && query[i] != '"' && query[i] != '\n' {
+				if query[i] == '\\' && i+1 < len(query) {
+					clean(query[start:i])
+					out.WriteString(query[i : i+2])
+					i += 2
+					start = i
+					continue
+				}
+				i++
+			}
+			clean(query[start:i])
+			if i < len(query) && query[i] == '"' {
+				out.WriteByte('"')
+				i++
+			}
+
+		default:
+			out.WriteByte(query[i])
+			i++
+		}
+	}
+	return out.String(), removed
+}
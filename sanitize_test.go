@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSanitizeStringLiterals(t *testing.T) {
+	useConfig(t, map[string]string{"SANITIZE_PATTERN": ""})
+	tests := []struct {
+		name, query, want string
+		removed           int
+	}{
+		{
+			"structure outside strings is kept",
+			`query Q($n: Int = -1) { items(first: $n, q: "a;b<c>") { ...F } } # no;change`,
+			`query Q($n: Int = -1) { items(first: $n, q: "abc") { ...F } } # no;change`,
+			3,
+		},
+		{"escaped quote does not end the string", `{ a(x: "1\";2") b(y: "=") }`, `{ a(x: "1\"2") b(y: "") }`, 2},
+		{"escaped backslash ends the string", `{ a(x: "\\") b(n: -1) }`, `{ a(x: "\\") b(n: -1) }`, 0},
+		{"block string", `{ a(x: """<b>
+-- """) }`, `{ a(x: """b
+ """) }`, 4},
+		{"escaped triple quote in block string", `{ a(x: """;\""";""") }`, `{ a(x: """\"""""") }`, 2},
+		{"string ends at a newline", "{ a(x: \"1;\n;\") }", "{ a(x: \"1\n;\") }", 1},
+		{"unterminated string", `{ a(x: "1;2`, `{ a(x: "12`, 1},
+		{"no strings", `{ a(n: -1) }`, `{ a(n: -1) }`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed := sanitizeStringLiterals(tt.query)
+			if got != tt.want || removed != tt.removed {
+				t.Errorf("sanitizeStringLiterals(%q) = %q, %d; want %q, %d", tt.query, got, removed, tt.want, tt.removed)
+			}
+		})
+	}
+}
+
+func TestProxySanitizesOnlyStrings(t *testing.T) {
+	p := newTestProxy(t, map[string]string{"SANITIZE_MODE": "strings"}, nil)
+	query := `mutation Rate($n: Int = -1) { rate(score: $n, note: "<script>;") }`
+	body, _ := json.Marshal(map[string]string{"query": query})
+	if resp, _ := p.post(t, "/public", string(body), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(p.backend.last(t).Body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if q := payload["query"]; q != `mutation Rate($n: Int = -1) { rate(score: $n, note: "script") }` {
+		t.Errorf("forwarded query = %q", q)
+	}
+}
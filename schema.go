@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+const schemaFetchTimeout = 10 * time.Second
+
+const introspectionQuery = `query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types {
+      kind name
+      fields(includeDeprecated: true) { name args { ...InputValue } type { ...TypeRef } }
+      inputFields { ...InputValue }
+      interfaces { ...TypeRef }
+      enumValues(includeDeprecated: true) { name }
+      possibleTypes { ...TypeRef }
+    }
+    directives { name isRepeatable locations args { ...InputValue } }
+  }
+}
+fragment InputValue on __InputValue { name type { ...TypeRef } defaultValue }
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name
+    ofType { kind name ofType { kind name ofType { kind name } } } } } } }
+}`
+
+// loadedSchema is the backend schema queries are validated against. The SDL
+// it was built from is kept alongside for inspection.
+type loadedSchema struct {
+	schema  *ast.Schema
+	sdl     string
+	fetched time.Time
+}
+
+var backendSchema atomic.Pointer[loadedSchema]
+
+type introspectionTypeRef struct {
+	Kind   string                `json:"kind"`
+	Name   string                `json:"name"`
+	OfType *introspectionTypeRef `json:"ofType"`
+}
+
+type introspectionInputValue struct {
+	Name         string               `json:"name"`
+	Type         introspectionTypeRef `json:"type"`
+	DefaultValue *string              `json:"defaultValue"`
+}
+
+type introspectionField struct {
+	Name string                    `json:"name"`
+	Args []introspectionInputValue `json:"args"`
+	Type introspectionTypeRef      `json:"type"`
+}
+
+type introspectionType struct {
+	Kind          string                    `json:"kind"`
+	Name          string                    `json:"name"`
+	Fields        []introspectionField      `json:"fields"`
+	InputFields   []introspectionInputValue `json:"inputFields"`
+	Interfaces    []introspectionTypeRef    `json:"interfaces"`
+	EnumValues    []struct{ Name string }   `json:"enumValues"`
+	PossibleTypes []introspectionTypeRef    `json:"possibleTypes"`
+}
+
+type introspectionDirective struct {
+	Name         string                    `json:"name"`
+	IsRepeatable bool                      `json:"isRepeatable"`
+	Locations    []string                  `json:"locations"`
+	Args         []introspectionInputValue `json:"args"`
+}
+
+type introspectionSchema struct {
+	QueryType        *struct{ Name string }   `json:"queryType"`
+	MutationType     *struct{ Name string }   `json:"mutationType"`
+	SubscriptionType *struct{ Name string }   `json:"subscriptionType"`
+	Types            []introspectionType      `json:"types"`
+	Directives       []introspectionDirective `json:"directives"`
+}
+
+// builtinSDL lists the definitions gqlparser's prelude already provides;
+// redefining them from the introspection result would fail to load.
+var builtinSDL = map[string]bool{
+	"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true,
+	"defer": true, "include": true, "skip": true, "deprecated": true, "specifiedBy": true, "oneOf": true,
+}
+
+// schemaNeeded reports whether the backend schema is fetched at all: it is
+// used by SCHEMA_VALIDATION and served by SCHEMA_ENDPOINT.
+func schemaNeeded() bool {
+	return cfg.SchemaValidation || cfg.SchemaEndpoint
+}
+
+// refreshSchema fetches the schema from the primary backend and swaps it in.
+// On failure the previous schema, if any, stays in use.
+func refreshSchema(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, schemaFetchTimeout)
+	defer cancel()
+
+	loaded, err := fetchSchema(ctx, activeBackends.Load().primary)
+	if err != nil {
+		return err
+	}
+	backendSchema.Store(loaded)
+	slog.Info("Loaded backend schema", "types", len(loaded.schema.Types))
+	return nil
+}
+
+// fetchSchema introspects b. The query is sent as if proxied on the first
+// GraphQL route, through the backend's own director, so it reaches the same
+// URL with the same upstream headers as client traffic.
+func fetchSchema(ctx context.Context, b *backend) (*loadedSchema, error) {
+	path := "/"
+	if len(cfg.Routes) > 0 {
+		path = cfg.Routes[0]
+	}
+	body, _ := json.Marshal(map[string]string{"query": introspectionQuery})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	b.proxy.Director(req)
+
+	resp, err := (&http.Client{Transport: b.transport}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching schema: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching schema: backend returned %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Schema *introspectionSchema `json:"__schema"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding schema: %w", err)
+	}
+	if result.Data.Schema == nil {
+		return nil, fmt.Errorf("fetching schema: response has no __schema")
+	}
+
+	sdl := introspectionToSDL(result.Data.Schema)
+	schema, err := gqlparser.LoadSchema(&ast.Source{Name: "backend", Input: sdl})
+	if err != nil {
+		return nil, fmt.Errorf("loading schema: %w", err)
+	}
+	return &loadedSchema{schema: schema, sdl: sdl, fetched: time.Now()}, nil
+}
+
+// introspectionToSDL renders an introspection result as schema language.
+// Descriptions and deprecations are left out; only what validation needs is
+// kept.
+func introspectionToSDL(s *introspectionSchema) string {
+	var b strings.Builder
+
+	b.WriteString("schema {\n")
+	if s.QueryType != nil {
+		fmt.Fprintf(&b, "  query: %s\n", s.QueryType.Name)
+	}
+	if s.MutationType != nil {
+		fmt.Fprintf(&b, "  mutation: %s\n", s.MutationType.Name)
+	}
+	if s.SubscriptionType != nil {
+		fmt.Fprintf(&b, "  subscription: %s\n", s.SubscriptionType.Name)
+	}
+	b.WriteString("}\n")
+
+	for _, d := range s.Directives {
+		if builtinSDL[d.Name] {
+			continue
+		}
+		fmt.Fprintf(&b, "\ndirective @%s%s", d.Name, sdlArgs(d.Args))
+		if d.IsRepeatable {
+			b.WriteString(" repeatable")
+		}
+		fmt.Fprintf(&b, " on %s\n", strings.Join(d.Locations, " | "))
+	}
+
+	for _, t := range s.Types {
+		if builtinSDL[t.Name] || strings.HasPrefix(t.Name, "__") {
+			continue
+		}
+		b.WriteString("\n")
+		switch t.Kind {
+		case "SCALAR":
+			fmt.Fprintf(&b, "scalar %s\n", t.Name)
+		case "OBJECT", "INTERFACE":
+			keyword := "type"
+			if t.Kind == "INTERFACE" {
+				keyword = "interface"
+			}
+			fmt.Fprintf(&b, "%s %s", keyword, t.Name)
+			if len(t.Interfaces) > 0 {
+				names := make([]string, len(t.Interfaces))
+				for i, iface := range t.Interfaces {
+					names[i] = iface.Name
+				}
+				fmt.Fprintf(&b, " implements %s", strings.Join(names, " & "))
+			}
+			b.WriteString(" {\n")
+			for _, f := range t.Fields {
+				fmt.Fprintf(&b, "  %s%s: %s\n", f.Name, sdlArgs(f.Args), sdlType(f.Type))
+			}
+			b.WriteString("}\n")
+		case "UNION":
+			names := make([]string, len(t.PossibleTypes))
+			for i, member := range t.PossibleTypes {
+				names[i] = member.Name
+			}
+			fmt.Fprintf(&b, "union %s = %s\n", t.Name, strings.Join(names, " | "))
+		case "ENUM":
+			fmt.Fprintf(&b, "enum %s {\n", t.Name)
+			for _, v := range t.EnumValues {
+				fmt.Fprintf(&b, "  %s\n", v.Name)
+			}
+			b.WriteString("}\n")
+		case "INPUT_OBJECT":
+			fmt.Fprintf(&b, "input %s {\n", t.Name)
+			for _, f := range t.InputFields {
+				fmt.Fprintf(&b, "  %s\n", sdlInputValue(f))
+			}
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+func sdlArgs(args []introspectionInputValue) string {
+	if len(args) == 0 {
+		return ""
+	}
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = sdlInputValue(arg)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func sdlInputValue(v introspectionInputValue) string {
+	s := v.Name + ": " + sdlType(v.Type)
+	if v.DefaultValue != nil {
+		s += " = " + *v.DefaultValue
+	}
+	return s
+}
+
+func sdlType(t introspectionTypeRef) string {
+	switch {
+	case t.Kind == "NON_NULL" && t.OfType != nil:
+		return sdlType(*t.OfType) + "!"
+	case t.Kind == "LIST" && t.OfType != nil:
+		return "[" + sdlType(*t.OfType) + "]"
+	default:
+		return t.Name
+	}
+}
+
+// validateAgainstSchema checks query against the loaded backend schema and
+// returns a description of the problems found, or "" if it is valid or no
+// schema has been loaded yet.
+func validateAgainstSchema(query string) string {
+	loaded := backendSchema.Load()
+	if loaded == nil {
+		return ""
+	}
+	doc, err := parseQuery(query)
+	if err != nil {
+		return err.Error()
+	}
+	errs := validator.Validate(loaded.schema, doc)
+	if len(errs) == 0 {
+		return ""
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// schemaHandler serves the cached backend schema as SDL at GET /schema. It
+// reveals as much as introspection does, so with DISABLE_INTROSPECTION it is
+// a 404 for clients outside INTROSPECTION_ALLOWED_CIDRS.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.DisableIntrospection && !ipInNets(clientIPFromRequest(r, cfg.TrustedProxies), cfg.IntrospectionAllowedCIDRs) {
+		notFoundHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	loaded := backendSchema.Load()
+	if loaded == nil {
+		http.Error(w, "Schema not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Last-Modified", loaded.fetched.UTC().Format(http.TimeFormat))
+	io.WriteString(w, loaded.sdl)
+}
+
+// refreshSchemaPeriodically re-fetches the schema every interval so changes
+// deployed to the backend are picked up without a restart.
+func refreshSchemaPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := refreshSchema(context.Background()); err != nil {
+			slog.Error("Schema refresh failed, keeping current schema", "err", err)
+		}
+	}
+}
+
+// adminSchemaRefreshHandler forces a schema refresh. A failed refresh keeps
+// the current schema and reports the error with a 502.
+func adminSchemaRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !schemaNeeded() {
+		http.Error(w, "Schema validation and the schema endpoint are disabled", http.StatusConflict)
+		return
+	}
+	if err := refreshSchema(r.Context()); err != nil {
+		slog.Error("Schema refresh failed, keeping current schema", "err", err)
+		http.Error(w, "Schema refresh failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	loaded := backendSchema.Load()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"types":   len(loaded.schema.Types),
+		"fetched": loaded.fetched,
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// introspectionResponse is a backend's introspection answer for a schema with
+// Query.items, Query.item(id:) and an Item type whose fields are given.
+func introspectionResponse(itemFields ...string) string {
+	fields := make([]string, len(itemFields))
+	for i, name := range itemFields {
+		fields[i] = `{"name":"` + name + `","args":[],"type":{"kind":"SCALAR","name":"String"}}`
+	}
+	return `{"data":{"__schema":{
+		"queryType":{"name":"Query"},"mutationType":null,"subscriptionType":null,
+		"types":[
+			{"kind":"OBJECT","name":"Query","fields":[
+				{"name":"items","args":[],"type":{"kind":"LIST","ofType":{"kind":"OBJECT","name":"Item"}}},
+				{"name":"item","args":[{"name":"id","type":{"kind":"NON_NULL","ofType":{"kind":"SCALAR","name":"ID"}},"defaultValue":null}],"type":{"kind":"OBJECT","name":"Item"}}
+			],"interfaces":[]},
+			{"kind":"OBJECT","name":"Item","fields":[` + strings.Join(fields, ",") + `],"interfaces":[]},
+			{"kind":"SCALAR","name":"String"},
+			{"kind":"OBJECT","name":"__Schema","fields":[]}
+		],
+		"directives":[{"name":"skip","isRepeatable":false,"locations":["FIELD"],"args":[]}]
+	}}}`
+}
+
+// schemaBackend answers introspection on path with the introspection response
+// currently in schema, or a 404 if it holds "", and everything else with an
+// empty data object.
+func schemaBackend(path string, schema *atomic.Value) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case !strings.Contains(string(body), "IntrospectionQuery"):
+			io.WriteString(w, `{"data":{}}`)
+		case r.URL.Path != path || schema.Load() == "":
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			io.WriteString(w, schema.Load().(string))
+		}
+	}
+}
+
+func useBackendSchema(t *testing.T) {
+	prev := backendSchema.Load()
+	t.Cleanup(func() { backendSchema.Store(prev) })
+	backendSchema.Store(nil)
+}
+
+func TestSchemaValidation(t *testing.T) {
+	var schema atomic.Value
+	schema.Store(introspectionResponse("id", "name"))
+	p := newTestProxy(t, map[string]string{"SCHEMA_VALIDATION": "true", "UPSTREAM_HEADERS": "X-Api-Key=k"}, schemaBackend("/public", &schema))
+	useBackendSchema(t)
+	if err := refreshSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	introspection := p.backend.last(t)
+	if introspection.Path != "/public" || introspection.Header.Get("X-Api-Key") != "k" {
+		t.Errorf("introspection sent to %s with headers %v, want the proxied route and upstream headers", introspection.Path, introspection.Header)
+	}
+
+	if resp, body := p.post(t, "/public", `{"query":"{ items { id name } }"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid query status = %d: %s", resp.StatusCode, body)
+	}
+	resp, body := p.post(t, "/public", `{"query":"{ items { id price } }"}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown field status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if msg := errorMessage(t, body); !strings.HasPrefix(msg, "Query does not match the schema: ") || !strings.Contains(msg, `"price"`) {
+		t.Errorf("message = %q", msg)
+	}
+	if resp, _ := p.post(t, "/public", `{"query":"{ item { id } }"}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing required argument status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestSchemaFetchUsesRoutePath(t *testing.T) {
+	var schema atomic.Value
+	schema.Store(introspectionResponse("id"))
+	newTestProxy(t, map[string]string{"GRAPHQL_ROUTES": "/graphql"}, schemaBackend("/graphql", &schema))
+	useBackendSchema(t)
+	if err := refreshSchema(context.Background()); err != nil {
+		t.Fatalf("refreshSchema: %v", err)
+	}
+}
+
+func TestValidateWithoutSchema(t *testing.T) {
+	useBackendSchema(t)
+	if problems := validateAgainstSchema("{ anything }"); problems != "" {
+		t.Errorf("validateAgainstSchema without a schema = %q", problems)
+	}
+}
+
+func TestIntrospectionToSDL(t *testing.T) {
+	def := `"x"`
+	s := &introspectionSchema{
+		QueryType:    &struct{ Name string }{"Query"},
+		MutationType: &struct{ Name string }{"Mutation"},
+		Types: []introspectionType{
+			{Kind: "OBJECT", Name: "Query", Fields: []introspectionField{
+				{Name: "node", Args: []introspectionInputValue{{Name: "id", Type: introspectionTypeRef{Kind: "NON_NULL", OfType: &introspectionTypeRef{Kind: "SCALAR", Name: "ID"}}}}, Type: introspectionTypeRef{Kind: "INTERFACE", Name: "Node"}},
+				{Name: "search", Args: []introspectionInputValue{{Name: "filter", Type: introspectionTypeRef{Kind: "INPUT_OBJECT", Name: "Filter"}}}, Type: introspectionTypeRef{Kind: "LIST", OfType: &introspectionTypeRef{Kind: "UNION", Name: "Result"}}},
+			}},
+			{Kind: "OBJECT", Name: "Mutation", Fields: []introspectionField{{Name: "buy", Type: introspectionTypeRef{Kind: "SCALAR", Name: "Boolean"}}}},
+			{Kind: "INTERFACE", Name: "Node", Fields: []introspectionField{{Name: "id", Type: introspectionTypeRef{Kind: "SCALAR", Name: "ID"}}}},
+			{Kind: "OBJECT", Name: "Item", Interfaces: []introspectionTypeRef{{Name: "Node"}}, Fields: []introspectionField{{Name: "id", Type: introspectionTypeRef{Kind: "SCALAR", Name: "ID"}}, {Name: "color", Type: introspectionTypeRef{Kind: "ENUM", Name: "Color"}}}},
+			{Kind: "UNION", Name: "Result", PossibleTypes: []introspectionTypeRef{{Name: "Item"}}},
+			{Kind: "ENUM", Name: "Color", EnumValues: []struct{ Name string }{{"RED"}, {"BLUE"}}},
+			{Kind: "INPUT_OBJECT", Name: "Filter", InputFields: []introspectionInputValue{{Name: "q", Type: introspectionTypeRef{Kind: "SCALAR", Name: "String"}, DefaultValue: &def}}},
+			{Kind: "SCALAR", Name: "DateTime"},
+			{Kind: "SCALAR", Name: "String"},
+		},
+		Directives: []introspectionDirective{
+			{Name: "auth", IsRepeatable: true, Locations: []string{"FIELD", "QUERY"}, Args: []introspectionInputValue{{Name: "role", Type: introspectionTypeRef{Kind: "SCALAR", Name: "String"}}}},
+			{Name: "include", Locations: []string{"FIELD"}},
+		},
+	}
+	sdl := introspectionToSDL(s)
+	for _, want := range []string{
+		"  mutation: Mutation\n",
+		"directive @auth(role: String) repeatable on FIELD | QUERY\n",
+		"  node(id: ID!): Node\n",
+		"  search(filter: Filter): [Result]\n",
+		"type Item implements Node {\n",
+		"union Result = Item\n",
+		"enum Color {\n  RED\n  BLUE\n}\n",
+		"input Filter {\n  q: String = \"x\"\n}\n",
+		"scalar DateTime\n",
+	} {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("SDL is missing %q:\n%s", want, sdl)
+		}
+	}
+	if strings.Contains(sdl, "scalar String") || strings.Contains(sdl, "@include") {
+		t.Errorf("SDL redefines built-ins:\n%s", sdl)
+	}
+	if _, err := gqlparser.LoadSchema(&ast.Source{Input: sdl}); err != nil {
+		t.Errorf("SDL does not load: %v\n%s", err, sdl)
+	}
+}
+
+func TestAdminSchemaRefreshHandler(t *testing.T) {
+	var schema atomic.Value
+	schema.Store(introspectionResponse("id"))
+	p := newTestProxy(t, map[string]string{"SCHEMA_VALIDATION": "true"}, schemaBackend("/public", &schema))
+	useBackendSchema(t)
+	refresh := func() *httptest.ResponseRecorder {
+		return serve(adminSchemaRefreshHandler, http.MethodPost, "/admin/schema/refresh", "", nil)
+	}
+	if rec := refresh(); rec.Code != http.StatusOK {
+		t.Fatalf("refresh = %d %s", rec.Code, rec.Body)
+	}
+	query := `{"query":"{ items { id name } }"}`
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("query against the old schema = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	schema.Store(introspectionResponse("id", "name"))
+	if rec := refresh(); rec.Code != http.StatusOK {
+		t.Fatalf("refresh = %d %s", rec.Code, rec.Body)
+	}
+	if resp, body := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("query after a forced refresh = %d %s", resp.StatusCode, body)
+	}
+
+	schema.Store("")
+	before := backendSchema.Load()
+	if rec := refresh(); rec.Code != http.StatusBadGateway {
+		t.Errorf("failed refresh = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if backendSchema.Load() != before {
+		t.Error("a failed refresh replaced the schema")
+	}
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("query after a failed refresh = %d, want the old schema kept", resp.StatusCode)
+	}
+
+	if rec := serve(adminSchemaRefreshHandler, http.MethodGet, "/admin/schema/refresh", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminSchemaRefreshDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"SCHEMA_VALIDATION": "false", "SCHEMA_ENDPOINT": "false"})
+	if rec := serve(adminSchemaRefreshHandler, http.MethodPost, "/admin/schema/refresh", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("refresh with the schema unused = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestSchemaHandler(t *testing.T) {
+	var schema atomic.Value
+	schema.Store(introspectionResponse("id", "name"))
+	newTestProxy(t, map[string]string{"SCHEMA_ENDPOINT": "true", "DISABLE_INTROSPECTION": "false"}, schemaBackend("/public", &schema))
+	useBackendSchema(t)
+
+	if rec := serve(schemaHandler, http.MethodGet, "/schema", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before the schema is loaded: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if err := refreshSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(schemaHandler, http.MethodGet, "/schema", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("status = %d, Content-Type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if body := rec.Body.String(); body != backendSchema.Load().sdl || !strings.Contains(body, "type Item {\n  id: String\n  name: String\n}") {
+		t.Errorf("body = %q, want the cached SDL", body)
+	}
+	if rec.Header().Get("Last-Modified") == "" {
+		t.Error("Last-Modified not set")
+	}
+	if rec := serve(schemaHandler, http.MethodPost, "/schema", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSchemaHandlerHiddenWithIntrospectionDisabled(t *testing.T) {
+	useConfig(t, map[string]string{"DISABLE_INTROSPECTION": "true", "INTROSPECTION_ALLOWED_CIDRS": "10.0.0.0/8"})
+	useBackendSchema(t)
+	backendSchema.Store(&loadedSchema{sdl: "type Query { a: String }\n"})
+
+	if rec := serve(schemaHandler, http.MethodGet, "/schema", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/schema", nil)
+	req.RemoteAddr = "10.1.2.3:5000"
+	rec := httptest.NewRecorder()
+	schemaHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("from an allowed network: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	shadowTimeout      = 10 * time.Second
+	shadowMaxBodyBytes = 1 << 20
+)
+
+var shadowRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "shadow_requests_total",
+	Help: "Queries mirrored to the shadow backend, by comparison result.",
+}, []string{"result"})
+
+type shadowDiff struct {
+	RequestID     string    `bson:"requestId"`
+	OperationName string    `bson:"operationName,omitempty"`
+	Query         string    `bson:"query"`
+	PrimaryStatus int       `bson:"primaryStatus"`
+	ShadowStatus  int       `bson:"shadowStatus"`
+	PrimaryBody   string    `bson:"primaryBody"`
+	ShadowBody    string    `bson:"shadowBody"`
+	Timestamp     time.Time `bson:"timestamp"`
+}
+
+// teeWriter copies up to limit bytes of the response while it streams to the
+// client, so the primary response can be compared with the shadow's.
+type teeWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if room := t.limit - t.buf.Len(); len(p) > room {
+		t.buf.Write(p[:room])
+		t.truncated = true
+	} else {
+		t.buf.Write(p)
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *teeWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// mirrorToShadow replays the forwarded request against the shadow backend in
+// the background and records any difference from the primary response. The
+// client has already been served by the time this runs.
+func mirrorToShadow(shadow *backend, r *http.Request, body []byte, primaryStatus int, primary *teeWriter) {
+	if primary.truncated {
+		shadowRequestsTotal.WithLabelValues("skipped").Inc()
+		return
+	}
+	rc := requestContextFrom(r.Context())
+	primaryBody := primary.buf.Bytes()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), shadowTimeout)
+	defer cancel()
+	req := r.Clone(ctx)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	resp := newBufferedResponse()
+	shadow.ServeHTTP(resp, req)
+
+	if resp.status == primaryStatus && sameJSON(primaryBody, resp.body.Bytes()) {
+		shadowRequestsTotal.WithLabelValues("match").Inc()
+		return
+	}
+	shadowRequestsTotal.WithLabelValues("diff").Inc()
+	conn := mongoConn.Load()
+	if conn == nil {
+		return
+	}
+
+	diff := shadowDiff{
+		RequestID:     rc.RequestID,
+		OperationName: rc.OperationName,
+		Query:         rc.SanitizedQuery,
+		PrimaryStatus: primaryStatus,
+		ShadowStatus:  resp.status,
+		PrimaryBody:   string(primaryBody),
+		ShadowBody:    string(resp.body.Bytes()[:min(resp.body.Len(), shadowMaxBodyBytes)]),
+		Timestamp:     time.Now(),
+	}
+	insertCtx, insertCancel := context.WithTimeout(context.Background(), logWriteTimeout)
+	defer insertCancel()
+	err := withMongoWriteSlot(insertCtx, func() error {
+		_, err := conn.shadow.InsertOne(insertCtx, diff)
+		return err
+	})
+	reportMongoResult(err)
+	if err != nil {
+		slog.Error("Error writing shadow diff to MongoDB", "err", err)
+	}
+}
+
+// sameJSON compares two bodies semantically when both are JSON, so key order
+// and whitespace differences are not reported.
+func sameJSON(a, b []byte) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(av, bv)
+}
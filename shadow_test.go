@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// waitForDiffs polls until shadow_requests_total{result="diff"} reaches n,
+// which mirrorToShadow records only after it is done with the request.
+func waitForDiffs(t *testing.T, n float64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("diff")) < n {
+		if time.Now().After(deadline) {
+			t.Fatal("shadow comparison not recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShadowBackend(t *testing.T) {
+	shadow := newStubBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"data":{"source":"shadow"}}`)
+	})
+	prev := mongoConn.Swap(nil)
+	t.Cleanup(func() { mongoConn.Store(prev) })
+	p := newTestProxy(t, map[string]string{"SHADOW_BACKEND_URL": shadow.URL}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"data":{"source":"primary"}}`)
+	})
+
+	diffs := testutil.ToFloat64(shadowRequestsTotal.WithLabelValues("diff"))
+	_, mutationBody := p.post(t, "/public", `{"query":"mutation { buy }"}`, nil)
+	_, queryBody := p.post(t, "/public", `{"query":"{ source }"}`, nil)
+	for _, body := range []string{mutationBody, queryBody} {
+		if body != `{"data":{"source":"primary"}}` {
+			t.Errorf("client got %s, want the primary response", body)
+		}
+	}
+
+	waitForDiffs(t, diffs+1)
+	// Give a mirrored mutation, if there were one, time to arrive too.
+	time.Sleep(50 * time.Millisecond)
+	got := shadow.received()
+	if len(got) != 1 || !strings.Contains(got[0].Body, "{ source }") {
+		t.Errorf("shadow received %+v, want only the query", got)
+	}
+}
+
+func TestMirrorToShadowRecordsDiffs(t *testing.T) {
+	mt := newMockMongo(t)
+	mirror := func(mt *mtest.T, shadowBody, primaryBody string) {
+		shadow := newStubBackend(mt.T, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, shadowBody)
+		})
+		target, _ := url.Parse(shadow.URL)
+		r := httptest.NewRequest(http.MethodPost, "/public", nil)
+		r = withRequestContext(r, &RequestContext{RequestID: "req-1", OperationName: "Items", SanitizedQuery: "{ items }"})
+		tee := &teeWriter{ResponseWriter: httptest.NewRecorder(), limit: shadowMaxBodyBytes}
+		tee.Write([]byte(primaryBody))
+		mirrorToShadow(newBackend(target, nil, nil), r, []byte(`{"query":"{ items }"}`), http.StatusOK, tee)
+	}
+
+	mt.Run("records a diff", func(mt *mtest.T) {
+		useConfig(mt.T, nil)
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		mirror(mt, `{"data":{"items":[2]}}`, `{"data":{"items":[1]}}`)
+
+		cmd := mt.GetStartedEvent()
+		if cmd == nil || cmd.CommandName != "insert" {
+			mt.Fatalf("command = %v, want an insert", cmd)
+		}
+		if coll := cmd.Command.Lookup("insert").StringValue(); coll != "shadow_diffs" {
+			mt.Errorf("inserted into %q", coll)
+		}
+		doc := cmd.Command.Lookup("documents").Array().Index(0).Value().Document()
+		if id := doc.Lookup("requestId").StringValue(); id != "req-1" {
+			mt.Errorf("requestId = %q", id)
+		}
+		if body := doc.Lookup("shadowBody").StringValue(); body != `{"data":{"items":[2]}}` {
+			mt.Errorf("shadowBody = %q", body)
+		}
+		if body := doc.Lookup("primaryBody").StringValue(); body != `{"data":{"items":[1]}}` {
+			mt.Errorf("primaryBody = %q", body)
+		}
+	})
+
+	mt.Run("ignores formatting differences", func(mt *mtest.T) {
+		useConfig(mt.T, nil)
+		useMockMongo(mt)
+		mirror(mt, `{"data": {"b": 2, "a": 1}}`, `{"data":{"a":1,"b":2}}`)
+		if cmd := mt.GetStartedEvent(); cmd != nil {
+			mt.Errorf("matching responses wrote %s", cmd.CommandName)
+		}
+	})
+}
+
+func TestTeeWriterTruncates(t *testing.T) {
+	rec := httptest.NewRecorder()
+	tee := &teeWriter{ResponseWriter: rec, limit: 4}
+	tee.Write([]byte("abc"))
+	tee.Write([]byte("defg"))
+	if tee.buf.String() != "abcd" || !tee.truncated {
+		t.Errorf("copy = %q, truncated = %v", tee.buf.String(), tee.truncated)
+	}
+	if rec.Body.String() != "abcdefg" {
+		t.Errorf("client got %q, want the whole body", rec.Body)
+	}
+}
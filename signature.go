@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const signatureHeader = "X-Signature"
+
+// verifySignature checks a hex-encoded HMAC-SHA256 of body, optionally
+// prefixed with "sha256=" as GitHub-style webhooks send it.
+func verifySignature(body []byte, signature string, secret []byte) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
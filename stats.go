@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultStatsWindow = time.Hour
+	defaultStatsTop    = 10
+)
+
+type statsCount struct {
+	Key   string `bson:"_id" json:"key"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+type statsResult struct {
+	Total []struct {
+		Count int64 `bson:"count"`
+	} `bson:"total"`
+	TopOperations []statsCount `bson:"topOperations"`
+	TopIPs        []statsCount `bson:"topIPs"`
+}
+
+// statsPipeline counts the entries logged since since, with the top
+// operations and client IPs by request count, in a single $facet pass.
+func statsPipeline(since time.Time, top int) mongo.Pipeline {
+	topBy := func(field string) bson.A {
+		return bson.A{
+			bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$" + field}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+			bson.D{{Key: "$limit", Value: top}},
+		}
+	}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+		{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "count"}}}},
+			{Key: "topOperations", Value: topBy("operationName")},
+			{Key: "topIPs", Value: topBy("ip")},
+		}}},
+	}
+}
+
+// adminStatsHandler summarizes the logged traffic over ?window= (default 1h)
+// with the ?top= (default 10, at most ADMIN_LOGS_MAX_LIMIT) busiest operations
+// and IPs. Anonymous operations are grouped under an empty key.
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn := mongoConn.Load()
+	if conn == nil {
+		http.Error(w, "MongoDB is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	window := defaultStatsWindow
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid window parameter", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	top := defaultStatsTop
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid top parameter", http.StatusBadRequest)
+			return
+		}
+		top = min(n, cfg.MaxLogsLimit)
+	}
+
+	since := time.Now().Add(-window)
+	cursor, err := conn.logs.Aggregate(r.Context(), statsPipeline(since, top))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error aggregating MongoDB logs", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var results []statsResult
+	if err := cursor.All(r.Context(), &results); err != nil {
+		slog.ErrorContext(r.Context(), "Error decoding MongoDB stats", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	stats := map[string]interface{}{
+		"window":        window.String(),
+		"since":         since,
+		"total":         int64(0),
+		"topOperations": []statsCount{},
+		"topIPs":        []statsCount{},
+	}
+	if len(results) > 0 {
+		if len(results[0].Total) > 0 {
+			stats["total"] = results[0].Total[0].Count
+		}
+		if results[0].TopOperations != nil {
+			stats["topOperations"] = results[0].TopOperations
+		}
+		if results[0].TopIPs != nil {
+			stats["topIPs"] = results[0].TopIPs
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
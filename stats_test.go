@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAdminStatsHandler(t *testing.T) {
+	mt := newMockMongo(t)
+	count := func(key string, n int) bson.D {
+		return bson.D{{Key: "_id", Value: key}, {Key: "count", Value: n}}
+	}
+
+	mt.Run("returns the aggregated stats", func(mt *mtest.T) {
+		useConfig(mt.T, map[string]string{"ADMIN_LOGS_MAX_LIMIT": "5"})
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.logs", mtest.FirstBatch, bson.D{
+			{Key: "total", Value: bson.A{bson.D{{Key: "count", Value: 42}}}},
+			{Key: "topOperations", Value: bson.A{count("Items", 30), count("", 12)}},
+			{Key: "topIPs", Value: bson.A{count("203.0.113.7", 40), count("198.51.100.2", 2)}},
+		}))
+
+		before := time.Now()
+		rec := serve(adminStatsHandler, http.MethodGet, "/admin/stats?window=30m&top=50", "", nil)
+		if rec.Code != http.StatusOK {
+			mt.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var stats struct {
+			Window        string       `json:"window"`
+			Since         time.Time    `json:"since"`
+			Total         int64        `json:"total"`
+			TopOperations []statsCount `json:"topOperations"`
+			TopIPs        []statsCount `json:"topIPs"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			mt.Fatal(err)
+		}
+		if stats.Window != "30m0s" || stats.Total != 42 {
+			mt.Errorf("window = %q, total = %d", stats.Window, stats.Total)
+		}
+		if len(stats.TopOperations) != 2 || stats.TopOperations[0] != (statsCount{"Items", 30}) || stats.TopOperations[1] != (statsCount{"", 12}) {
+			mt.Errorf("topOperations = %+v", stats.TopOperations)
+		}
+		if len(stats.TopIPs) != 2 || stats.TopIPs[0] != (statsCount{"203.0.113.7", 40}) {
+			mt.Errorf("topIPs = %+v", stats.TopIPs)
+		}
+
+		cmd := mt.GetStartedEvent().Command
+		stages, err := cmd.Lookup("pipeline").Array().Values()
+		if err != nil || len(stages) != 2 {
+			mt.Fatalf("pipeline = %v", cmd.Lookup("pipeline"))
+		}
+		since := stages[0].Document().Lookup("$match", "timestamp", "$gte").Time()
+		if want := before.Add(-30 * time.Minute); since.Before(want.Add(-time.Second)) || since.After(want.Add(time.Second)) {
+			mt.Errorf("$match since %v, want about %v", since, want)
+		}
+		limit := stages[1].Document().Lookup("$facet", "topIPs").Array().Index(2).Value().Document().Lookup("$limit").AsInt64()
+		if limit != 5 {
+			mt.Errorf("$limit = %d, want top capped at 5", limit)
+		}
+	})
+
+	mt.Run("empty window", func(mt *mtest.T) {
+		useConfig(mt.T, nil)
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.logs", mtest.FirstBatch, bson.D{
+			{Key: "total", Value: bson.A{}},
+			{Key: "topOperations", Value: bson.A{}},
+			{Key: "topIPs", Value: bson.A{}},
+		}))
+		rec := serve(adminStatsHandler, http.MethodGet, "/admin/stats", "", nil)
+		if rec.Code != http.StatusOK {
+			mt.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var stats map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			mt.Fatal(err)
+		}
+		if stats["window"] != "1h0m0s" || stats["total"] != float64(0) {
+			mt.Errorf("stats = %v", stats)
+		}
+		for _, key := range []string{"topOperations", "topIPs"} {
+			if list, ok := stats[key].([]interface{}); !ok || len(list) != 0 {
+				mt.Errorf("%s = %v, want an empty list", key, stats[key])
+			}
+		}
+	})
+
+	mt.Run("aggregation failure", func(mt *mtest.T) {
+		useConfig(mt.T, nil)
+		useMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Message: "unauthorized"}))
+		if rec := serve(adminStatsHandler, http.MethodGet, "/admin/stats", "", nil); rec.Code != http.StatusInternalServerError {
+			mt.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+		}
+	})
+
+	mt.Run("rejects bad parameters", func(mt *mtest.T) {
+		useConfig(mt.T, nil)
+		useMockMongo(mt)
+		for _, target := range []string{"/admin/stats?window=x", "/admin/stats?window=-1h", "/admin/stats?top=0", "/admin/stats?top=x"} {
+			if rec := serve(adminStatsHandler, http.MethodGet, target, "", nil); rec.Code != http.StatusBadRequest {
+				mt.Errorf("%s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+			}
+		}
+		if rec := serve(adminStatsHandler, http.MethodPost, "/admin/stats", "", nil); rec.Code != http.StatusMethodNotAllowed {
+			mt.Errorf("POST: status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestAdminStatsRequiresAdminToken(t *testing.T) {
+	useConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	prev := mongoConn.Swap(nil)
+	t.Cleanup(func() { mongoConn.Store(prev) })
+
+	if rec := serve(requireAdmin(adminStatsHandler), http.MethodGet, "/admin/stats", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := serve(requireAdmin(adminStatsHandler), http.MethodGet, "/admin/stats", "", map[string]string{"Authorization": "Bearer secret"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("with token and no MongoDB: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
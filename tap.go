@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	tapBufferSize        = 256
+	tapHeartbeatInterval = 15 * time.Second
+)
+
+var tapDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "tap_events_dropped_total",
+	Help: "Log entries not delivered to an /admin/tap subscriber that fell behind.",
+})
+
+// tapSubscriber is one /admin/tap client. Entries are offered to it without
+// blocking, so a slow client only loses entries on its own stream.
+type tapSubscriber struct {
+	ip            string
+	operationName string
+	entries       chan logEntry
+	done          <-chan struct{}
+}
+
+func (s *tapSubscriber) wants(entry logEntry) bool {
+	return (s.ip == "" || s.ip == entry.IP) &&
+		(s.operationName == "" || s.operationName == entry.OperationName)
+}
+
+var (
+	tapMu          sync.Mutex
+	tapSubscribers = make(map[*tapSubscriber]struct{})
+	// tapDone is closed by stopTaps to end every stream, so open taps don't
+	// hold up a graceful shutdown until it times out.
+	tapDone    = make(chan struct{})
+	tapStopped bool
+)
+
+// stopTaps ends the /admin/tap streams. It is registered with each server's
+// RegisterOnShutdown, so it may run more than once.
+func stopTaps() {
+	tapMu.Lock()
+	defer tapMu.Unlock()
+	if !tapStopped {
+		tapStopped = true
+		close(tapDone)
+	}
+}
+
+func publishTap(entry logEntry) {
+	tapMu.Lock()
+	defer tapMu.Unlock()
+	for sub := range tapSubscribers {
+		if !sub.wants(entry) {
+			continue
+		}
+		select {
+		case sub.entries <- entry:
+		default:
+			tapDroppedTotal.Inc()
+		}
+	}
+}
+
+func subscribeTap(ip, operationName string) *tapSubscriber {
+	sub := &tapSubscriber{ip: ip, operationName: operationName, entries: make(chan logEntry, tapBufferSize)}
+	tapMu.Lock()
+	sub.done = tapDone
+	tapSubscribers[sub] = struct{}{}
+	tapMu.Unlock()
+	return sub
+}
+
+func unsubscribeTap(sub *tapSubscriber) {
+	tapMu.Lock()
+	delete(tapSubscribers, sub)
+	tapMu.Unlock()
+}
+
+// adminTapHandler streams log entries as Server-Sent Events until the client
+// disconnects or the server shuts down, optionally filtered by ?ip= and ?operationName=.
+func adminTapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	sub := subscribeTap(r.URL.Query().Get("ip"), r.URL.Query().Get("operationName"))
+	defer unsubscribeTap(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(tapHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case entry := <-sub.entries:
+			data, _ := json.Marshal(entry)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
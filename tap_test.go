@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func tapSubscriberCount() int {
+	tapMu.Lock()
+	defer tapMu.Unlock()
+	return len(tapSubscribers)
+}
+
+func TestAdminTapStreamsEntries(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	tap := httptest.NewServer(http.HandlerFunc(adminTapHandler))
+	t.Cleanup(tap.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, tap.URL+"/admin/tap?operationName=Items", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	p.post(t, "/public", `{"query":"query Other { a }"}`, nil)
+	p.post(t, "/public", `{"query":"query Items { items }"}`, nil)
+
+	events := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				events <- data
+				return
+			}
+		}
+	}()
+	select {
+	case data := <-events:
+		var entry logEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			t.Fatalf("event %q: %v", data, err)
+		}
+		if entry.OperationName != "Items" {
+			t.Errorf("streamed operation = %q, want the filtered Items", entry.OperationName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event streamed")
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for tapSubscriberCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber left behind after the client disconnected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAdminTapEndsOnShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		tapMu.Lock()
+		tapDone, tapStopped = make(chan struct{}), false
+		tapMu.Unlock()
+	})
+	tap := httptest.NewUnstartedServer(http.HandlerFunc(adminTapHandler))
+	tap.Config.RegisterOnShutdown(stopTaps)
+	tap.Start()
+	t.Cleanup(tap.Close)
+
+	resp, err := http.Get(tap.URL + "/admin/tap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tap.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown with an open tap: %v", err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("reading the ended stream: %v", err)
+	}
+	if n := tapSubscriberCount(); n != 0 {
+		t.Errorf("%d subscribers left after shutdown, want 0", n)
+	}
+}
+
+func TestTapDropsForSlowSubscriber(t *testing.T) {
+	sub := subscribeTap("", "")
+	defer unsubscribeTap(sub)
+	other := subscribeTap("203.0.113.7", "")
+	defer unsubscribeTap(other)
+
+	dropped := testutil.ToFloat64(tapDroppedTotal)
+	for i := 0; i < tapBufferSize+3; i++ {
+		publishTap(logEntry{IP: "198.51.100.1"})
+	}
+	if v := testutil.ToFloat64(tapDroppedTotal) - dropped; v != 3 {
+		t.Errorf("tap_events_dropped_total rose by %v, want 3", v)
+	}
+	if n := len(sub.entries); n != tapBufferSize {
+		t.Errorf("subscriber holds %d entries, want a full buffer of %d", n, tapBufferSize)
+	}
+	if n := len(other.entries); n != 0 {
+		t.Errorf("filtered subscriber received %d entries", n)
+	}
+}
+
+func TestAdminTapMethod(t *testing.T) {
+	if rec := serve(adminTapHandler, http.MethodPost, "/admin/tap", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+)
+
+// startTestBackend serves the stub backend used in TEST_MODE on a loopback
+// port and points BACKEND_URL at it, so the proxy runs without any external
+// service. The stub answers with TEST_BACKEND_RESPONSE if set, and otherwise
+// echoes the forwarded request back as {"data":{"echo":...}}.
+func startTestBackend() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if cfg.TestBackendResponse != "" {
+			io.WriteString(w, cfg.TestBackendResponse)
+			return
+		}
+		var request interface{}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil {
+			request = string(body)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"echo": request},
+		})
+	})
+	go http.Serve(ln, handler)
+
+	// Set in the environment, not just used once, so SIGHUP reloads keep it.
+	url := "http://" + ln.Addr().String()
+	os.Setenv("BACKEND_URL", url)
+	slog.Warn("TEST_MODE: using stub backend and in-memory logs", "backend", url)
+	return nil
+}
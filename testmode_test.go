@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestTestModeEchoBackend(t *testing.T) {
+	t.Setenv("BACKEND_URL", "")
+	useConfig(t, map[string]string{"TEST_MODE": "true", "TEST_BACKEND_RESPONSE": ""})
+	if err := startTestBackend(); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, map[string]string{"BACKEND_URL": os.Getenv("BACKEND_URL")}, nil)
+
+	resp, body := p.post(t, "/public", `{"query":"query Items($n: Int) { items(first: $n) }","variables":{"n":2}}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	var echoed struct {
+		Data struct {
+			Echo map[string]interface{} `json:"echo"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(body), &echoed); err != nil {
+		t.Fatal(err)
+	}
+	if q := echoed.Data.Echo["query"]; q != "query Items($n: Int) { items(first: $n) }" {
+		t.Errorf("echoed query = %v", q)
+	}
+	if vars, _ := echoed.Data.Echo["variables"].(map[string]interface{}); vars["n"] != float64(2) {
+		t.Errorf("echoed variables = %v", echoed.Data.Echo["variables"])
+	}
+	if entry := p.lastLog(t); entry.OperationName != "Items" || entry.Status != http.StatusOK {
+		t.Errorf("logged %q with status %d", entry.OperationName, entry.Status)
+	}
+
+	useConfig(t, map[string]string{"TEST_BACKEND_RESPONSE": `{"data":{"fixed":true}}`})
+	if _, body := p.post(t, "/public", `{"query":"{ a }"}`, nil); body != `{"data":{"fixed":true}}` {
+		t.Errorf("body = %s, want TEST_BACKEND_RESPONSE", body)
+	}
+}
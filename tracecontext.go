@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// traceIDFrom returns the trace ID of a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or "" if it is missing or invalid.
+// traceparent and tracestate themselves are forwarded to the backend
+// untouched like any other end-to-end header; only the ID is kept here, to
+// correlate our logs with the client's trace.
+func traceIDFrom(r *http.Request) string {
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	// Version 00 has exactly four fields; later versions may append more.
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return ""
+	}
+	if !isLowerHex(traceID, 32) || !isLowerHex(parentID, 16) || !isLowerHex(flags, 2) {
+		return ""
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return ""
+	}
+	return traceID
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && (s[i] < 'a' || s[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
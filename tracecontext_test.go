@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTraceIDFrom(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name, header, want string
+	}{
+		{"valid", "00-" + traceID + "-00f067aa0ba902b7-01", traceID},
+		{"surrounding space", " 00-" + traceID + "-00f067aa0ba902b7-01 ", traceID},
+		{"future version with extra fields", "01-" + traceID + "-00f067aa0ba902b7-01-extra", traceID},
+		{"missing", "", ""},
+		{"too few fields", "00-" + traceID + "-01", ""},
+		{"version 00 with extra fields", "00-" + traceID + "-00f067aa0ba902b7-01-extra", ""},
+		{"invalid version", "ff-" + traceID + "-00f067aa0ba902b7-01", ""},
+		{"uppercase trace id", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ""},
+		{"short trace id", "00-4bf92f35-00f067aa0ba902b7-01", ""},
+		{"all-zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+		{"all-zero parent id", "00-" + traceID + "-0000000000000000-01", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/public", nil)
+			if tt.header != "" {
+				r.Header.Set("traceparent", tt.header)
+			}
+			if got := traceIDFrom(r); got != tt.want {
+				t.Errorf("traceIDFrom(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	const (
+		traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		tracestate  = "shop=t61rcWkgMzE,vendor=00f067aa0ba902b7"
+	)
+	p := newTestProxy(t, nil, nil)
+	resp, _ := p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"traceparent": traceparent, "tracestate": tracestate})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	upstream := p.backend.last(t).Header
+	if upstream.Get("traceparent") != traceparent || upstream.Get("tracestate") != tracestate {
+		t.Errorf("upstream traceparent = %q, tracestate = %q", upstream.Get("traceparent"), upstream.Get("tracestate"))
+	}
+	if id := p.lastLog(t).TraceID; id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("logged trace ID = %q", id)
+	}
+
+	p.post(t, "/public", `{"query":"{ a }"}`, map[string]string{"traceparent": "garbage"})
+	if got := p.backend.last(t).Header.Get("traceparent"); got != "garbage" {
+		t.Errorf("upstream traceparent = %q, want an invalid header forwarded untouched", got)
+	}
+	if id := p.lastLog(t).TraceID; id != "" {
+		t.Errorf("logged trace ID = %q for an invalid traceparent", id)
+	}
+}
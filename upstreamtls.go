@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSConfig builds the TLS settings for HTTPS backends from
+// BACKEND_TLS_MIN_VERSION, BACKEND_TLS_CIPHERS, BACKEND_CA_FILE and
+// BACKEND_INSECURE_SKIP_VERIFY. Ciphers only apply below TLS 1.3, whose
+// suites are not configurable.
+func upstreamTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[cfg.BackendTLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid BACKEND_TLS_MIN_VERSION %q", cfg.BackendTLSMinVersion)
+	}
+	config := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: cfg.BackendInsecureSkipVerify,
+	}
+
+	if len(cfg.BackendTLSCiphers) > 0 {
+		byName := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			byName[suite.Name] = suite.ID
+		}
+		for _, name := range cfg.BackendTLSCiphers {
+			id, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q in BACKEND_TLS_CIPHERS", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	if cfg.BackendCAFile != "" {
+		pem, err := os.ReadFile(cfg.BackendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading BACKEND_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in BACKEND_CA_FILE %s", cfg.BackendCAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
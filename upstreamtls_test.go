@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTLSBackend starts an HTTPS backend with a self-signed certificate, and
+// writes that certificate to a PEM file usable as BACKEND_CA_FILE.
+func newTLSBackend(t *testing.T, maxVersion uint16) (*httptest.Server, string) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"data":{"secure":true}}`)
+	}))
+	srv.TLS = &tls.Config{MaxVersion: maxVersion}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+func TestUpstreamCustomCA(t *testing.T) {
+	backend, caFile := newTLSBackend(t, 0)
+	query := `{"query":"{ secure }"}`
+
+	p := newTestProxy(t, map[string]string{"BACKEND_URL": backend.URL, "BACKEND_CA_FILE": caFile}, nil)
+	if resp, body := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusOK || body != `{"data":{"secure":true}}` {
+		t.Errorf("with the CA: %d %s", resp.StatusCode, body)
+	}
+
+	p = newTestProxy(t, map[string]string{"BACKEND_URL": backend.URL, "BACKEND_CA_FILE": ""}, nil)
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("without the CA: status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+
+	p = newTestProxy(t, map[string]string{"BACKEND_URL": backend.URL, "BACKEND_CA_FILE": "", "BACKEND_INSECURE_SKIP_VERIFY": "true"}, nil)
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("skipping verification: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestUpstreamMinTLSVersion(t *testing.T) {
+	backend, caFile := newTLSBackend(t, tls.VersionTLS12)
+	query := `{"query":"{ secure }"}`
+
+	p := newTestProxy(t, map[string]string{"BACKEND_URL": backend.URL, "BACKEND_CA_FILE": caFile, "BACKEND_TLS_MIN_VERSION": "1.2"}, nil)
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("TLS 1.2 backend with minimum 1.2: status = %d", resp.StatusCode)
+	}
+	p = newTestProxy(t, map[string]string{"BACKEND_URL": backend.URL, "BACKEND_CA_FILE": caFile, "BACKEND_TLS_MIN_VERSION": "1.3"}, nil)
+	if resp, _ := p.post(t, "/public", query, nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("TLS 1.2 backend with minimum 1.3: status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(notPEM, []byte("nothing here"), 0o600)
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"unknown version", map[string]string{"BACKEND_TLS_MIN_VERSION": "2.0"}},
+		{"unknown cipher", map[string]string{"BACKEND_TLS_CIPHERS": "TLS_NOPE"}},
+		{"insecure cipher", map[string]string{"BACKEND_TLS_CIPHERS": "TLS_RSA_WITH_RC4_128_SHA"}},
+		{"missing CA file", map[string]string{"BACKEND_CA_FILE": filepath.Join(t.TempDir(), "missing.pem")}},
+		{"CA file without certificates", map[string]string{"BACKEND_CA_FILE": notPEM}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.env)
+			if _, err := upstreamTLSConfig(); err == nil {
+				t.Error("upstreamTLSConfig succeeded")
+			}
+		})
+	}
+
+	useConfig(t, map[string]string{"BACKEND_TLS_MIN_VERSION": "1.2", "BACKEND_TLS_CIPHERS": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "BACKEND_CA_FILE": ""})
+	config, err := upstreamTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("config = %+v", config)
+	}
+}
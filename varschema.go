@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// variableSchemas holds the compiled VARIABLE_SCHEMAS, keyed by operation
+// name.
+var variableSchemas map[string]*jsonschema.Schema
+
+// loadVariableSchemas compiles the JSON Schema files named in
+// VARIABLE_SCHEMAS, such as CreateOrder=schemas/create-order.json, so a bad
+// schema fails at startup.
+func loadVariableSchemas() error {
+	compiler := jsonschema.NewCompiler()
+	schemas := make(map[string]*jsonschema.Schema, len(cfg.VariableSchemas))
+	for operation, path := range cfg.VariableSchemas {
+		schema, err := compiler.Compile(path)
+		if err != nil {
+			return fmt.Errorf("compiling variable schema for %s: %w", operation, err)
+		}
+		schemas[operation] = schema
+	}
+	variableSchemas = schemas
+	return nil
+}
+
+// checkVariableSchema validates variables against the schema registered for
+// operationName and describes each mismatch, or returns "" if they conform or
+// no schema is registered. Missing variables are validated as an empty
+// object so required properties are still enforced.
+func checkVariableSchema(operationName string, variables map[string]interface{}) string {
+	schema, ok := variableSchemas[operationName]
+	if !ok {
+		return ""
+	}
+	if variables == nil {
+		variables = map[string]interface{}{}
+	}
+	err := schema.Validate(variables)
+	if err == nil {
+		return ""
+	}
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err.Error()
+	}
+	var problems []string
+	for _, unit := range verr.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		problems = append(problems, fmt.Sprintf("at '%s': %s", location, unit.Error))
+	}
+	return strings.Join(problems, "; ")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const buySchema = `{
+	"type": "object",
+	"required": ["id", "qty"],
+	"properties": {
+		"id": {"type": "string"},
+		"qty": {"type": "integer", "minimum": 1, "maximum": 10}
+	},
+	"additionalProperties": false
+}`
+
+// useVariableSchemas writes schemas to files, registers them through
+// VARIABLE_SCHEMAS and loads them as at startup.
+func useVariableSchemas(t *testing.T, env map[string]string, schemas map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	var entries []string
+	for operation, schema := range schemas {
+		path := filepath.Join(dir, operation+".json")
+		if err := os.WriteFile(path, []byte(schema), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, operation+"="+path)
+	}
+	env["VARIABLE_SCHEMAS"] = strings.Join(entries, ",")
+	useConfig(t, env)
+	prev := variableSchemas
+	t.Cleanup(func() { variableSchemas = prev })
+	if err := loadVariableSchemas(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckVariableSchema(t *testing.T) {
+	useVariableSchemas(t, map[string]string{}, map[string]string{"Buy": buySchema})
+	tests := []struct {
+		name      string
+		operation string
+		variables map[string]interface{}
+		want      []string
+	}{
+		{"conforming", "Buy", map[string]interface{}{"id": "a1", "qty": float64(2)}, nil},
+		{"wrong type", "Buy", map[string]interface{}{"id": "a1", "qty": "2"}, []string{"at '/qty'"}},
+		{"out of range", "Buy", map[string]interface{}{"id": "a1", "qty": float64(11)}, []string{"at '/qty'"}},
+		{"missing variables", "Buy", nil, []string{"at '/'", "id", "qty"}},
+		{"unexpected variable", "Buy", map[string]interface{}{"id": "a1", "qty": float64(1), "admin": true}, []string{"admin"}},
+		{"no schema registered", "Browse", map[string]interface{}{"anything": true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := checkVariableSchema(tt.operation, tt.variables)
+			if (problems == "") != (tt.want == nil) {
+				t.Fatalf("checkVariableSchema = %q", problems)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(problems, want) {
+					t.Errorf("problems %q do not mention %q", problems, want)
+				}
+			}
+		})
+	}
+}
+
+func TestVariableSchemaValidation(t *testing.T) {
+	p := newTestProxy(t, nil, nil)
+	useVariableSchemas(t, map[string]string{"BACKEND_URL": p.backend.URL, "AUDIT_LOG": "false"}, map[string]string{"Buy": buySchema})
+	mutation := `"query":"mutation Buy($id: ID!, $qty: Int!) { buy(id: $id, qty: $qty) }"`
+
+	if resp, body := p.post(t, "/public", `{`+mutation+`,"variables":{"id":"a1","qty":3}}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("conforming variables: status = %d: %s", resp.StatusCode, body)
+	}
+	resp, body := p.post(t, "/public", `{`+mutation+`,"variables":{"id":"a1","qty":0}}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("non-conforming variables: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if msg := errorMessage(t, body); !strings.HasPrefix(msg, "Variables do not match the schema for Buy: at '/qty'") {
+		t.Errorf("message = %q", msg)
+	}
+	if n := len(p.backend.received()); n != 1 {
+		t.Errorf("backend received %d requests, want 1", n)
+	}
+}
+
+func TestLoadVariableSchemasFails(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.json")
+	os.WriteFile(broken, []byte(`{"type": 5}`), 0o600)
+	for name, path := range map[string]string{"missing file": filepath.Join(dir, "missing.json"), "invalid schema": broken} {
+		t.Run(name, func(t *testing.T) {
+			useConfig(t, map[string]string{"VARIABLE_SCHEMAS": "Buy=" + path})
+			prev := variableSchemas
+			t.Cleanup(func() { variableSchemas = prev })
+			if err := loadVariableSchemas(); err == nil {
+				t.Error("loadVariableSchemas succeeded")
+			}
+		})
+	}
+}